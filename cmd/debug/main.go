@@ -34,7 +34,11 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
-	netEngine := engine.NewUringNetEngine()
+	netEngine, err := engine.NewNetEngine()
+	if err != nil {
+		slog.Error("Failed engine.NewNetEngine()", "error", err)
+		os.Exit(1)
+	}
 	defer func() {
 		err := netEngine.Close()
 		if err != nil {
@@ -60,7 +64,7 @@ func main() {
 	liveApp.Run(ctx)
 	networkServer := server.NewNetworkServer(netEngine, config, nil, realTimeApp)
 
-	err := networkServer.Listen(ctx)
+	err = networkServer.Listen(ctx)
 	if err != nil {
 		slog.Error("Failed networkServer.Listen()", "error", err)
 		os.Exit(1)
@@ -3,10 +3,12 @@ package main
 import (
 	"context"
 	"flag"
-	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 
 	"github.com/touka-aoi/low-level-server/core/engine"
@@ -20,6 +22,36 @@ func main() {
 		host  = flag.String("host", "0.0.0.0", "Host to listen on")
 		port  = flag.Int("port", 8080, "Port to listen on")
 		debug = flag.Bool("debug", false, "Enable debug logging")
+
+		noDelay       = flag.Bool("tcp-nodelay", false, "Set TCP_NODELAY on connections")
+		deferAccept   = flag.Duration("defer-accept", 0, "Delay accepting connections until data arrives, up to this long (TCP_DEFER_ACCEPT, 0 disables)")
+		keepAliveIdle = flag.Duration("keepalive-idle", 0, "Enable TCP keepalive probes after this much idle time (0 keeps the system default)")
+		userTimeout   = flag.Duration("tcp-user-timeout", 0, "Close connections whose sent data stays unacknowledged this long (TCP_USER_TIMEOUT, 0 disables)")
+		backlog       = flag.Int("backlog", 0, "Listen backlog (0 uses the default)")
+
+		unixSocket = flag.String("unix", "", "Listen on this unix socket path instead of TCP (@name uses the abstract namespace)")
+		unixMode   = flag.Uint("unix-mode", 0, "Permission bits for the unix socket file, e.g. 0660 (0 keeps the umask)")
+
+		sqPollIdle = flag.Duration("sqpoll-idle", 0, "Enable io_uring SQPOLL with the given idle time (0 disables)")
+		sqPollCPU  = flag.Int("sqpoll-cpu", -1, "Pin the SQPOLL thread to this CPU (-1 disables)")
+		fixedFiles = flag.Int("fixed-files", 0, "Register a fixed file table with this many slots (0 disables)")
+		directAcc  = flag.Bool("direct-accept", false, "Accept connections straight into the fixed file table (needs -fixed-files)")
+		zeroCopy   = flag.Bool("zero-copy-recv", false, "Hand provided buffers to the application without copying")
+		zcSend     = flag.Int("zero-copy-send", 0, "Use IORING_OP_SEND_ZC for writes of at least this many bytes (0 disables)")
+		reactors   = flag.Int("reactors", 1, "Number of event loops sharing the port with SO_REUSEPORT (0 uses one per CPU)")
+		pinCPU     = flag.Bool("pin-cpu", false, "Pin each reactor thread to its own CPU")
+
+		idleTimeout   = flag.Duration("idle-timeout", 0, "Close connections idle for this long (0 disables)")
+		headerTimeout = flag.Duration("header-timeout", 0, "Close connections that do not send a full request header within this time (0 disables)")
+		writeTimeout  = flag.Duration("write-timeout", 0, "Close connections whose writes make no progress for this long (0 disables)")
+		drainTimeout  = flag.Duration("drain-timeout", 0, "How long to wait for connections to close on shutdown (0 uses the default)")
+
+		maxConns      = flag.Int("max-conns", 0, "Maximum number of concurrent connections (0 disables)")
+		maxConnsPerIP = flag.Int("max-conns-per-ip", 0, "Maximum number of concurrent connections per source IP (0 disables)")
+		acceptRate    = flag.Float64("accept-rate", 0, "Maximum number of connections accepted per second (0 disables)")
+		acceptBurst   = flag.Int("accept-burst", 0, "Number of connections accepted in a burst above -accept-rate (0 uses one second's worth)")
+		allowCIDRs    = flag.String("allow", "", "Comma-separated CIDRs to accept connections from (empty allows all)")
+		denyCIDRs     = flag.String("deny", "", "Comma-separated CIDRs to reject connections from")
 	)
 	flag.Parse()
 
@@ -34,37 +66,112 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
-	// Create io_uring engine
-	netEngine := engine.NewUringNetEngine()
-	defer netEngine.Close()
+	// Create network engine (falls back to epoll when io_uring is unavailable)
+	var uringOpts []engine.UringOption
+	if *sqPollIdle > 0 {
+		uringOpts = append(uringOpts, engine.WithSQPoll(*sqPollIdle), engine.WithSQThreadCPU(*sqPollCPU))
+	}
+	if *fixedFiles > 0 {
+		uringOpts = append(uringOpts, engine.WithFixedFiles(*fixedFiles))
+	}
+	if *directAcc {
+		uringOpts = append(uringOpts, engine.WithDirectAccept())
+	}
+	if *zeroCopy {
+		uringOpts = append(uringOpts, engine.WithZeroCopyReceive())
+	}
+	if *zcSend > 0 {
+		uringOpts = append(uringOpts, engine.WithZeroCopySend(*zcSend))
+	}
+
+	// Create admission filter
+	var admit server.AdmissionFunc
+	if *allowCIDRs != "" || *denyCIDRs != "" {
+		filter, err := server.NewCIDRFilter(splitList(*allowCIDRs), splitList(*denyCIDRs))
+		if err != nil {
+			slog.Error("Failed to parse CIDR list", "error", err)
+			os.Exit(1)
+		}
+		admit = filter.Admit
+	}
 
 	// Create HTTP application with default handlers
 	router := http.DefaultHandlers()
 	httpApp := http.NewHTTPApplication(router)
 
 	// Create network server
-	networkServer := server.NewNetworkServer(netEngine, httpApp, nil)
+	config := server.NetworkServerConfig{
+		Protocol:          "tcp",
+		Address:           *host,
+		Port:              *port,
+		IdleTimeout:       *idleTimeout,
+		HeaderReadTimeout: *headerTimeout,
+		WriteTimeout:      *writeTimeout,
+		DrainTimeout:      *drainTimeout,
+		SocketMode:        os.FileMode(*unixMode),
+		SocketOptions: engine.SocketOptions{
+			NoDelay:       *noDelay,
+			DeferAccept:   *deferAccept,
+			KeepAliveIdle: *keepAliveIdle,
+			UserTimeout:   *userTimeout,
+			Backlog:       *backlog,
+		},
+
+		MaxConnections:      *maxConns,
+		MaxConnectionsPerIP: *maxConnsPerIP,
+		AcceptRate:          *acceptRate,
+		AcceptBurst:         *acceptBurst,
+		Admit:               admit,
+	}
 
-	// Create listener
-	addr := fmt.Sprintf("%s:%d", *host, *port)
-	listener, err := engine.Listen("tcp", addr, 128)
-	if err != nil {
-		slog.Error("Failed to create listener", "error", err)
-		os.Exit(1)
+	address := net.JoinHostPort(*host, strconv.Itoa(*port))
+	if *unixSocket != "" {
+		config.Protocol = "unix"
+		config.Address = *unixSocket
+		address = *unixSocket
 	}
-	defer listener.Close()
 
-	slog.Info("HTTP server starting", "address", addr)
+	var networkServer interface {
+		Listen(ctx context.Context) error
+		Serve(ctx context.Context) error
+		Stats() server.Stats
+	}
+	if *reactors == 1 {
+		netEngine, err := engine.NewNetEngine(uringOpts...)
+		if err != nil {
+			slog.Error("Failed to create network engine", "error", err)
+			os.Exit(1)
+		}
+		defer netEngine.Close()
+		networkServer = server.NewNetworkServer(netEngine, config, nil, httpApp)
+	} else {
+		multiReactor, err := server.NewMultiReactorServer(server.MultiReactorConfig{
+			NetworkServerConfig: config,
+			Reactors:            *reactors,
+			PinCPU:              *pinCPU,
+			NewEngine: func(int) (engine.NetEngine, error) {
+				return engine.NewNetEngine(uringOpts...)
+			},
+		}, nil, httpApp)
+		if err != nil {
+			slog.Error("Failed to create reactors", "error", err)
+			os.Exit(1)
+		}
+		defer multiReactor.Close()
+		networkServer = multiReactor
+	}
 
-	// Start accepting connections
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := netEngine.Accept(ctx, listener); err != nil {
+	// Start accepting connections
+	if err := networkServer.Listen(ctx); err != nil {
 		slog.Error("Failed to start accepting connections", "error", err)
 		os.Exit(1)
 	}
 
+	slog.Info("HTTP server starting", "address", address)
+
 	// Handle shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -76,7 +183,26 @@ func main() {
 	}()
 
 	// Run the server
-	networkServer.Serve(ctx)
+	err := networkServer.Serve(ctx)
+	stats := networkServer.Stats()
+	if err != nil {
+		slog.Warn("Server stopped", "error", err, "accepted", stats.Accepted, "rejected", stats.Rejected)
+		return
+	}
+
+	slog.Info("Server stopped", "accepted", stats.Accepted, "rejected", stats.Rejected)
+}
 
-	slog.Info("Server stopped")
+// splitList はカンマ区切りのフラグを分けます
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var list []string
+	for item := range strings.SplitSeq(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
+)
+
+// io_uring_enterの回数をSQEごとの即時提出とバッチ提出で比べる
+// イベントループ1周でbatch個のレスポンスを書き込む状況を再現する
+func main() {
+	var (
+		requests = flag.Int("requests", 100000, "Number of writes to submit")
+		batch    = flag.Int("batch", 32, "Writes queued per event loop iteration")
+		size     = flag.Int("size", 128, "Bytes per write")
+	)
+	flag.Parse()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	for _, batched := range []bool{false, true} {
+		enters, elapsed, err := run(*requests, *batch, *size, batched)
+		if err != nil {
+			slog.Error("Benchmark failed", "error", err)
+			os.Exit(1)
+		}
+		mode := "submit-per-sqe"
+		if batched {
+			mode = "batched"
+		}
+		fmt.Printf("%-15s requests=%d batch=%d enters=%d enters/request=%.3f ns/request=%d\n",
+			mode, *requests, *batch, enters, float64(enters)/float64(*requests), elapsed.Nanoseconds()/int64(*requests))
+	}
+}
+
+func run(requests, batch, size int, batched bool) (uint64, time.Duration, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unix.Close(fds[0])
+
+	// 受信側は読み捨てるだけ
+	reader := os.NewFile(uintptr(fds[1]), "bench-reader")
+	go func() {
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+	defer reader.Close()
+
+	uring := core.CreateUring(4096)
+	defer uring.Close()
+
+	payload := make([]byte, size)
+	start := time.Now()
+	completed := 0
+	for submitted := 0; submitted < requests; {
+		n := min(batch, requests-submitted)
+		for i := 0; i < n; i++ {
+			op := uring.Write(int32(fds[0]), payload, uint64(submitted+i))
+			if batched {
+				if err := uring.Queue(op); err != nil {
+					return 0, 0, err
+				}
+				continue
+			}
+			if err := uring.Submit(op); err != nil {
+				return 0, 0, err
+			}
+		}
+		submitted += n
+
+		// バッチ提出では1周の最後に提出と完了待ちをまとめて行う
+		if batched {
+			if err := uring.WaitEvent(); err != nil {
+				return 0, 0, err
+			}
+		}
+		for completed < submitted {
+			cqes, err := uring.PeekBatchEvents(uint32(batch))
+			if err != nil {
+				if err := uring.WaitEvent(); err != nil {
+					return 0, 0, err
+				}
+				continue
+			}
+			for _, cqe := range cqes {
+				if cqe.Res < 0 {
+					return 0, 0, unix.Errno(-cqe.Res)
+				}
+			}
+			completed += len(cqes)
+		}
+	}
+
+	return uring.EnterCalls(), time.Since(start), nil
+}
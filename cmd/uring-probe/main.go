@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
+)
+
+// このホストのカーネルで使えるio_uringの機能とopcodeを表示する
+func main() {
+	all := flag.Bool("all", false, "Also list opcodes the kernel does not support")
+	flag.Parse()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err == nil {
+		fmt.Printf("kernel: %s\n", unix.ByteSliceToString(uname.Release[:]))
+	}
+
+	caps, err := core.ProbeCapabilities()
+	if err != nil {
+		fmt.Printf("io_uring: unavailable (%v)\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("features: %s\n", strings.Join(core.FeatureNames(caps.Features), " "))
+
+	fmt.Println("capabilities:")
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{
+		{"multishot accept", caps.MultishotAccept()},
+		{"multishot recv", caps.MultishotRecv()},
+		{"multishot timeout", caps.MultishotTimeout()},
+		{"provided buffer ring", caps.BufferRing()},
+		{"zero-copy send", caps.Supports(core.IORING_OP_SEND_ZC)},
+		{"msg ring", caps.Supports(core.IORING_OP_MSG_RING)},
+	} {
+		fmt.Printf("  %-22s %s\n", c.name, yesNo(c.ok))
+	}
+
+	fmt.Printf("opcodes (last=%d):\n", caps.LastOp)
+	for op := 0; op <= int(caps.LastOp); op++ {
+		supported := caps.Supports(uint8(op))
+		if !supported && !*all {
+			continue
+		}
+		fmt.Printf("  %3d %-18s %s\n", op, core.OpName(uint8(op)), yesNo(supported))
+	}
+}
+
+func yesNo(ok bool) string {
+	if ok {
+		return "yes"
+	}
+	return "no"
+}
@@ -42,12 +42,12 @@ func (r *RingBuffer) Length() int {
 	return int(r.tail - r.head)
 }
 
-func (r *RingBuffer) capacity() int {
+func (r *RingBuffer) Capacity() int {
 	return len(r.buf)
 }
 
 func (r *RingBuffer) Free() int {
-	return r.capacity() - r.Length()
+	return r.Capacity() - r.Length()
 }
 
 func (r *RingBuffer) Advance(n int) {
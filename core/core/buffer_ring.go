@@ -0,0 +1,146 @@
+//go:build linux
+
+package core
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrInvalidBufferRing = errors.New("buffer ring entries must be a power of 2 up to 32768")
+)
+
+// BufferRing はIORING_REGISTER_PBUF_RINGで登録したバッファグループです
+// カーネルがREAD/RECVのたびに1つ取り出すので、使い終わったバッファはRecycleで戻す必要があります
+type BufferRing struct {
+	GroupID uint16
+	entries int
+	mask    uint16
+	size    int
+	ring    []uringBuf // 先頭のResvがtailを兼ねる
+	data    []byte     // mmapした領域 (リング + バッファ)
+	base    unsafe.Pointer
+	inUse   int
+}
+
+// RegisterBufferRing はentries個のsizeバイトのバッファを持つグループを登録し、全て提供済みにします
+func (u *Uring) RegisterBufferRing(groupID uint16, entries, size int) (*BufferRing, error) {
+	if entries <= 0 || entries > 1<<15 || entries&(entries-1) != 0 {
+		return nil, ErrInvalidBufferRing
+	}
+
+	ringSize := (unsafe.Sizeof(uringBuf{}) + uintptr(size)) * uintptr(entries)
+	data, err := unix.Mmap(-1, 0, int(ringSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE)
+	if err != nil {
+		slog.Error("Mmap failed for ring buffer", "err", err, "errno", err.Error())
+		return nil, err
+	}
+	ringPtr := unsafe.Pointer(unsafe.SliceData(data))
+
+	reg := &uringBufReg{
+		RingAddr:    uint64(uintptr(ringPtr)),
+		RingEntries: uint32(entries),
+		Bgid:        groupID,
+	}
+
+	_, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_REGISTER,
+		uintptr(u.Fd),
+		IORING_REGISTER_PBUF_RING,
+		uintptr(unsafe.Pointer(reg)),
+		1,
+		0,
+		0,
+	)
+	if errno != 0 {
+		slog.Error("IO_URING_REGISTER failed", "errno", errno, "err", errno.Error())
+		_ = unix.Munmap(data)
+		return nil, errno
+	}
+
+	br := &BufferRing{
+		GroupID: groupID,
+		entries: entries,
+		mask:    uint16(entries - 1),
+		size:    size,
+		ring:    unsafe.Slice((*uringBuf)(ringPtr), entries),
+		data:    data,
+		base:    unsafe.Add(ringPtr, uintptr(entries)*unsafe.Sizeof(uringBuf{})),
+		inUse:   entries,
+	}
+	for i := 0; i < entries; i++ {
+		br.Recycle(uint16(i))
+	}
+
+	slog.Debug("Registered ring buffer", "entries", entries, "size", size, "bufferGroupID", groupID)
+	return br, nil
+}
+
+// UnregisterBufferRing はグループの登録を解除してメモリを解放します
+func (u *Uring) UnregisterBufferRing(br *BufferRing) error {
+	reg := &uringBufReg{
+		Bgid: br.GroupID,
+	}
+
+	_, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_REGISTER,
+		uintptr(u.Fd),
+		IORING_UNREGISTER_PBUF_RING,
+		uintptr(unsafe.Pointer(reg)),
+		1,
+		0,
+		0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return unix.Munmap(br.data)
+}
+
+// Buffer はCQEで通知されたbidのバッファのうち、先頭nバイトを返します
+// 返したスライスはRecycleするまでカーネルに再利用されません
+func (br *BufferRing) Buffer(bid uint16, n int) []byte {
+	ptr := unsafe.Add(br.base, uintptr(bid)*uintptr(br.size))
+	return unsafe.Slice((*byte)(ptr), br.size)[:n:n]
+}
+
+// Consumed はカーネルがバッファを1つ取り出したことを記録します
+func (br *BufferRing) Consumed() {
+	br.inUse++
+}
+
+// Recycle はbidのバッファをリングの末尾に戻し、カーネルが再び使えるようにします
+func (br *BufferRing) Recycle(bid uint16) {
+	tail := br.ring[0].Resv
+	// ring[0]のResvはtailなので、構造体ごと代入せずにフィールドだけ書く
+	entry := &br.ring[tail&br.mask]
+	entry.Addr = uint64(uintptr(unsafe.Add(br.base, uintptr(bid)*uintptr(br.size))))
+	entry.Len = uint32(br.size)
+	entry.Bid = bid
+	br.publishTail(tail + 1)
+	br.inUse--
+}
+
+// publishTail はtailをリリースストアで書き、それまでに書いたエントリがカーネルから先に見えるようにします
+// Goには16ビットのアトミックがないので、ring[0]のBidと合わせた4バイトをまとめて書きます (Bidを書くのはこちらだけ)
+func (br *BufferRing) publishTail(tail uint16) {
+	var word uint32
+	halves := (*[2]uint16)(unsafe.Pointer(&word))
+	halves[0] = br.ring[0].Bid
+	halves[1] = tail
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&br.ring[0].Bid)), word)
+}
+
+// Available はカーネルに提供中のバッファの数を返します
+func (br *BufferRing) Available() int {
+	return br.entries - br.inUse
+}
+
+func (br *BufferRing) Size() int {
+	return br.size
+}
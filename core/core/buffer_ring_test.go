@@ -0,0 +1,123 @@
+//go:build linux
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func newTestUring(t *testing.T) *Uring {
+	t.Helper()
+	if err := ProbeUring(); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	u := CreateUring(16)
+	t.Cleanup(func() { _ = u.Close() })
+	return u
+}
+
+func TestRegisterBufferRingEntries(t *testing.T) {
+	tests := []struct {
+		entries int
+		wantErr error
+	}{
+		{entries: 0, wantErr: ErrInvalidBufferRing},
+		{entries: 3, wantErr: ErrInvalidBufferRing},
+		{entries: 1 << 16, wantErr: ErrInvalidBufferRing},
+		{entries: 1},
+		{entries: 8},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.entries), func(t *testing.T) {
+			u := newTestUring(t)
+			br, err := u.RegisterBufferRing(1, tt.entries, 64)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RegisterBufferRing(%d) error = %v, want %v", tt.entries, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = u.UnregisterBufferRing(br) })
+			if got := br.Available(); got != tt.entries {
+				t.Errorf("Available() = %d, want %d", got, tt.entries)
+			}
+		})
+	}
+}
+
+func TestBufferRingRecycle(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries int
+		reads   int
+		recycle bool
+		want    []string // 読めたデータ、ENOBUFSなら""
+	}{
+		{name: "within entries", entries: 2, reads: 2, want: []string{"0", "1"}},
+		{name: "exhausted", entries: 2, reads: 3, want: []string{"0", "1", ""}},
+		{name: "recycled", entries: 2, reads: 5, recycle: true, want: []string{"0", "1", "2", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUring(t)
+			br, err := u.RegisterBufferRing(1, tt.entries, 64)
+			if err != nil {
+				t.Skipf("buffer rings are not available: %v", err)
+			}
+			t.Cleanup(func() { _ = u.UnregisterBufferRing(br) })
+
+			var p [2]int
+			if err := unix.Pipe(p[:]); err != nil {
+				t.Fatalf("Pipe: %v", err)
+			}
+			t.Cleanup(func() { _ = unix.Close(p[0]); _ = unix.Close(p[1]) })
+
+			for i := range tt.reads {
+				if _, err := unix.Write(p[1], []byte(fmt.Sprint(i))); err != nil {
+					t.Fatalf("Write: %v", err)
+				}
+				if err := u.Queue(u.ReadMultishot(int32(p[0]), br.GroupID, uint64(i))); err != nil {
+					t.Fatalf("Queue: %v", err)
+				}
+				if err := u.WaitEvent(); err != nil {
+					t.Fatalf("WaitEvent: %v", err)
+				}
+				cqes, err := u.PeekBatchEvents(1)
+				if err != nil {
+					t.Fatalf("PeekBatchEvents: %v", err)
+				}
+				cqe := cqes[0]
+
+				if tt.want[i] == "" {
+					if cqe.Res != -int32(unix.ENOBUFS) {
+						t.Fatalf("read %d: res = %d, want ENOBUFS", i, cqe.Res)
+					}
+					continue
+				}
+				if cqe.Res < 0 || cqe.Flags&IORING_CQE_F_BUFFER == 0 {
+					t.Fatalf("read %d: res = %d flags = %#x, want a buffer", i, cqe.Res, cqe.Flags)
+				}
+				br.Consumed()
+				bid := uint16(cqe.Flags >> IORING_CQE_BUFFER_SHIFT)
+				if got := string(br.Buffer(bid, int(cqe.Res))); got != tt.want[i] {
+					t.Errorf("read %d: data = %q, want %q", i, got, tt.want[i])
+				}
+				if tt.recycle {
+					br.Recycle(bid)
+				}
+			}
+
+			wantAvailable := 0
+			if tt.recycle {
+				wantAvailable = tt.entries
+			}
+			if got := br.Available(); got != wantAvailable {
+				t.Errorf("Available() = %d, want %d", got, wantAvailable)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package core
+
+import (
+	"log/slog"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type uringRsrcRegister struct {
+	Nr    uint32
+	Flags uint32
+	Resv2 uint64
+	Data  uint64
+	Tags  uint64
+}
+
+// RegisterFiles はentries個の空のスロットを持つ固定ファイルテーブルを登録します
+// 登録したスロットにはFilesUpdateでfdを入れ、SQEはIOSQE_FIXED_FILEでスロット番号を指定します
+func (u *Uring) RegisterFiles(entries int) error {
+	reg := &uringRsrcRegister{
+		Nr:    uint32(entries),
+		Flags: IORING_RSRC_REGISTER_SPARSE,
+	}
+
+	_, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_REGISTER,
+		uintptr(u.Fd),
+		IORING_REGISTER_FILES2,
+		uintptr(unsafe.Pointer(reg)),
+		unsafe.Sizeof(*reg),
+		0,
+		0,
+	)
+	if errno != 0 {
+		slog.Error("IO_URING_REGISTER files failed", "errno", errno, "err", errno.Error())
+		return errno
+	}
+
+	slog.Debug("Registered file table", "entries", entries)
+	return nil
+}
+
+// FilesUpdate は固定ファイルテーブルのoffsetから順にfdsを入れるSQEを作ります (Linux 5.6以降)
+// fdに-1を入れるとスロットを空にします。fdsはCQEが返るまでカーネルが読むので、それまで手放してはいけません
+func (u *Uring) FilesUpdate(offset int32, fds []int32, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_FILES_UPDATE,
+		Fd:       -1,
+		Offset:   uint64(offset),
+		Address:  uint64(uintptr(unsafe.Pointer(&fds[0]))),
+		Len:      uint32(len(fds)),
+		UserData: userData,
+	}
+	return op
+}
+
+// WithFixedFile はSQEの対象をfdから固定ファイルテーブルのスロットに切り替えます
+func (op *UringSQE) WithFixedFile(index int32) *UringSQE {
+	op.Fd = index
+	op.Flags |= IOSQE_FIXED_FILE
+	return op
+}
+
+// AcceptDirect は受け付けた接続をfdにせず、カーネルが選んだ固定ファイルテーブルのスロットに入れるSQEを作ります (Linux 5.19以降)
+// CQEのResはスロット番号です。相手のアドレスはaddrに書かれるので、CQEが返るまでaddrとaddrLenを手放してはいけません
+// マルチショットにすると接続ごとにaddrが上書きされるので、1回ずつ出し直します
+func (u *Uring) AcceptDirect(fd int32, addr *unix.RawSockaddrAny, addrLen *uint32, userData uint64) *UringSQE {
+	*addrLen = unix.SizeofSockaddrAny
+	op := &UringSQE{
+		Opcode:     IORING_OP_ACCEPT,
+		Fd:         fd,
+		Address:    uint64(uintptr(unsafe.Pointer(addr))),
+		Offset:     uint64(uintptr(unsafe.Pointer(addrLen))),
+		UserData:   userData,
+		SpliceFdIn: IORING_FILE_INDEX_ALLOC,
+	}
+	return op
+}
+
+// CloseFixed は固定ファイルテーブルのスロットを閉じるSQEを作ります
+func (u *Uring) CloseFixed(index int32, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:     IORING_OP_CLOSE,
+		UserData:   userData,
+		SpliceFdIn: index + 1, // file_indexは1から数える
+	}
+	return op
+}
+
+// CancelFixed は固定ファイルテーブルのスロットに対するすべての操作をキャンセルします
+func (u *Uring) CancelFixed(index int32, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:    IORING_OP_ASYNC_CANCEL,
+		Fd:        index,
+		UserFlags: IORING_ASYNC_CANCEL_ALL | IORING_ASYNC_CANCEL_FD | IORING_ASYNC_CANCEL_FD_FIXED,
+		UserData:  userData,
+	}
+	return op
+}
@@ -0,0 +1,296 @@
+//go:build linux
+
+package core
+
+import (
+	"log/slog"
+	"runtime"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	IORING_REGISTER_PROBE = 8
+
+	IO_URING_OP_SUPPORTED = 1 << 0
+)
+
+type uringProbeOp struct {
+	Op    uint8
+	Resv  uint8
+	Flags uint16 // IO_URING_OP_SUPPORTED
+	Resv2 uint32
+}
+
+type uringProbe struct {
+	LastOp uint8 // カーネルが知っている最後のopcode
+	OpsLen uint8
+	Resv   uint16
+	Resv2  [3]uint32
+	Ops    [256]uringProbeOp
+}
+
+// Capabilities はカーネルがサポートしているio_uringの機能とopcodeです
+type Capabilities struct {
+	Features uint32 // IORING_FEAT_*
+	LastOp   uint8
+	ops      [256]bool
+	// multishotTimeout はIORING_TIMEOUT_MULTISHOTのTIMEOUTを実際に出せたかです
+	multishotTimeout bool
+}
+
+// Supports はopcodeが使えるかを返します
+func (c *Capabilities) Supports(op uint8) bool {
+	return c.ops[op]
+}
+
+// HasFeature はIORING_FEAT_*が立っているかを返します
+func (c *Capabilities) HasFeature(feature uint32) bool {
+	return c.Features&feature == feature
+}
+
+// Ops は使えるopcodeの一覧を返します
+func (c *Capabilities) Ops() []uint8 {
+	var ops []uint8
+	for op := 0; op <= int(c.LastOp); op++ {
+		if c.ops[op] {
+			ops = append(ops, uint8(op))
+		}
+	}
+	return ops
+}
+
+// フラグで指定する機能はPROBEでは分からないので、同じカーネルで入ったopcodeから推測します
+
+// MultishotAccept はIORING_ACCEPT_MULTISHOTが使えるかを返します (5.19, IORING_OP_SOCKETと同時)
+func (c *Capabilities) MultishotAccept() bool {
+	return c.Supports(IORING_OP_SOCKET)
+}
+
+// BufferRing はIORING_REGISTER_PBUF_RINGが使えるかを返します (5.19, IORING_OP_SOCKETと同時)
+func (c *Capabilities) BufferRing() bool {
+	return c.Supports(IORING_OP_SOCKET)
+}
+
+// MultishotRecv はIORING_RECV_MULTISHOTが使えるかを返します (6.0, IORING_OP_SEND_ZCと同時)
+func (c *Capabilities) MultishotRecv() bool {
+	return c.Supports(IORING_OP_SEND_ZC)
+}
+
+// MultishotTimeout はIORING_TIMEOUT_MULTISHOTが使えるかを返します (6.4)
+// 6.4で入ったopcodeがないので、調べるときにマルチショットのTIMEOUTを出して確かめています
+func (c *Capabilities) MultishotTimeout() bool {
+	return c.multishotTimeout
+}
+
+// Probe はIORING_REGISTER_PROBEでこのリングが使えるopcodeを調べます
+func (u *Uring) Probe() (*Capabilities, error) {
+	caps, err := probe(u.Fd)
+	if err != nil {
+		return nil, err
+	}
+	caps.Features = u.Features
+	caps.multishotTimeout = probeMultishotTimeout()
+	return caps, nil
+}
+
+// ProbeCapabilities は小さなリングを作ってカーネルの機能を調べ、すぐに閉じます
+func ProbeCapabilities() (*Capabilities, error) {
+	params := uringParams{}
+	fd, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_SETUP,
+		1,
+		uintptr(unsafe.Pointer(&params)),
+		0,
+		0,
+		0,
+		0)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer unix.Close(int(fd))
+
+	caps, err := probe(int32(fd))
+	if err != nil {
+		return nil, err
+	}
+	caps.Features = params.Features
+	caps.multishotTimeout = probeMultishotTimeout()
+	return caps, nil
+}
+
+func probe(ringFd int32) (*Capabilities, error) {
+	p := &uringProbe{}
+	_, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_REGISTER,
+		uintptr(ringFd),
+		IORING_REGISTER_PROBE,
+		uintptr(unsafe.Pointer(p)),
+		uintptr(len(p.Ops)),
+		0,
+		0,
+	)
+	if errno != 0 {
+		// 5.6より前のカーネルはPROBEを持っていない
+		slog.Debug("IO_URING_REGISTER probe failed", "errno", errno, "err", errno.Error())
+		return nil, errno
+	}
+
+	caps := &Capabilities{LastOp: p.LastOp}
+	for _, op := range p.Ops[:p.OpsLen] {
+		if op.Flags&IO_URING_OP_SUPPORTED != 0 {
+			caps.ops[op.Op] = true
+		}
+	}
+	return caps, nil
+}
+
+// probeMultishotTimeout は小さなリングでマルチショットのTIMEOUTを出し、すぐに取り消します
+// 対応していないカーネルはフラグを知らないので、TIMEOUTのCQEがEINVALになります
+func probeMultishotTimeout() bool {
+	u := CreateUring(2)
+	defer u.Close()
+
+	const timeoutUserData, removeUserData = 1, 2
+	timeSpec := unix.NsecToTimespec(int64(time.Hour))
+	timeout := &UringSQE{
+		Opcode:    IORING_OP_TIMEOUT,
+		Fd:        -1,
+		Address:   uint64(uintptr(unsafe.Pointer(&timeSpec))),
+		UserFlags: IORING_TIMEOUT_MULTISHOT,
+		Len:       1,
+		UserData:  timeoutUserData,
+	}
+	remove := &UringSQE{
+		Opcode:   IORING_OP_TIMEOUT_REMOVE,
+		Fd:       -1,
+		Address:  timeoutUserData,
+		UserData: removeUserData,
+	}
+	if err := u.pushSQE(timeout); err != nil {
+		return false
+	}
+	if err := u.pushSQE(remove); err != nil {
+		return false
+	}
+	// TIMEOUTと取り消しのCQEが両方返るまで待つ
+	err := u.enter(u.sqPending(), 2, IORING_ENTER_GETEVENTS, nil, 0)
+	runtime.KeepAlive(&timeSpec)
+	if err != nil {
+		slog.Debug("Multishot timeout probe failed", "err", err)
+		return false
+	}
+
+	supported := false
+	for u.cqReady() > 0 {
+		cqe := u.getCQE()
+		if cqe.UserData == timeoutUserData {
+			supported = cqe.Res != -int32(unix.EINVAL)
+		}
+	}
+	return supported
+}
+
+// OpName はopcodeの名前を返します
+func OpName(op uint8) string {
+	if name, ok := opNames[op]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// FeatureNames はfeaturesに立っているIORING_FEAT_*の名前を返します
+func FeatureNames(features uint32) []string {
+	var names []string
+	for _, f := range featureNames {
+		if features&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+var opNames = map[uint8]string{
+	IORING_OP_NOP:              "NOP",
+	IORING_OP_READV:            "READV",
+	IORING_OP_WRITEV:           "WRITEV",
+	IORING_OP_FSYNC:            "FSYNC",
+	IORING_OP_READ_FIXED:       "READ_FIXED",
+	IORING_OP_WRITE_FIXED:      "WRITE_FIXED",
+	IORING_OP_POLL_ADD:         "POLL_ADD",
+	IORING_OP_POLL_REMOVE:      "POLL_REMOVE",
+	IORING_OP_SYNC_FILE_RANGE:  "SYNC_FILE_RANGE",
+	IORING_OP_SENDMSG:          "SENDMSG",
+	IORING_OP_RECVMSG:          "RECVMSG",
+	IORING_OP_TIMEOUT:          "TIMEOUT",
+	IORING_OP_TIMEOUT_REMOVE:   "TIMEOUT_REMOVE",
+	IORING_OP_ACCEPT:           "ACCEPT",
+	IORING_OP_ASYNC_CANCEL:     "ASYNC_CANCEL",
+	IORING_OP_LINK_TIMEOUT:     "LINK_TIMEOUT",
+	IORING_OP_CONNECT:          "CONNECT",
+	IORING_OP_FALLOCATE:        "FALLOCATE",
+	IORING_OP_OPENAT:           "OPENAT",
+	IORING_OP_CLOSE:            "CLOSE",
+	IORING_OP_FILES_UPDATE:     "FILES_UPDATE",
+	IORING_OP_STATX:            "STATX",
+	IORING_OP_READ:             "READ",
+	IORING_OP_WRITE:            "WRITE",
+	IORING_OP_FADVISE:          "FADVISE",
+	IORING_OP_MADVISE:          "MADVISE",
+	IORING_OP_SEND:             "SEND",
+	IORING_OP_RECV:             "RECV",
+	IORING_OP_OPENAT2:          "OPENAT2",
+	IORING_OP_EPOLL_CTL:        "EPOLL_CTL",
+	IORING_OP_SPLICE:           "SPLICE",
+	IORING_OP_PROVIDE_BUFFERS:  "PROVIDE_BUFFERS",
+	IORING_OP_REMOVE_BUFFERS:   "REMOVE_BUFFERS",
+	IORING_OP_TEE:              "TEE",
+	IORING_OP_SHUTDOWN:         "SHUTDOWN",
+	IORING_OP_RENAMEAT:         "RENAMEAT",
+	IORING_OP_UNLINKAT:         "UNLINKAT",
+	IORING_OP_MKDIRAT:          "MKDIRAT",
+	IORING_OP_SYMLINKAT:        "SYMLINKAT",
+	IORING_OP_LINKAT:           "LINKAT",
+	IORING_OP_MSG_RING:         "MSG_RING",
+	IORING_OP_FSETXATTR:        "FSETXATTR",
+	IORING_OP_SETXATTR:         "SETXATTR",
+	IORING_OP_FGETXATTR:        "FGETXATTR",
+	IORING_OP_GETXATTR:         "GETXATTR",
+	IORING_OP_SOCKET:           "SOCKET",
+	IORING_OP_URING_CMD:        "URING_CMD",
+	IORING_OP_SEND_ZC:          "SEND_ZC",
+	IORING_OP_SENDMSG_ZC:       "SENDMSG_ZC",
+	IORING_OP_READ_MULTISHOT:   "READ_MULTISHOT",
+	IORING_OP_WAITID:           "WAITID",
+	IORING_OP_FUTEX_WAIT:       "FUTEX_WAIT",
+	IORING_OP_FUTEX_WAKE:       "FUTEX_WAKE",
+	IORING_OP_FUTEX_WAITV:      "FUTEX_WAITV",
+	IORING_OP_FIXED_FD_INSTALL: "FIXED_FD_INSTALL",
+	IORING_OP_FTRUNCATE:        "FTRUNCATE",
+	IORING_OP_BIND:             "BIND",
+	IORING_OP_LISTEN:           "LISTEN",
+}
+
+var featureNames = []struct {
+	flag uint32
+	name string
+}{
+	{IORING_FEAT_SINGLE_MMAP, "SINGLE_MMAP"},
+	{IORING_FEAT_NODROP, "NODROP"},
+	{IORING_FEAT_SUBMIT_STABLE, "SUBMIT_STABLE"},
+	{IORING_FEAT_RW_CUR_POS, "RW_CUR_POS"},
+	{IORING_FEAT_CUR_PERSONALITY, "CUR_PERSONALITY"},
+	{IORING_FEAT_FAST_POLL, "FAST_POLL"},
+	{IORING_FEAT_POLL_32BITS, "POLL_32BITS"},
+	{IORING_FEAT_SQPOLL_NONFIXED, "SQPOLL_NONFIXED"},
+	{IORING_FEAT_EXT_ARG, "EXT_ARG"},
+	{IORING_FEAT_NATIVE_WORKERS, "NATIVE_WORKERS"},
+	{IORING_FEAT_RSRC_TAGS, "RSRC_TAGS"},
+	{IORING_FEAT_CQE_SKIP, "CQE_SKIP"},
+	{IORING_FEAT_LINKED_FILE, "LINKED_FILE"},
+	{IORING_FEAT_REG_REG_RING, "REG_REG_RING"},
+	{IORING_FEAT_RECVSEND_BUNDLE, "RECVSEND_BUNDLE"},
+	{IORING_FEAT_MIN_TIMEOUT, "MIN_TIMEOUT"},
+}
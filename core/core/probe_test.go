@@ -0,0 +1,34 @@
+//go:build linux
+
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestProbeMultishotTimeout(t *testing.T) {
+	if err := ProbeUring(); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		t.Fatalf("Uname: %v", err)
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &major, &minor); err != nil {
+		t.Skipf("unknown kernel release %q", uts.Release)
+	}
+
+	caps, err := ProbeCapabilities()
+	if err != nil {
+		t.Skipf("PROBE is not available: %v", err)
+	}
+	// IORING_TIMEOUT_MULTISHOTは6.4で入った
+	want := major > 6 || major == 6 && minor >= 4
+	if got := caps.MultishotTimeout(); got != want {
+		t.Errorf("MultishotTimeout() = %v on %d.%d, want %v", got, major, minor, want)
+	}
+}
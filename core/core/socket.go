@@ -6,92 +6,214 @@ import (
 	"encoding/binary"
 	"errors"
 	"log/slog"
+	"net"
 	"net/netip"
+	"strconv"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-type sockAddr struct {
-	Family uint16
-	Data   [14]byte
-}
-
 type Socket struct {
 	Fd        int32
 	LocalAddr string
 }
 
-func CreateTCPSocket() *Socket {
+// Family はaddrをbindするソケットのアドレスファミリー (AF_INETかAF_INET6) を返します
+func Family(addr netip.Addr) int {
+	if addr.Is4() {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// CreateTCPSocket はfamily (AF_INETかAF_INET6) のTCPソケットを作り、SO_REUSEADDRを立てます
+func CreateTCPSocket(family int) (*Socket, error) {
+	s, err := newSocket(family, unix.SOCK_STREAM)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SetsockoptInt(unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateUDPSocket はfamily (AF_INETかAF_INET6) のUDPソケットを作ります
+func CreateUDPSocket(family int) (*Socket, error) {
+	return newSocket(family, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK)
+}
+
+// CreateUnixSocket はAF_UNIXのソケットを作ります。sockTypeはSOCK_STREAMかSOCK_SEQPACKETです
+func CreateUnixSocket(sockType int) (*Socket, error) {
+	return newSocket(unix.AF_UNIX, sockType)
+}
+
+func newSocket(domain, sockType int) (*Socket, error) {
 	fd, _, errno := unix.Syscall6(
 		unix.SYS_SOCKET,
-		unix.AF_INET,
-		unix.SOCK_STREAM|unix.SOCK_CLOEXEC,
+		uintptr(domain),
+		uintptr(sockType|unix.SOCK_CLOEXEC),
 		0,
 		0,
 		0,
 		0)
 
-	if fd < 0 {
+	if errno != 0 {
 		slog.Error("Failed to create socket", "errno", errno, "err", errno.Error())
-		panic(errno)
+		return nil, errno
 	}
 
-	opVal := int32(1)
-	_, _, errno = unix.Syscall6(unix.SYS_SETSOCKOPT, fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, uintptr(unsafe.Pointer(&opVal)), unsafe.Sizeof(opVal), 0)
+	return &Socket{Fd: int32(fd)}, nil
+}
+
+// SetsockoptInt はint型のソケットオプションを設定します
+func (s *Socket) SetsockoptInt(level, opt, value int) error {
+	return SetsockoptInt(s.Fd, level, opt, value)
+}
+
+// SetsockoptInt はfdにint型のソケットオプションを設定します
+func SetsockoptInt(fd int32, level, opt, value int) error {
+	opVal := int32(value)
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt), uintptr(unsafe.Pointer(&opVal)), unsafe.Sizeof(opVal), 0)
 	if errno != 0 {
-		slog.Error("Failed to set socket option", "errno", errno, "err", errno.Error())
-		panic(errno)
+		return errno
 	}
+	return nil
+}
 
-	return &Socket{Fd: int32(fd)}
+// SetReusePort はSO_REUSEPORTを立てて、同じアドレスに複数のソケットをbindできるようにします
+// カーネルは接続をbindしているソケットに振り分けます
+func (s *Socket) SetReusePort() error {
+	return s.SetsockoptInt(unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
 }
 
-func CreateUDPSocket() *Socket {
-	fd, _, errno := unix.Syscall6(
-		unix.SYS_SOCKET,
-		unix.AF_INET,
-		unix.SOCK_DGRAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK,
-		0,
+// SetV6Only はIPV6_V6ONLYを設定します
+// offにしたAF_INET6のソケットを[::]にbindすると、IPv4の接続も::ffff:a.b.c.dとして受け付けます (デュアルスタック)
+func (s *Socket) SetV6Only(on bool) error {
+	var opVal int
+	if on {
+		opVal = 1
+	}
+	return s.SetsockoptInt(unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, opVal)
+}
+
+func (s *Socket) Bind(address netip.AddrPort) error {
+	// https://man7.org/linux/man-pages/man2/bind.2.html
+	sockaddr, size, err := RawSockaddr(address)
+	if err != nil {
+		return err
+	}
+
+	res, _, errno := unix.Syscall6(
+		unix.SYS_BIND,
+		uintptr(s.Fd),
+		uintptr(sockaddr),
+		uintptr(size),
 		0,
 		0,
 		0)
 
-	if fd < 0 {
-		panic(errno)
+	if res != 0 {
+		slog.Error("Failed to bind", "address", address, "errno", errno, "err", errno.Error())
+		return errno
 	}
 
-	return &Socket{Fd: int32(fd)}
+	s.LocalAddr = address.String()
+	return nil
 }
 
-func (s *Socket) Bind(address netip.AddrPort) {
-	// https://man7.org/linux/man-pages/man2/bind.2.html
-	sockaddr := sockAddr{
-		Family: unix.AF_INET,
-	}
-
-	port := address.Port()
-	binary.BigEndian.PutUint16(sockaddr.Data[:], port)
-
-	addr := address.Addr().AsSlice()
-	for i := 0; i < len(addr); i++ {
-		sockaddr.Data[2+i] = addr[i]
+// BindUnix はunixソケットをpathにbindします。@で始まるpathはLinuxの抽象名前空間で、ファイルを作りません
+func (s *Socket) BindUnix(path string) error {
+	sockaddr, size, err := RawSockaddrUnix(path)
+	if err != nil {
+		return err
 	}
 
 	res, _, errno := unix.Syscall6(
 		unix.SYS_BIND,
 		uintptr(s.Fd),
-		uintptr(unsafe.Pointer(&sockaddr)),
-		uintptr(unsafe.Sizeof(sockaddr)),
+		uintptr(sockaddr),
+		uintptr(size),
 		0,
 		0,
 		0)
 
 	if res != 0 {
-		panic(errno)
+		slog.Error("Failed to bind", "path", path, "errno", errno, "err", errno.Error())
+		return errno
 	}
 
-	s.LocalAddr = address.String()
+	s.LocalAddr = path
+	return nil
+}
+
+// RawSockaddrUnix はpathをsockaddr_unにして、そのポインタと大きさを返します
+// 抽象名前空間 (@name) のsun_pathは先頭がNULで、名前の長さまでが名前になるので終端のNULは付けません
+func RawSockaddrUnix(path string) (unsafe.Pointer, uint32, error) {
+	sa := &unix.RawSockaddrUnix{Family: unix.AF_UNIX}
+	name := []byte(path)
+	abstract := len(name) > 0 && name[0] == '@'
+	if abstract {
+		name[0] = 0
+	}
+	// ファイルのパスは終端のNULを入れて収まる必要がある
+	if len(name) == 0 || len(name) > len(sa.Path) || (!abstract && len(name) == len(sa.Path)) {
+		return nil, 0, unix.EINVAL
+	}
+	for i, b := range name {
+		sa.Path[i] = int8(b)
+	}
+	size := uint32(unsafe.Offsetof(sa.Path)) + uint32(len(name))
+	if !abstract {
+		size++
+	}
+	return unsafe.Pointer(sa), size, nil
+}
+
+// RawSockaddr はaddressをカーネルに渡すsockaddr_in/sockaddr_in6にして、そのポインタと大きさを返します
+// IPv4のアドレスならsockaddr_in、それ以外 (::ffff:a.b.c.dを含む) ならsockaddr_in6になります
+func RawSockaddr(address netip.AddrPort) (unsafe.Pointer, uint32, error) {
+	addr := address.Addr()
+	if !addr.IsValid() {
+		return nil, 0, unix.EINVAL
+	}
+	if addr.Is4() {
+		sa := &unix.RawSockaddrInet4{
+			Family: unix.AF_INET,
+			Addr:   addr.As4(),
+		}
+		// sin_portはネットワークバイトオーダー
+		binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], address.Port())
+		return unsafe.Pointer(sa), unix.SizeofSockaddrInet4, nil
+	}
+
+	sa := &unix.RawSockaddrInet6{
+		Family: unix.AF_INET6,
+		Addr:   addr.As16(),
+	}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], address.Port())
+	if zone := addr.Zone(); zone != "" {
+		// fe80::1%eth0のようなリンクローカルアドレスはインターフェースの番号で指定する
+		scopeID, err := zoneToScopeID(zone)
+		if err != nil {
+			return nil, 0, err
+		}
+		sa.Scope_id = scopeID
+	}
+	return unsafe.Pointer(sa), unix.SizeofSockaddrInet6, nil
+}
+
+func zoneToScopeID(zone string) (uint32, error) {
+	if id, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	ifi, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(ifi.Index), nil
 }
 
 func (s *Socket) Listen(maxConn int) error {
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"log/slog"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -18,6 +19,10 @@ const (
 	MaxBufferSize = 20 * 1024 // 20kib
 )
 
+var (
+	ErrSubmissionQueueFull = errors.New("submission queue is full")
+)
+
 type UringSQE struct {
 	Opcode      uint8
 	Flags       uint8
@@ -41,32 +46,30 @@ type UringCQE struct {
 }
 
 type Uring struct {
-	Fd                 int32
-	SQ                 SQ
-	CQ                 CQ
-	Buffer             []byte
-	pRingRegBuffer     []byte     // 使用しない GC対策
-	pRingBuffer        []uringBuf // mmapしたバッファのポインタ
-	pRingData          []byte     // mmapしたデータのポインタ
-	pRingBufferBasePtr uintptr    // バッファのベースアドレス
-
-	// ヘッダーとかやってみるかぁ
-	Msghdr unix.Msghdr
-	Addr   []byte
+	Fd             int32
+	Features       uint32 // io_uring_setupが返したIORING_FEAT_*
+	SQ             SQ
+	CQ             CQ
+	sqLock         sync.Mutex // SQEの書き込みとtailの更新を1つにまとめる
+	sqPoll         bool
+	enterCalls     atomic.Uint64 // io_uring_enterを呼んだ回数 (計測用)
+	Buffer         []byte
+	pRingRegBuffer []byte // 使用しない GC対策
 }
 
 type SQ struct {
-	SQPtr    uintptr
+	SQPtr    unsafe.Pointer
 	Head     *uint32
 	Tail     *uint32
 	Mask     *uint32
 	Entries  *uint32
-	ArrayPtr uintptr
-	SQEPtr   uintptr
+	Flags    *uint32 // SQPOLLスレッドが寝ているとIORING_SQ_NEED_WAKEUPが立つ
+	ArrayPtr unsafe.Pointer
+	SQEPtr   unsafe.Pointer
 }
 
 type CQ struct {
-	CQPtr   uintptr
+	CQPtr   unsafe.Pointer
 	Head    *uint32
 	Tail    *uint32
 	Mask    *uint32
@@ -74,8 +77,41 @@ type CQ struct {
 	CQEs    *uint32
 }
 
+// UringSetup はio_uring_setupに渡すオプションです
+type UringSetup struct {
+	// SQPoll を有効にするとカーネルスレッドがSQをポーリングし、Submitでio_uring_enterを呼ばなくなります
+	SQPoll bool
+	// SQThreadIdle はポーリングスレッドが寝るまでの時間です (0ならカーネルのデフォルト)
+	// カーネルはミリ秒単位で受け取るので、端数は切り上げます
+	SQThreadIdle time.Duration
+	// SQThreadCPU はポーリングスレッドを固定するCPUです (負の値なら固定しない)
+	SQThreadCPU int
+}
+
+// sqThreadIdleMsec はSQThreadIdleをミリ秒にします
+// カーネルは0をデフォルト (約1秒) として扱うので、1ミリ秒未満の指定は切り捨てずに1ミリ秒に切り上げます
+func sqThreadIdleMsec(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	return uint32((d + time.Millisecond - 1) / time.Millisecond)
+}
+
 func CreateUring(entries uint32) *Uring {
+	return CreateUringWithSetup(entries, UringSetup{SQThreadCPU: -1})
+}
+
+func CreateUringWithSetup(entries uint32, setup UringSetup) *Uring {
 	params := uringParams{}
+	if setup.SQPoll {
+		params.Flags |= IORING_SETUP_SQPOLL
+		params.SqThreadIdle = sqThreadIdleMsec(setup.SQThreadIdle)
+		if setup.SQThreadCPU >= 0 {
+			params.Flags |= IORING_SETUP_SQ_AFF
+			params.SqThreadCPU = uint32(setup.SQThreadCPU)
+		}
+	}
+
 	fd, _, errno := unix.Syscall6(
 		unix.SYS_IO_URING_SETUP,
 		uintptr(entries),
@@ -103,7 +139,7 @@ func CreateUring(entries uint32) *Uring {
 		panic(err)
 	}
 
-	SQPtr := uintptr(unsafe.Pointer(unsafe.SliceData(SQData)))
+	SQPtr := unsafe.Pointer(unsafe.SliceData(SQData))
 
 	SQEData, err := unix.Mmap(
 		int(fd),
@@ -113,147 +149,245 @@ func CreateUring(entries uint32) *Uring {
 		unix.MAP_SHARED|unix.MAP_POPULATE,
 	)
 
-	SQEPtr := uintptr(unsafe.Pointer(unsafe.SliceData(SQEData)))
+	SQEPtr := unsafe.Pointer(unsafe.SliceData(SQEData))
 
 	if err != nil {
 		slog.Error("Mmap failed", "err", err, "errno", err.Error())
 		panic(err)
 	}
 
-	var CQPtr uintptr
+	var CQPtr unsafe.Pointer
 	if params.Features&IORING_FEAT_SINGLE_MMAP == IORING_FEAT_SINGLE_MMAP {
 		CQPtr = SQPtr
 	} else {
-		//TODO: kernel 5.4以前の対応
+		// kernel 5.4以前はCQリングを別にmmapする
+		CQData, err := unix.Mmap(
+			int(fd),
+			IORING_OFF_CQ_RING,
+			int(params.CQOffsets.CQEs+params.CqEntry*uint32(unsafe.Sizeof(UringCQE{}))),
+			unix.PROT_READ|unix.PROT_WRITE,
+			unix.MAP_SHARED|unix.MAP_POPULATE,
+		)
+		if err != nil {
+			slog.Error("Mmap failed", "err", err, "errno", err.Error())
+			panic(err)
+		}
+		CQPtr = unsafe.Pointer(unsafe.SliceData(CQData))
 	}
 
 	uring := &Uring{
-		Fd: int32(fd),
+		Fd:       int32(fd),
+		Features: params.Features,
+		sqPoll:   setup.SQPoll,
 		SQ: SQ{
 			SQPtr:    SQPtr,
-			Head:     (*uint32)(unsafe.Pointer(SQPtr + uintptr(params.SQOffsets.Head))),
-			Tail:     (*uint32)(unsafe.Pointer(SQPtr + uintptr(params.SQOffsets.Tail))),
-			Entries:  (*uint32)(unsafe.Pointer(SQPtr + uintptr(params.SQOffsets.RingEntries))),
-			Mask:     (*uint32)(unsafe.Pointer(SQPtr + uintptr(params.SQOffsets.RingMask))),
-			ArrayPtr: uintptr(unsafe.Pointer(SQPtr + uintptr(params.SQOffsets.Array))),
+			Head:     (*uint32)(unsafe.Add(SQPtr, params.SQOffsets.Head)),
+			Tail:     (*uint32)(unsafe.Add(SQPtr, params.SQOffsets.Tail)),
+			Entries:  (*uint32)(unsafe.Add(SQPtr, params.SQOffsets.RingEntries)),
+			Mask:     (*uint32)(unsafe.Add(SQPtr, params.SQOffsets.RingMask)),
+			Flags:    (*uint32)(unsafe.Add(SQPtr, params.SQOffsets.Flags)),
+			ArrayPtr: unsafe.Add(SQPtr, params.SQOffsets.Array),
 			SQEPtr:   SQEPtr,
 		},
 		CQ: CQ{
 			CQPtr:   CQPtr,
-			Head:    (*uint32)(unsafe.Pointer(CQPtr + uintptr(params.CQOffsets.Head))),
-			Tail:    (*uint32)(unsafe.Pointer(CQPtr + uintptr(params.CQOffsets.Tail))),
-			Entries: (*uint32)(unsafe.Pointer(CQPtr + uintptr(params.CQOffsets.RingEntries))),
-			Mask:    (*uint32)(unsafe.Pointer(CQPtr + uintptr(params.CQOffsets.RingMask))),
-			CQEs:    (*uint32)(unsafe.Pointer(CQPtr + uintptr(params.CQOffsets.CQEs))),
+			Head:    (*uint32)(unsafe.Add(CQPtr, params.CQOffsets.Head)),
+			Tail:    (*uint32)(unsafe.Add(CQPtr, params.CQOffsets.Tail)),
+			Entries: (*uint32)(unsafe.Add(CQPtr, params.CQOffsets.RingEntries)),
+			Mask:    (*uint32)(unsafe.Add(CQPtr, params.CQOffsets.RingMask)),
+			CQEs:    (*uint32)(unsafe.Add(CQPtr, params.CQOffsets.CQEs)),
 		},
 	}
 
+	slog.Debug("Created uring", "entries", entries, "sqPoll", setup.SQPoll, "features", params.Features)
 	return uring
 
 }
 
-func (u *Uring) RegisterRingBuffer(entries, maxBufferSize, bufferGroupID int) {
-	ringSize := (unsafe.Sizeof(uringBuf{}) + MaxBufferSize) * uintptr(entries)
-	data, err := unix.Mmap(-1, 0, int(ringSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANONYMOUS|unix.MAP_PRIVATE)
-	if err != nil {
-		slog.Error("Mmap failed for ring buffer", "err", err, "errno", err.Error())
-		panic(err)
-	}
-	pRingPtr := unsafe.Pointer(unsafe.SliceData(data))
-	pRingBuffer := unsafe.Slice((*uringBuf)(pRingPtr), entries)
-	bufferBasePtr := uintptr(pRingPtr) + (uintptr(entries) * unsafe.Sizeof(uringBuf{}))
-
-	reg := &uringBufReg{
-		RingAddr:    uint64(uintptr(pRingPtr)),
-		RingEntries: uint32(entries),
-		Bgid:        uint16(bufferGroupID),
-	}
-
-	_, _, errno := unix.Syscall6(
-		unix.SYS_IO_URING_REGISTER,
-		uintptr(u.Fd),
-		IORING_REGISTER_PBUF_RING,
-		uintptr(unsafe.Pointer(reg)),
+// ProbeUring は小さなリングを作ってすぐ閉じることで、io_uringが使えるか確認します
+// seccompやカーネル設定で無効になっている場合はENOSYS/EPERMが返ります
+func ProbeUring() error {
+	params := uringParams{}
+	fd, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_SETUP,
 		1,
+		uintptr(unsafe.Pointer(&params)),
 		0,
 		0,
-	)
+		0,
+		0)
+
 	if errno != 0 {
-		slog.Error("IO_URING_REGISTER failed", "errno", errno, "err", errno.Error())
-		panic(errno)
+		return errno
 	}
+	return unix.Close(int(fd))
+}
 
-	for i := 0; i < entries; i++ {
-		index := (int(pRingBuffer[0].Resv) + i) & (entries - 1)
-		pRingBuffer[index].Addr = uint64(bufferBasePtr + uintptr(i)*MaxBufferSize)
-		pRingBuffer[index].Len = uint32(maxBufferSize)
-		pRingBuffer[index].Bid = uint16(i)
+func (u *Uring) AcceptMultishot(fd int32, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_ACCEPT,
+		Ioprio:   IORING_ACCEPT_MULTISHOT, // https://lore.kernel.org/lkml/a41a1f47-ad05-3245-8ac8-7d8e95ebde44@kernel.dk/t/
+		Fd:       fd,
+		UserData: userData,
+	}
+	return op
+}
+
+// Accept は1回だけ接続を受け付けます (IORING_ACCEPT_MULTISHOTがない5.19より前のカーネル用)
+func (u *Uring) Accept(fd int32, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_ACCEPT,
+		Fd:       fd,
+		UserData: userData,
 	}
+	return op
+}
 
-	u.pRingData = data
-	u.pRingBuffer = pRingBuffer
-	u.pRingBufferBasePtr = bufferBasePtr
-	slog.Debug("Registered ring buffer", "entries", entries, "maxBufferSize", maxBufferSize, "bufferGroupID", bufferGroupID)
-	u.advancePbufRing(uint16(entries))
+// RecvMsg はmsghdrで1回だけ受信します。送信元はmsghdr.Nameに、データはbufferGroupのバッファの先頭に入ります
+// msghdrはCQEが返るまで手放してはいけません
+func (u *Uring) RecvMsg(fd int32, msghdr *unix.Msghdr, bufferGroup uint16, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_RECVMSG,
+		Flags:    IOSQE_BUFFER_SELECT,
+		BufIndex: bufferGroup,
+		Fd:       fd,
+		UserData: userData,
+		Address:  uint64(uintptr(unsafe.Pointer(msghdr))),
+	}
+	return op
 }
 
-func (u *Uring) GetRingBuffer(index uint16) []byte {
-	ptr := u.pRingBufferBasePtr + uintptr(index)*MaxBufferSize
-	return unsafe.Slice((*byte)(unsafe.Pointer(ptr)), MaxBufferSize)
+// RecvMsgMultishot はmsghdrを雛形にして、データグラムを受信するたびにCQEを返します (Linux 6.0以降)
+// バッファの先頭にはio_uring_recvmsg_out、続いてmsghdr.Namelen分の送信元アドレス、msghdr.Controllen分の制御メッセージ、データの順に入ります
+// msghdrはIORING_CQE_F_MOREが立っていないCQEが返るまで手放してはいけません
+func (u *Uring) RecvMsgMultishot(fd int32, msghdr *unix.Msghdr, bufferGroup uint16, userData uint64) *UringSQE {
+	op := u.RecvMsg(fd, msghdr, bufferGroup, userData)
+	op.Ioprio = IORING_RECV_MULTISHOT
+	return op
 }
 
-func (u *Uring) advancePbufRing(count uint16) {
-	newTail := u.pRingBuffer[0].Resv + count
-	u.pRingBuffer[0].Resv = newTail
+// RecvmsgOut はマルチショットのRECVMSGがバッファの先頭に書くstruct io_uring_recvmsg_outです
+type RecvmsgOut struct {
+	Namelen    uint32
+	Controllen uint32
+	Payloadlen uint32
+	Flags      uint32
 }
 
-func (u *Uring) AcceptMultishot(fd int32, userData uint64) *UringSQE {
+const SizeofRecvmsgOut = int(unsafe.Sizeof(RecvmsgOut{}))
+
+// SendMsg はmsghdrの宛先にmsghdrのiovecを送ります
+// msghdrとそこから指しているアドレス・データはCQEが返るまで手放してはいけません
+func (u *Uring) SendMsg(fd int32, msghdr *unix.Msghdr, userData uint64) *UringSQE {
 	op := &UringSQE{
-		Opcode:   IORING_OP_ACCEPT,
-		Ioprio:   IORING_ACCEPT_MULTISHOT, // https://lore.kernel.org/lkml/a41a1f47-ad05-3245-8ac8-7d8e95ebde44@kernel.dk/t/
+		Opcode:   IORING_OP_SENDMSG,
 		Fd:       fd,
+		Len:      1,
 		UserData: userData,
+		Address:  uint64(uintptr(unsafe.Pointer(msghdr))),
 	}
 	return op
 }
 
-func (u *Uring) RecvFrom(fd int32, userData uint64) *UringSQE {
-	addr := make([]byte, unix.SizeofSockaddrInet6)
-	u.Addr = addr
-	u.Msghdr = unix.Msghdr{
-		Name:       &addr[0],
-		Namelen:    unix.SizeofSockaddrInet6,
-		Control:    nil,
-		Controllen: 0,
+func (u *Uring) Cancel(fd int32, cancelTarget uint64, userData uint64) error {
+	op := &UringSQE{
+		Opcode:   IORING_OP_ASYNC_CANCEL,
+		Address:  cancelTarget,
+		UserData: userData,
 	}
+	return u.Submit(op)
+}
+
+// CancelFd はfdに対するすべての操作をキャンセルします
+// fdをcloseする前に提出しないと、fdが引けずにEBADFになります
+func (u *Uring) CancelFd(fd int32, userData uint64) *UringSQE {
 	op := &UringSQE{
-		Opcode:   IORING_OP_RECVMSG,
-		Ioprio:   0, //NOTE: MultiShotを使うとMsgHdrがカーネル側で初期化されるので取得できない
+		Opcode:    IORING_OP_ASYNC_CANCEL,
+		Fd:        fd,
+		UserFlags: IORING_ASYNC_CANCEL_ALL | IORING_ASYNC_CANCEL_FD,
+		UserData:  userData,
+	}
+	return op
+}
+
+// CloseFd はfdをリングの中で閉じます (Linux 5.6以降)
+func (u *Uring) CloseFd(fd int32, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_CLOSE,
+		Fd:       fd,
+		UserData: userData,
+	}
+	return op
+}
+
+// Connect はfdをaddrにつなぎます (Linux 5.5以降)
+// addrはCQEが返るまでカーネルが読むので、それまで手放してはいけません
+func (u *Uring) Connect(fd int32, addr unsafe.Pointer, addrLen uint32, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_CONNECT,
+		Fd:       fd,
+		Address:  uint64(uintptr(addr)),
+		Offset:   uint64(addrLen),
+		UserData: userData,
+	}
+	return op
+}
+
+// LinkTimeout は直前にIOSQE_IO_LINKでつないだ操作が、tsまでに終わらなければキャンセルします
+// 操作はECANCELEDで、タイムアウトが先に来たときはこのSQEがETIMEで返ります
+// tsはCQEが返るまで手放してはいけません
+func (u *Uring) LinkTimeout(ts *unix.Timespec, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_LINK_TIMEOUT,
+		Fd:       -1,
+		Address:  uint64(uintptr(unsafe.Pointer(ts))),
+		Len:      1,
+		UserData: userData,
+	}
+	return op
+}
+
+// Nop は何もせずにuserDataのCQEだけを返します
+func (u *Uring) Nop(userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_NOP,
+		UserData: userData,
+	}
+	return op
+}
+
+// RecvMultishot はソケットからの受信を1回の登録で繰り返し受け取ります
+// IORING_CQE_F_MOREが立っていないCQEが来たら、カーネルが受信を止めたので登録し直す必要があります
+func (u *Uring) RecvMultishot(fd int32, bufferGroup uint16, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_RECV,
+		Ioprio:   IORING_RECV_MULTISHOT,
 		Flags:    IOSQE_BUFFER_SELECT,
-		BufIndex: 1,
+		BufIndex: bufferGroup,
 		Fd:       fd,
 		UserData: userData,
-		Address:  uint64(uintptr(unsafe.Pointer(&u.Msghdr))),
 	}
-	slog.Debug("RecvFrom", "opcode", op.Opcode, "ioprio", op.Ioprio, "fd", op.Fd)
 	return op
 }
 
-func (u *Uring) Cancel(fd int32, cancelTarget uint64, userData uint64) {
+// Recv はソケットから1回だけ受信します (IORING_RECV_MULTISHOTがない6.0より前のカーネル用)
+func (u *Uring) Recv(fd int32, bufferGroup uint16, userData uint64) *UringSQE {
 	op := &UringSQE{
-		Opcode:   IORING_OP_ASYNC_CANCEL,
-		Address:  cancelTarget,
+		Opcode:   IORING_OP_RECV,
+		Flags:    IOSQE_BUFFER_SELECT,
+		BufIndex: bufferGroup,
+		Fd:       fd,
 		UserData: userData,
 	}
-	u.Submit(op)
+	return op
 }
 
-func (u *Uring) ReadMultishot(fd int32, userData uint64) *UringSQE {
+// ReadMultishot はソケット以外 (pipeなど) からの読み込みを繰り返し受け取ります
+func (u *Uring) ReadMultishot(fd int32, bufferGroup uint16, userData uint64) *UringSQE {
 	op := &UringSQE{
-		// Opcode:   IORING_OP_READ_MULTISHOT,
-		Opcode:   IORING_OP_READ, // 一旦通常のREADで試す
+		Opcode:   IORING_OP_READ_MULTISHOT,
 		Flags:    IOSQE_BUFFER_SELECT,
-		BufIndex: 1,
+		BufIndex: bufferGroup,
 		Fd:       fd,
 		UserData: userData,
 	}
@@ -261,12 +395,107 @@ func (u *Uring) ReadMultishot(fd int32, userData uint64) *UringSQE {
 	return op
 }
 
-func (u *Uring) Submit(op *UringSQE) {
-	_ = u.pushSQE(op)
-	u.sendSQE()
+// Queue はSQEをSQに積むだけで、io_uring_enterは呼びません
+// 積んだSQEはFlushかWaitEventでまとめてカーネルに渡します
+func (u *Uring) Queue(op *UringSQE) error {
+	return u.pushSQE(op)
+}
+
+// Submit はSQEを積んで、溜まっているSQEと一緒にすぐ提出します
+// SQが空かないか提出に失敗したらエラーを返します
+func (u *Uring) Submit(op *UringSQE) error {
+	if err := u.pushSQE(op); err != nil {
+		return err
+	}
+	return u.Flush()
+}
+
+// Flush は積まれているSQEを1回のio_uring_enterでまとめて提出します
+func (u *Uring) Flush() error {
+	if u.sqPoll {
+		return u.wakeupSQPoll()
+	}
+	toSubmit := u.sqPending()
+	if toSubmit == 0 {
+		return nil
+	}
+	return u.enter(toSubmit, 0, 0, nil, 0)
+}
+
+// FlushSync はFlushした上で、SQPOLLならカーネルスレッドが積んだSQEをすべて取り出すまで待ちます
+// fdをcloseする直前のキャンセルなど、この時点で提出が終わっている必要がある操作に使います
+func (u *Uring) FlushSync() error {
+	if err := u.Flush(); err != nil {
+		return err
+	}
+	for u.sqPoll && u.sqPending() > 0 {
+		runtime.Gosched()
+	}
+	return nil
+}
+
+// EnterCalls はこれまでにio_uring_enterを呼んだ回数を返します
+func (u *Uring) EnterCalls() uint64 {
+	return u.enterCalls.Load()
+}
+
+// sqPending はまだカーネルが取り出していないSQEの数を返します
+func (u *Uring) sqPending() uint32 {
+	return atomic.LoadUint32(u.SQ.Tail) - atomic.LoadUint32(u.SQ.Head)
+}
+
+func (u *Uring) enter(toSubmit, minComplete uint32, flags uintptr, arg unsafe.Pointer, argSize uintptr) error {
+	u.enterCalls.Add(1)
+	_, _, errno := unix.Syscall6(
+		unix.SYS_IO_URING_ENTER,
+		uintptr(u.Fd),
+		uintptr(toSubmit),
+		uintptr(minComplete),
+		flags,
+		uintptr(arg),
+		argSize)
+
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// wakeupSQPoll はSQPOLLスレッドが寝ている時だけio_uring_enterで起こします
+// 起きている間はtailを進めるだけでカーネルが拾ってくれる
+func (u *Uring) wakeupSQPoll() error {
+	if atomic.LoadUint32(u.SQ.Flags)&IORING_SQ_NEED_WAKEUP == 0 {
+		return nil
+	}
+	return u.enter(0, 0, IORING_ENTER_SQ_WAKEUP, nil, 0)
+}
+
+func (u *Uring) Read(fd int32, buffer []byte, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_READ,
+		Fd:       fd,
+		Address:  uint64(uintptr(unsafe.Pointer(&buffer[0]))),
+		Len:      uint32(len(buffer)),
+		UserData: userData,
+	}
+	return op
+}
+
+// MsgRing は別のリング (targetFd) のCQにuserDataとresを持ったCQEを直接積みます
+// 自分のリングにも送信結果のCQEが届きます
+func (u *Uring) MsgRing(targetFd int32, res uint32, targetUserData uint64, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_MSG_RING,
+		Fd:       targetFd,
+		Address:  IORING_MSG_DATA,
+		Len:      res,
+		Offset:   targetUserData,
+		UserData: userData,
+	}
+	return op
 }
 
-func (u *Uring) Write(fd int32, buffer []byte, userData uint64) {
+func (u *Uring) Write(fd int32, buffer []byte, userData uint64) *UringSQE {
 	op := &UringSQE{
 		Opcode:   IORING_OP_WRITE,
 		Fd:       fd,
@@ -274,81 +503,109 @@ func (u *Uring) Write(fd int32, buffer []byte, userData uint64) {
 		Len:      uint32(len(buffer)),
 		UserData: userData,
 	}
+	return op
+}
 
-	u.Submit(op)
+// Writev はiovecsが指す複数のバッファを1回で順番に書き込みます
+// iovecsとそれが指すバッファは、CQEが届くまで保持しておく必要があります
+func (u *Uring) Writev(fd int32, iovecs []unix.Iovec, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_WRITEV,
+		Fd:       fd,
+		Address:  uint64(uintptr(unsafe.Pointer(&iovecs[0]))),
+		Len:      uint32(len(iovecs)),
+		UserData: userData,
+	}
+	return op
+}
+
+// SendZC はbufferをカーネルにコピーせずに送信します
+// CQEは2つ届きます。1つ目 (IORING_CQE_F_MOREつき) が送信結果で、
+// 2つ目 (IORING_CQE_F_NOTIF) が届くまではbufferを書き換えてはいけません
+func (u *Uring) SendZC(fd int32, buffer []byte, userData uint64) *UringSQE {
+	op := &UringSQE{
+		Opcode:   IORING_OP_SEND_ZC,
+		Fd:       fd,
+		Address:  uint64(uintptr(unsafe.Pointer(&buffer[0]))),
+		Len:      uint32(len(buffer)),
+		UserData: userData,
+	}
+	return op
 }
 
-func (u *Uring) RegisterRead(fd int32, userData uint64) {
+func (u *Uring) RegisterRead(fd int32, bufferGroup uint16, userData uint64) error {
 	op := &UringSQE{
 		Opcode:   IORING_OP_READ_MULTISHOT,
 		Fd:       fd,
 		Flags:    IOSQE_BUFFER_SELECT,
 		UserData: userData,
-		BufIndex: 1,
+		BufIndex: bufferGroup,
 	}
 
-	u.Submit(op)
+	return u.Submit(op)
 }
 
 func (u *Uring) pushSQE(op *UringSQE) error {
+	u.sqLock.Lock()
+	defer u.sqLock.Unlock()
 
 	head, tail := atomic.LoadUint32(u.SQ.Head), atomic.LoadUint32(u.SQ.Tail)
 	if tail-head >= *u.SQ.Entries {
-		slog.Warn("sq entries full", "tail", tail, "head", head)
-		return nil
+		// 一杯なら溜まっている分を先にカーネルへ渡して空きを作る
+		if err := u.drainSQ(tail - head); err != nil {
+			return err
+		}
+		head = atomic.LoadUint32(u.SQ.Head)
+		if tail-head >= *u.SQ.Entries {
+			slog.Warn("sq entries full", "tail", tail, "head", head)
+			return ErrSubmissionQueueFull
+		}
 	}
 
-	for {
-		tail := atomic.LoadUint32(u.SQ.Tail)
-
-		if atomic.CompareAndSwapUint32(u.SQ.Tail, tail, tail+1) {
-			sqe := unsafe.Slice((*UringSQE)(unsafe.Pointer(u.SQ.SQEPtr)), *u.SQ.Entries)
-			sqe[tail&*u.SQ.Mask] = *op
+	// SQPOLLではカーネルがtailを見た瞬間にSQEを読むので、SQEを書き終えてからtailを進める
+	index := tail & *u.SQ.Mask
+	sqe := unsafe.Slice((*UringSQE)(u.SQ.SQEPtr), *u.SQ.Entries)
+	sqe[index] = *op
 
-			array := unsafe.Slice((*uint32)(unsafe.Pointer(u.SQ.ArrayPtr)), *u.SQ.Entries)
-			array[tail&*u.SQ.Mask] = tail
+	array := unsafe.Slice((*uint32)(u.SQ.ArrayPtr), *u.SQ.Entries)
+	array[index] = index
 
-			break
-		}
-		runtime.Gosched()
-	}
+	atomic.StoreUint32(u.SQ.Tail, tail+1)
 	return nil
 }
 
-func (u *Uring) sendSQE() {
-	_, _, errno := unix.Syscall6(
-		unix.SYS_IO_URING_ENTER,
-		uintptr(u.Fd),
-		1,
-		0,
-		0,
-		0,
-		0)
-
-	if errno != 0 {
-		slog.Error("Uring failed", "errno", errno, "err", errno.Error())
-		panic(errno)
+func (u *Uring) drainSQ(pending uint32) error {
+	if u.sqPoll {
+		return u.enter(0, 0, IORING_ENTER_SQ_WAKEUP|IORING_ENTER_SQ_WAIT, nil, 0)
 	}
+	return u.enter(pending, 0, 0, nil, 0)
 }
 
+// WaitEvent は積まれているSQEの提出と完了待ちを1回のio_uring_enterで行います
 func (u *Uring) WaitEvent() error {
-	_, _, errno := unix.Syscall6(
-		unix.SYS_IO_URING_ENTER,
-		uintptr(u.Fd),
-		0,
-		1,
-		IORING_ENTER_GETEVENTS,
-		0,
-		0)
+	toSubmit, err := u.prepareWait()
+	if err != nil {
+		return err
+	}
 
-	if errno != 0 {
-		slog.Error("syscall sys_io_uring_enter failed", "err", errno.Error(), "errno", int(errno))
-		return errno
+	err = u.enter(toSubmit, 1, IORING_ENTER_GETEVENTS, nil, 0)
+	if err != nil {
+		slog.Error("syscall sys_io_uring_enter failed", "err", err.Error(), "errno", err)
+		return err
 	}
 	return nil
 }
 
-func (u *Uring) Timeout(d time.Duration, userData uint64) {
+// prepareWait は待つ前に提出するSQEの数を返します
+// SQPOLLではカーネルスレッドが提出するので、必要なら起こすだけ
+func (u *Uring) prepareWait() (uint32, error) {
+	if u.sqPoll {
+		return 0, u.wakeupSQPoll()
+	}
+	return u.sqPending(), nil
+}
+
+func (u *Uring) Timeout(d time.Duration, userData uint64) error {
 	timeSpec := unix.NsecToTimespec(d.Nanoseconds())
 	op := &UringSQE{
 		Opcode:    IORING_OP_TIMEOUT,
@@ -360,10 +617,10 @@ func (u *Uring) Timeout(d time.Duration, userData uint64) {
 		UserData:  userData,
 	}
 
-	u.Submit(op)
+	return u.Submit(op)
 }
 
-func (u *Uring) TimeoutWithMultiShot(d time.Duration, userData uint64) {
+func (u *Uring) TimeoutWithMultiShot(d time.Duration, userData uint64) error {
 	timeSpec := unix.NsecToTimespec(d.Nanoseconds())
 	op := &UringSQE{
 		Opcode:    IORING_OP_TIMEOUT,
@@ -375,7 +632,7 @@ func (u *Uring) TimeoutWithMultiShot(d time.Duration, userData uint64) {
 		UserData:  userData,
 	}
 
-	u.Submit(op)
+	return u.Submit(op)
 }
 
 func (u *Uring) WaitEventWithTimeout(d time.Duration) error {
@@ -387,25 +644,23 @@ func (u *Uring) WaitEventWithTimeout(d time.Duration) error {
 		ts:         uint64(uintptr(unsafe.Pointer(&timeSpec))),
 	}
 
+	toSubmit, err := u.prepareWait()
+	if err != nil {
+		return err
+	}
+
 	t1 := time.Now()
 
-	_, _, errno := unix.Syscall6(
-		unix.SYS_IO_URING_ENTER,
-		uintptr(u.Fd),
-		0,
-		1,
-		IORING_ENTER_GETEVENTS|IORING_ENTER_EXT_ARG,
-		uintptr(unsafe.Pointer(getEventsArgs)),
-		unsafe.Sizeof(*getEventsArgs))
+	err = u.enter(toSubmit, 1, IORING_ENTER_GETEVENTS|IORING_ENTER_EXT_ARG, unsafe.Pointer(getEventsArgs), unsafe.Sizeof(*getEventsArgs))
 
-	if errno != 0 {
-		if errors.Is(errno, unix.ETIME) {
+	if err != nil {
+		if errors.Is(err, unix.ETIME) {
 			return toukaerrors.ErrWouldBlock
 		}
 		t2 := time.Now()
 		slog.Debug("wait event", "d", d, "elapsed", t2.Sub(t1))
-		slog.Error("syscall sys_io_uring_enter failed", "err", errno.Error(), "errno", int(errno))
-		return errno
+		slog.Error("syscall sys_io_uring_enter failed", "err", err.Error(), "errno", err)
+		return err
 	}
 	return nil
 }
@@ -463,10 +718,6 @@ func (u *Uring) getCQE() *UringCQE {
 	return nil
 }
 
-func (u *Uring) Read(buffer []byte) {
-	// copy(buffer, u.pRingBuffer[:len(buffer)])
-}
-
 func (u *Uring) Close() error {
 	err := unix.Close(int(u.Fd))
 	if err != nil {
@@ -571,7 +822,7 @@ type uringGetEventArgs struct {
 
 const (
 	IORING_OFF_SQ_RING    int64 = 0
-	ORING_OFF_CQ_RING     int64 = 0x8000000
+	IORING_OFF_CQ_RING    int64 = 0x8000000
 	IORING_OFF_SQES       int64 = 0x10000000
 	IORING_OFF_PBUF_RING  int64 = 0x80000000
 	IORING_OFF_PBUF_SHIFT int64 = 16
@@ -682,13 +933,79 @@ const (
 	IORING_RECV_MULTISHOT
 )
 
+// IORING_OP_MSG_RING command types, stored in sqe->addr
+const (
+	IORING_MSG_DATA    = iota // pass sqe->len as 'res' and off as user_data
+	IORING_MSG_SEND_FD        // send a registered fd to another ring
+)
+
+// async cancel flags stored in sqe->cancel_flags
 const (
-	IORING_FEAT_SINGLE_MMAP = 1 << 0
+	IORING_ASYNC_CANCEL_ALL = 1 << iota
+	IORING_ASYNC_CANCEL_FD
+	IORING_ASYNC_CANCEL_ANY
+	IORING_ASYNC_CANCEL_FD_FIXED
+)
+
+// io_uring_params->features
+const (
+	IORING_FEAT_SINGLE_MMAP = 1 << iota
+	IORING_FEAT_NODROP
+	IORING_FEAT_SUBMIT_STABLE
+	IORING_FEAT_RW_CUR_POS
+	IORING_FEAT_CUR_PERSONALITY
+	IORING_FEAT_FAST_POLL
+	IORING_FEAT_POLL_32BITS
+	IORING_FEAT_SQPOLL_NONFIXED
+	IORING_FEAT_EXT_ARG
+	IORING_FEAT_NATIVE_WORKERS
+	IORING_FEAT_RSRC_TAGS
+	IORING_FEAT_CQE_SKIP
+	IORING_FEAT_LINKED_FILE
+	IORING_FEAT_REG_REG_RING
+	IORING_FEAT_RECVSEND_BUNDLE
+	IORING_FEAT_MIN_TIMEOUT
+)
+
+// io_uring_setup flags
+const (
+	IORING_SETUP_IOPOLL = 1 << iota
+	IORING_SETUP_SQPOLL
+	IORING_SETUP_SQ_AFF
+	IORING_SETUP_CQSIZE
+	IORING_SETUP_CLAMP
+	IORING_SETUP_ATTACH_WQ
+	IORING_SETUP_R_DISABLED
+	IORING_SETUP_SUBMIT_ALL
+	IORING_SETUP_COOP_TASKRUN
+	IORING_SETUP_TASKRUN_FLAG
+	IORING_SETUP_SQE128
+	IORING_SETUP_CQE32
+	IORING_SETUP_SINGLE_ISSUER
+	IORING_SETUP_DEFER_TASKRUN
+)
+
+// sq_ring->flags
+const (
+	IORING_SQ_NEED_WAKEUP = 1 << iota
+	IORING_SQ_CQ_OVERFLOW
+	IORING_SQ_TASKRUN
 )
 
 // https://github.com/axboe/liburing/blob/c5eead2659ef5ea86ef8c78410fa42d9bea976c9/src/include/liburing/io_uring.h#L565
 const (
-	IORING_REGISTER_PBUF_RING = 22
+	IORING_REGISTER_FILES2      = 13
+	IORING_REGISTER_PBUF_RING   = 22
+	IORING_UNREGISTER_PBUF_RING = 23
+)
+
+const (
+	IORING_RSRC_REGISTER_SPARSE = 1 << 0
+)
+
+// sqe->file_indexに指定するとカーネルが空いているスロットを選ぶ
+const (
+	IORING_FILE_INDEX_ALLOC = -1 // ~0U
 )
 
 const (
@@ -0,0 +1,136 @@
+//go:build linux
+
+package engine
+
+import (
+	"log/slog"
+	"slices"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+)
+
+// BufferGroupConfig は同じサイズのバッファをまとめたグループの設定です
+type BufferGroupConfig struct {
+	Size    int // 1バッファのバイト数
+	Entries int // 1リングあたりのバッファ数 (2の累乗)
+	// MaxRings はバッファが足りなくなった時に増やせるリングの数の上限です (1なら増やさない)
+	MaxRings int
+}
+
+var defaultBufferGroups = []BufferGroupConfig{
+	{Size: core.MaxBufferSize, Entries: 256, MaxRings: 4},
+}
+
+// bufferClass は同じサイズのリングの集まりです
+// 足りなくなったら新しいグループIDでリングを追加して増やします
+type bufferClass struct {
+	config BufferGroupConfig
+	rings  []*core.BufferRing
+}
+
+type bufferPool struct {
+	uring       *core.Uring
+	classes     []*bufferClass // サイズの小さい順
+	rings       map[uint16]*core.BufferRing
+	armed       map[uint16]int // グループごとの待機中の受信操作の数
+	nextGroupID uint16
+}
+
+func newBufferPool(uring *core.Uring, configs []BufferGroupConfig) (*bufferPool, error) {
+	configs = slices.Clone(configs)
+	slices.SortFunc(configs, func(a, b BufferGroupConfig) int {
+		return a.Size - b.Size
+	})
+
+	p := &bufferPool{
+		uring:       uring,
+		rings:       make(map[uint16]*core.BufferRing),
+		armed:       make(map[uint16]int),
+		nextGroupID: 1,
+	}
+	for _, config := range configs {
+		class := &bufferClass{config: config}
+		p.classes = append(p.classes, class)
+		if _, err := p.grow(class); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *bufferPool) grow(class *bufferClass) (*core.BufferRing, error) {
+	ring, err := p.uring.RegisterBufferRing(p.nextGroupID, class.config.Entries, class.config.Size)
+	if err != nil {
+		return nil, err
+	}
+	p.nextGroupID++
+	class.rings = append(class.rings, ring)
+	p.rings[ring.GroupID] = ring
+	return ring, nil
+}
+
+// pick はclassの中で、待機中の操作に対して一番空きの多いリングを選んで登録済みとして数えます
+// 同じリングに操作が偏ると、他のリングに空きがあってもENOBUFSになるため
+func (p *bufferPool) pick(classIndex int) *core.BufferRing {
+	class := p.classes[classIndex]
+	best := class.rings[0]
+	for _, ring := range class.rings[1:] {
+		if p.spare(ring) > p.spare(best) {
+			best = ring
+		}
+	}
+	p.armed[best.GroupID]++
+	return best
+}
+
+// done は受信操作が終わった (これ以上CQEが来ない) ことを記録します
+func (p *bufferPool) done(groupID uint16) {
+	if p.armed[groupID] > 0 {
+		p.armed[groupID]--
+	}
+}
+
+func (p *bufferPool) spare(ring *core.BufferRing) int {
+	return ring.Available() - p.armed[ring.GroupID]
+}
+
+// expand はバッファ不足 (ENOBUFS) の時に呼ばれ、上限まではリングを追加します
+func (p *bufferPool) expand(class *bufferClass) (*core.BufferRing, bool) {
+	if len(class.rings) >= max(class.config.MaxRings, 1) {
+		return nil, false
+	}
+	ring, err := p.grow(class)
+	if err != nil {
+		slog.Warn("Failed to grow buffer group", "size", class.config.Size, "error", err)
+		return nil, false
+	}
+	slog.Debug("Grew buffer group", "size", class.config.Size, "rings", len(class.rings))
+	return ring, true
+}
+
+// expandGroup はgroupIDが属するclassを増やします
+func (p *bufferPool) expandGroup(groupID uint16) {
+	p.expand(p.classes[p.classOf(groupID)])
+}
+
+func (p *bufferPool) ring(groupID uint16) (*core.BufferRing, bool) {
+	ring, ok := p.rings[groupID]
+	return ring, ok
+}
+
+// classOf はグループIDが属するclassの番号を返します
+func (p *bufferPool) classOf(groupID uint16) int {
+	for i, class := range p.classes {
+		for _, ring := range class.rings {
+			if ring.GroupID == groupID {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// next はバッファを使い切るほどのデータが来た時に、1つ大きいclassを返します
+func (p *bufferPool) next(classIndex int) int {
+	return min(classIndex+1, len(p.classes)-1)
+}
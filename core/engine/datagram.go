@@ -0,0 +1,150 @@
+//go:build linux
+
+package engine
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"unsafe"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"golang.org/x/sys/unix"
+)
+
+// recvMsg はfdに登録しているRECVMSGのmsghdrです
+// マルチショットではカーネルが雛形として読み続けるので、最後のCQEが届くまで置いておきます
+type recvMsg struct {
+	hdr       unix.Msghdr
+	name      [unix.SizeofSockaddrInet6]byte // IPv4とIPv6のどちらの送信元も入る大きさ
+	multishot bool
+}
+
+// sendMsg は送信中のSENDMSGのmsghdrです。宛先のsockaddrとiovecもここから参照しておきます
+type sendMsg struct {
+	hdr  unix.Msghdr
+	iov  unix.Iovec
+	name unsafe.Pointer
+	to   netip.AddrPort // SendToに渡された宛先 (SENDMSGイベントで返す)
+}
+
+// datagramMsgs はカーネルが使い終わっていないRECVMSG/SENDMSGのmsghdrを持っておきます
+// 操作ごとに別のmsghdrを使うので、同時にいくつ受信・送信していても互いに上書きしません
+type datagramMsgs struct {
+	recvs    map[int32]*recvMsg // fd -> 登録中のRECVMSG
+	next     uint16
+	sends    map[uint16]*sendMsg // 送信ID -> 送信中のSENDMSG
+	families socketFamilies
+}
+
+func newDatagramMsgs() *datagramMsgs {
+	return &datagramMsgs{
+		recvs:    make(map[int32]*recvMsg),
+		sends:    make(map[uint16]*sendMsg),
+		families: make(socketFamilies),
+	}
+}
+
+// recv はfdのRECVMSGに使うmsghdrを作ります。前の操作のmsghdrはもう使われていないので置き換えます
+func (m *datagramMsgs) recv(fd int32, multishot bool) *recvMsg {
+	r := &recvMsg{multishot: multishot}
+	r.hdr.Name = &r.name[0]
+	r.hdr.Namelen = uint32(len(r.name))
+	m.recvs[fd] = r
+	return r
+}
+
+// endRecv はfdのRECVMSGが終わったのでmsghdrを手放します
+func (m *datagramMsgs) endRecv(fd int32) {
+	delete(m.recvs, fd)
+}
+
+// pinSend はtoへdataを送るmsghdrを作って保持し、CQEで引き当てる送信IDを返します
+// 送信IDが65535個すべて使われていればErrWouldBlockを返します
+func (m *datagramMsgs) pinSend(fd int32, to netip.AddrPort, data []byte) (uint16, *sendMsg, error) {
+	dst, err := m.families.destination(fd, to)
+	if err != nil {
+		return 0, nil, err
+	}
+	s := &sendMsg{to: to}
+	name, nameLen, err := core.RawSockaddr(dst)
+	if err != nil {
+		return 0, nil, err
+	}
+	s.name = name
+	s.hdr.Name = (*byte)(name)
+	s.hdr.Namelen = nameLen
+	if len(data) > 0 {
+		s.iov.Base = &data[0]
+		s.iov.SetLen(len(data))
+		s.hdr.Iov = &s.iov
+		s.hdr.SetIovlen(1)
+	}
+	id, ok := allocID(&m.next, func(id uint16) bool {
+		_, used := m.sends[id]
+		return used
+	})
+	if !ok {
+		return 0, nil, toukaerrors.ErrWouldBlock
+	}
+	m.sends[id] = s
+	return id, s, nil
+}
+
+// unpinSend はCQEが届いたSENDMSGのmsghdrを手放して返します
+func (m *datagramMsgs) unpinSend(id uint16) *sendMsg {
+	s := m.sends[id]
+	delete(m.sends, id)
+	return s
+}
+
+// datagram はRECVMSGで受け取ったバッファから送信元とデータを取り出します
+// マルチショットのバッファはio_uring_recvmsg_out・送信元・制御メッセージ・データの順に並んでいます
+// truncatedはデータグラムがバッファに収まらず、後ろが切り捨てられたことを表します
+func (r *recvMsg) datagram(b []byte) (from netip.AddrPort, data []byte, truncated bool, err error) {
+	if !r.multishot {
+		from, err = parseRawSockaddr(r.name[:])
+		return from, b, false, err
+	}
+	if len(b) < core.SizeofRecvmsgOut {
+		return netip.AddrPort{}, nil, false, unix.EINVAL
+	}
+	out := core.RecvmsgOut{
+		Namelen:    binary.NativeEndian.Uint32(b[0:4]),
+		Controllen: binary.NativeEndian.Uint32(b[4:8]),
+		Payloadlen: binary.NativeEndian.Uint32(b[8:12]),
+		Flags:      binary.NativeEndian.Uint32(b[12:16]),
+	}
+	nameStart := core.SizeofRecvmsgOut
+	payloadStart := nameStart + int(r.hdr.Namelen) + int(r.hdr.Controllen)
+	if len(b) < payloadStart {
+		return netip.AddrPort{}, nil, false, unix.EINVAL
+	}
+	name := b[nameStart : nameStart+int(min(out.Namelen, r.hdr.Namelen))]
+	from, err = parseRawSockaddr(name)
+	payloadEnd := min(payloadStart+int(out.Payloadlen), len(b))
+	return from, b[payloadStart:payloadEnd], out.Flags&unix.MSG_TRUNC != 0, err
+}
+
+// socketFamilies はデータグラムを送るソケットのアドレスファミリーを覚えておきます
+type socketFamilies map[int32]int
+
+// destination はtoをfdのソケットから送れる宛先にします
+// 受信した送信元は::ffff:a.b.c.dをIPv4にしているので、デュアルスタックのIPv6ソケットから返すときはIPv4射影アドレスに戻します
+func (f socketFamilies) destination(fd int32, to netip.AddrPort) (netip.AddrPort, error) {
+	if !to.Addr().Is4() {
+		return to, nil
+	}
+	family, ok := f[fd]
+	if !ok {
+		var err error
+		if family, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN); err != nil {
+			return netip.AddrPort{}, err
+		}
+		f[fd] = family
+	}
+	if family == unix.AF_INET6 {
+		return netip.AddrPortFrom(netip.AddrFrom16(to.Addr().As16()), to.Port()), nil
+	}
+	return to, nil
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
+)
+
+// rawSockaddr はカーネルが書くのと同じ形のsockaddr_in/sockaddr_in6を作ります
+func rawSockaddr(ap netip.AddrPort) []byte {
+	if ap.Addr().Is4() {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		binary.NativeEndian.PutUint16(b[0:2], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], ap.Port())
+		a := ap.Addr().As4()
+		copy(b[4:8], a[:])
+		return b
+	}
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], ap.Port())
+	a := ap.Addr().As16()
+	copy(b[8:24], a[:])
+	return b
+}
+
+// recvmsgBuffer はマルチショットのRECVMSGがバッファに書く並び (io_uring_recvmsg_out・送信元・制御メッセージ・データ) を作ります
+func recvmsgBuffer(r *recvMsg, out core.RecvmsgOut, name []byte, payload string) []byte {
+	b := make([]byte, core.SizeofRecvmsgOut+int(r.hdr.Namelen)+int(r.hdr.Controllen))
+	binary.NativeEndian.PutUint32(b[0:4], out.Namelen)
+	binary.NativeEndian.PutUint32(b[4:8], out.Controllen)
+	binary.NativeEndian.PutUint32(b[8:12], out.Payloadlen)
+	binary.NativeEndian.PutUint32(b[12:16], out.Flags)
+	copy(b[core.SizeofRecvmsgOut:], name)
+	return append(b, payload...)
+}
+
+func TestRecvMsgDatagram(t *testing.T) {
+	v4 := netip.MustParseAddrPort("192.0.2.1:5353")
+	v6 := netip.MustParseAddrPort("[2001:db8::1]:5353")
+	mapped := netip.MustParseAddrPort("[::ffff:192.0.2.1]:5353")
+
+	tests := []struct {
+		name       string
+		controllen uint32 // msghdrに用意した制御メッセージの大きさ
+		out        core.RecvmsgOut
+		from       []byte
+		payload    string
+		trim       int // バッファの後ろを切り落とすバイト数
+		wantFrom   netip.AddrPort
+		wantData   string
+		wantTrunc  bool
+		wantErr    error
+	}{
+		{
+			name:     "IPv4",
+			out:      core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet4, Payloadlen: 5},
+			from:     rawSockaddr(v4),
+			payload:  "hello",
+			wantFrom: v4,
+			wantData: "hello",
+		},
+		{
+			name:     "IPv6",
+			out:      core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet6, Payloadlen: 5},
+			from:     rawSockaddr(v6),
+			payload:  "hello",
+			wantFrom: v6,
+			wantData: "hello",
+		},
+		{
+			name:     "IPv4-mapped IPv6 is unmapped",
+			out:      core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet6, Payloadlen: 5},
+			from:     rawSockaddr(mapped),
+			payload:  "hello",
+			wantFrom: v4,
+			wantData: "hello",
+		},
+		{
+			name:     "empty datagram",
+			out:      core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet4},
+			from:     rawSockaddr(v4),
+			wantFrom: v4,
+		},
+		{
+			name:       "payload after control messages",
+			controllen: 32,
+			out:        core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet4, Payloadlen: 5},
+			from:       rawSockaddr(v4),
+			payload:    "hello",
+			wantFrom:   v4,
+			wantData:   "hello",
+		},
+		{
+			name:      "truncated payload",
+			out:       core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet4, Payloadlen: 100, Flags: unix.MSG_TRUNC},
+			from:      rawSockaddr(v4),
+			payload:   "hello",
+			wantFrom:  v4,
+			wantData:  "hello",
+			wantTrunc: true,
+		},
+		{
+			name:     "name longer than msghdr is cut",
+			out:      core.RecvmsgOut{Namelen: 128, Payloadlen: 5},
+			from:     rawSockaddr(v6),
+			payload:  "hello",
+			wantFrom: v6,
+			wantData: "hello",
+		},
+		{
+			name:    "shorter than recvmsg_out",
+			out:     core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet4},
+			from:    rawSockaddr(v4),
+			trim:    unix.SizeofSockaddrInet6 + 8,
+			wantErr: unix.EINVAL,
+		},
+		{
+			name:    "shorter than name",
+			out:     core.RecvmsgOut{Namelen: unix.SizeofSockaddrInet4},
+			from:    rawSockaddr(v4),
+			trim:    4,
+			wantErr: unix.EINVAL,
+		},
+		{
+			name:     "unknown family",
+			out:      core.RecvmsgOut{Namelen: 2, Payloadlen: 5},
+			from:     []byte{0xff, 0xff},
+			payload:  "hello",
+			wantData: "hello",
+			wantErr:  unix.EAFNOSUPPORT,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newDatagramMsgs().recv(3, true)
+			r.hdr.Controllen = uint64(tt.controllen)
+			b := recvmsgBuffer(r, tt.out, tt.from, tt.payload)
+			b = b[:len(b)-tt.trim]
+
+			from, data, truncated, err := r.datagram(b)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if from != tt.wantFrom || string(data) != tt.wantData || truncated != tt.wantTrunc {
+				t.Errorf("datagram = %v %q %v, want %v %q %v", from, data, truncated, tt.wantFrom, tt.wantData, tt.wantTrunc)
+			}
+		})
+	}
+}
+
+func TestRecvMsgDatagramSingleshot(t *testing.T) {
+	from := netip.MustParseAddrPort("192.0.2.1:5353")
+	r := newDatagramMsgs().recv(3, false)
+	// 1回だけのRECVMSGでは、送信元はmsghdrのnameに、データはバッファの先頭から入る
+	copy(r.name[:], rawSockaddr(from))
+
+	gotFrom, data, truncated, err := r.datagram([]byte("hello"))
+	if err != nil {
+		t.Fatalf("datagram: %v", err)
+	}
+	if gotFrom != from || string(data) != "hello" || truncated {
+		t.Errorf("datagram = %v %q %v, want %v %q false", gotFrom, data, truncated, from, "hello")
+	}
+}
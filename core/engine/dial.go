@@ -0,0 +1,103 @@
+//go:build linux
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+	"unsafe"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
+)
+
+// DialOption はDialに渡すオプションです
+type DialOption func(*dialConfig)
+
+type dialConfig struct {
+	socket SocketOptions
+}
+
+// WithDialSocketOptions はつなぐソケットのオプションを指定します
+// connectする前に設定するので、SO_RCVBUFなどもウィンドウの大きさに反映されます
+func WithDialSocketOptions(o SocketOptions) DialOption {
+	return func(c *dialConfig) {
+		c.socket = o
+	}
+}
+
+// dialTarget はconnect中のソケットです
+// カーネルが読むsockaddrとタイムアウトは、完了するまでここで持っておきます
+type dialTarget struct {
+	fd       int32
+	addr     unsafe.Pointer
+	addrLen  uint32
+	deadline time.Time // ゼロならタイムアウトなし
+	timeout  unix.Timespec
+	pending  int   // まだ返っていないCQEの数 (CONNECTと、期限があればLINK_TIMEOUT)
+	res      int32 // CONNECTのCQEの結果
+	timedOut bool  // LINK_TIMEOUTが期限切れ (-ETIME) で返った
+}
+
+// openDialSocket はnetwork/addressにつなぐソケットを作って、オプションを設定します
+// networkは"tcp"・"unix"・"unixpacket"で、tcpのaddressは"10.0.0.1:80"や"[::1]:80"のようなIPアドレスです (名前解決はしません)
+func openDialSocket(ctx context.Context, network, address string, opts []DialOption) (*dialTarget, error) {
+	var config dialConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	d := &dialTarget{}
+	if deadline, ok := ctx.Deadline(); ok {
+		if time.Until(deadline) <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		d.deadline = deadline
+	}
+
+	var s *core.Socket
+	var err error
+	switch network {
+	case "tcp":
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if d.addr, d.addrLen, err = core.RawSockaddr(addr); err != nil {
+			return nil, err
+		}
+		s, err = core.CreateTCPSocket(core.Family(addr.Addr()))
+	case "unix", "unixpacket":
+		if d.addr, d.addrLen, err = core.RawSockaddrUnix(address); err != nil {
+			return nil, err
+		}
+		sockType := unix.SOCK_STREAM
+		if network == "unixpacket" {
+			sockType = unix.SOCK_SEQPACKET
+		}
+		s, err = core.CreateUnixSocket(sockType)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedProtocol, network)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := setsockopts(s.Fd, config.socket.connOptions(network == "tcp")); err != nil {
+		s.Close()
+		return nil, err
+	}
+	d.fd = s.Fd
+	return d, nil
+}
+
+// connect はノンブロッキングのconnectを呼びます。つながり終わっていなければEINPROGRESSを返します
+func (d *dialTarget) connect() error {
+	_, _, errno := unix.Syscall(unix.SYS_CONNECT, uintptr(d.fd), uintptr(d.addr), uintptr(d.addrLen))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,548 @@
+//go:build linux
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"time"
+	"unsafe"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"github.com/touka-aoi/low-level-server/core/event"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	epollWaitBatch = 64
+)
+
+// epollFd はepollに登録しているfdごとの状態です
+type epollFd struct {
+	fd         int32
+	eventType  event.EventType // ACCEPT / READ / RECVMSG のどれで待っているか
+	readable   bool
+	connecting bool // Dialしてconnectの完了 (EPOLLOUT) を待っている
+	registered bool
+	pending    [][][]byte // EAGAINで書き込めなかったWrite/Writev (順番を保持する)
+}
+
+func (f *epollFd) events() uint32 {
+	var ev uint32
+	if f.readable {
+		ev |= unix.EPOLLIN
+	}
+	if len(f.pending) > 0 || f.connecting {
+		ev |= unix.EPOLLOUT
+	}
+	return ev
+}
+
+// EpollNetEngine はio_uringが使えない環境向けのNetEngineです
+// UringNetEngineと同じNetEventを返すようにしています
+type EpollNetEngine struct {
+	epfd   int
+	wakeFd int
+	fds    map[int32]*epollFd
+	ready  []unix.EpollEvent // WaitEventで取得してまだ処理していないイベント
+	events []*NetEvent       // 次のReceiveDataで返す完了イベント (Writeなど)
+	buffer []byte
+	dials  map[int32]time.Time // connect中のfdとその期限 (ゼロなら期限なし)
+	// families はSendToするソケットのアドレスファミリー
+	families socketFamilies
+}
+
+func NewEpollNetEngine() (*EpollNetEngine, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+
+	err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wakeFd)})
+	if err != nil {
+		_ = unix.Close(wakeFd)
+		_ = unix.Close(epfd)
+		return nil, err
+	}
+
+	return &EpollNetEngine{
+		epfd:     epfd,
+		wakeFd:   wakeFd,
+		fds:      make(map[int32]*epollFd),
+		buffer:   make([]byte, core.MaxBufferSize),
+		dials:    make(map[int32]time.Time),
+		families: make(socketFamilies),
+	}, nil
+}
+
+func (e *EpollNetEngine) Accept(ctx context.Context, listener Listener) error {
+	// acceptはreadinessを見てから行うので、listenerはノンブロッキングにしておく
+	if err := unix.SetNonblock(int(listener.Fd()), true); err != nil {
+		return err
+	}
+	return e.watchRead(listener.Fd(), event.EVENT_TYPE_ACCEPT)
+}
+
+// Dial はノンブロッキングのconnectを呼び、すぐにつながらなければEPOLLOUTで完了を待ちます
+// 期限はReceiveDataのたびに確かめ、過ぎたらcontext.DeadlineExceededのCONNECTを返します
+func (e *EpollNetEngine) Dial(ctx context.Context, network, address string, opts ...DialOption) (int32, error) {
+	d, err := openDialSocket(ctx, network, address, opts)
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.SetNonblock(int(d.fd), true); err != nil {
+		unix.Close(int(d.fd))
+		return -1, err
+	}
+
+	err = d.connect()
+	switch {
+	case err == nil:
+		e.completeConnect(d.fd, nil)
+		return d.fd, nil
+	case errors.Is(err, unix.EINPROGRESS), errors.Is(err, unix.EAGAIN):
+	default:
+		e.completeConnect(d.fd, err)
+		return d.fd, nil
+	}
+
+	f := e.lookup(d.fd)
+	f.connecting = true
+	if err := e.update(f); err != nil {
+		delete(e.fds, d.fd)
+		unix.Close(int(d.fd))
+		return -1, err
+	}
+	e.dials[d.fd] = d.deadline
+	return d.fd, nil
+}
+
+func (e *EpollNetEngine) CancelAccept(ctx context.Context, listener Listener) error {
+	f, ok := e.fds[listener.Fd()]
+	if !ok {
+		return nil
+	}
+	f.readable = false
+	slog.DebugContext(ctx, "Accept operation canceled", "fd", listener.Fd())
+	return e.update(f)
+}
+
+func (e *EpollNetEngine) RecvFrom(ctx context.Context, listener Listener) error {
+	delete(e.families, listener.Fd())
+	return e.watchRead(listener.Fd(), event.EVENT_TYPE_RECVMSG)
+}
+
+func (e *EpollNetEngine) RegisterRead(ctx context.Context, fd int32) error {
+	slog.DebugContext(ctx, "Registering read operation", "fd", fd)
+	return e.watchRead(fd, event.EVENT_TYPE_READ)
+}
+
+// Write関数はすぐに書き込みを試み、書き込めなかった分はEPOLLOUTを待って書き込みます
+// 完了はio_uringと同じくEVENT_TYPE_WRITEとして次のReceiveDataで返します
+func (e *EpollNetEngine) Write(ctx context.Context, fd int32, data []byte) error {
+	return e.Writev(ctx, fd, [][]byte{data})
+}
+
+// Writev関数はWriteと同じく、すぐに書き込めなかった分はEPOLLOUTを待ってwritevで書き込みます
+func (e *EpollNetEngine) Writev(ctx context.Context, fd int32, bufs [][]byte) error {
+	f := e.lookup(fd)
+	if len(f.pending) > 0 {
+		f.pending = append(f.pending, bufs)
+		return nil
+	}
+
+	n, err := unix.Writev(int(fd), bufs)
+	if errors.Is(err, unix.EAGAIN) {
+		f.pending = append(f.pending, bufs)
+		return e.update(f)
+	}
+	e.completeWrite(fd, n, err)
+	return nil
+}
+
+// SendTo はすぐにsendtoで送り、完了を次のReceiveDataでEVENT_TYPE_SENDMSGとして返します
+// 送信バッファがいっぱいならそのデータグラムは送らず、EAGAINのエラーで返します (UDPなので待って送り直すことはしません)
+func (e *EpollNetEngine) SendTo(ctx context.Context, fd int32, to netip.AddrPort, data []byte) error {
+	dst, err := e.families.destination(fd, to)
+	if err != nil {
+		return err
+	}
+	name, nameLen, err := core.RawSockaddr(dst)
+	if err != nil {
+		return err
+	}
+	var p unsafe.Pointer
+	if len(data) > 0 {
+		p = unsafe.Pointer(&data[0])
+	}
+	n, _, errno := unix.Syscall6(unix.SYS_SENDTO, uintptr(fd), uintptr(p), uintptr(len(data)), unix.MSG_DONTWAIT, uintptr(name), uintptr(nameLen))
+	ev := &NetEvent{
+		EventType:  event.EVENT_TYPE_SENDMSG,
+		Fd:         fd,
+		RemoteAddr: to,
+	}
+	if errno != 0 {
+		ev.Err = errno
+	} else {
+		ev.SentLength = int(n)
+	}
+	e.events = append(e.events, ev)
+	return nil
+}
+
+// Flush はepollでは書き込みをすぐに行うので何もしません
+func (e *EpollNetEngine) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (e *EpollNetEngine) ReceiveData(ctx context.Context) ([]*NetEvent, error) {
+	if len(e.ready) == 0 {
+		if err := e.wait(0); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ev := range e.ready {
+		if int(ev.Fd) == e.wakeFd {
+			e.drainWakeup()
+			continue
+		}
+
+		f, ok := e.fds[ev.Fd]
+		if !ok {
+			continue
+		}
+
+		if ev.Events&(unix.EPOLLOUT|unix.EPOLLERR|unix.EPOLLHUP) != 0 && f.connecting {
+			e.finishConnect(ctx, f)
+		}
+
+		if ev.Events&(unix.EPOLLOUT|unix.EPOLLERR|unix.EPOLLHUP) != 0 && len(f.pending) > 0 {
+			e.flush(ctx, f)
+		}
+
+		if ev.Events&(unix.EPOLLIN|unix.EPOLLERR|unix.EPOLLHUP) != 0 && f.readable {
+			switch f.eventType {
+			case event.EVENT_TYPE_ACCEPT:
+				e.handleAccept(ctx, f)
+			case event.EVENT_TYPE_READ:
+				e.handleRead(ctx, f)
+			case event.EVENT_TYPE_RECVMSG:
+				e.handleRecvMsg(ctx, f)
+			}
+		}
+	}
+	e.ready = e.ready[:0]
+	e.expireDials(ctx)
+
+	netEvents := e.events
+	e.events = nil
+	if len(netEvents) == 0 {
+		return nil, toukaerrors.ErrWouldBlock
+	}
+	return netEvents, nil
+}
+
+func (e *EpollNetEngine) WaitEvent() error {
+	if len(e.events) > 0 || len(e.ready) > 0 {
+		return nil
+	}
+	return e.wait(e.waitMsec(-1))
+}
+
+func (e *EpollNetEngine) WaitEventWithTimeout(d time.Duration) error {
+	if len(e.events) > 0 || len(e.ready) > 0 {
+		return nil
+	}
+	if err := e.wait(e.waitMsec(int(d.Milliseconds()))); err != nil {
+		return err
+	}
+	if len(e.ready) == 0 {
+		return toukaerrors.ErrWouldBlock
+	}
+	return nil
+}
+
+func (e *EpollNetEngine) PrepareClose() error {
+	// epollはWaitEventをKickで起こせるので、io_uringのようなタイマーは不要
+	slog.Debug("Engine PrepareClose")
+	return e.Kick(context.Background())
+}
+
+func (e *EpollNetEngine) GetSockAddr(ctx context.Context, fd int32) (*SockAddr, error) {
+	return getSockAddr(fd)
+}
+
+func (e *EpollNetEngine) ClosePeer(ctx context.Context, fd int32) error {
+	delete(e.dials, fd)
+	if f, ok := e.fds[fd]; ok {
+		if f.registered {
+			_ = unix.EpollCtl(e.epfd, unix.EPOLL_CTL_DEL, int(fd), nil)
+		}
+		delete(e.fds, fd)
+	}
+	// io_uringと同じく、閉じ終わったことをEVENT_TYPE_CLOSEで返す
+	ev := &NetEvent{
+		EventType: event.EVENT_TYPE_CLOSE,
+		Fd:        fd,
+	}
+	if err := unix.Close(int(fd)); err != nil {
+		ev.Err = err
+	}
+	e.events = append(e.events, ev)
+	return nil
+}
+
+func (e *EpollNetEngine) Kick(ctx context.Context) error {
+	var b [8]byte
+	b[0] = 1
+	_, err := unix.Write(e.wakeFd, b[:])
+	if err != nil && !errors.Is(err, unix.EAGAIN) {
+		return err
+	}
+	return nil
+}
+
+func (e *EpollNetEngine) Close() error {
+	err := unix.Close(e.wakeFd)
+	if err2 := unix.Close(e.epfd); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (e *EpollNetEngine) lookup(fd int32) *epollFd {
+	f, ok := e.fds[fd]
+	if !ok {
+		f = &epollFd{fd: fd}
+		e.fds[fd] = f
+	}
+	return f
+}
+
+func (e *EpollNetEngine) watchRead(fd int32, eventType event.EventType) error {
+	f := e.lookup(fd)
+	f.eventType = eventType
+	f.readable = true
+	return e.update(f)
+}
+
+// update はepollFdの状態に合わせてepollの登録を追加/変更/削除します
+func (e *EpollNetEngine) update(f *epollFd) error {
+	events := f.events()
+	ev := &unix.EpollEvent{Events: events, Fd: f.fd}
+
+	switch {
+	case events == 0 && f.registered:
+		f.registered = false
+		return unix.EpollCtl(e.epfd, unix.EPOLL_CTL_DEL, int(f.fd), nil)
+	case events == 0:
+		return nil
+	case f.registered:
+		return unix.EpollCtl(e.epfd, unix.EPOLL_CTL_MOD, int(f.fd), ev)
+	default:
+		f.registered = true
+		return unix.EpollCtl(e.epfd, unix.EPOLL_CTL_ADD, int(f.fd), ev)
+	}
+}
+
+func (e *EpollNetEngine) wait(msec int) error {
+	var events [epollWaitBatch]unix.EpollEvent
+	n, err := unix.EpollWait(e.epfd, events[:], msec)
+	if err != nil {
+		if errors.Is(err, unix.EINTR) {
+			return nil
+		}
+		slog.Error("epoll_wait failed", "err", err)
+		return err
+	}
+	e.ready = append(e.ready, events[:n]...)
+	return nil
+}
+
+func (e *EpollNetEngine) drainWakeup() {
+	var b [8]byte
+	_, _ = unix.Read(e.wakeFd, b[:])
+}
+
+// finishConnect はEPOLLOUTが来たfdのconnectの結果をSO_ERRORで確かめます
+func (e *EpollNetEngine) finishConnect(ctx context.Context, f *epollFd) {
+	f.connecting = false
+	delete(e.dials, f.fd)
+	if err := e.update(f); err != nil {
+		slog.WarnContext(ctx, "Failed to update epoll interest", "fd", f.fd, "error", err)
+	}
+	var connErr error
+	errno, err := unix.GetsockoptInt(int(f.fd), unix.SOL_SOCKET, unix.SO_ERROR)
+	switch {
+	case err != nil:
+		connErr = err
+	case errno != 0:
+		connErr = unix.Errno(errno)
+	}
+	e.completeConnect(f.fd, connErr)
+}
+
+// expireDials は期限を過ぎたconnectを失敗にします。fdは呼び出し側がClosePeerで閉じます
+func (e *EpollNetEngine) expireDials(ctx context.Context) {
+	if len(e.dials) == 0 {
+		return
+	}
+	now := time.Now()
+	for fd, deadline := range e.dials {
+		if deadline.IsZero() || now.Before(deadline) {
+			continue
+		}
+		delete(e.dials, fd)
+		if f, ok := e.fds[fd]; ok {
+			f.connecting = false
+			if err := e.update(f); err != nil {
+				slog.WarnContext(ctx, "Failed to update epoll interest", "fd", fd, "error", err)
+			}
+		}
+		e.completeConnect(fd, context.DeadlineExceeded)
+	}
+}
+
+// waitMsec はepoll_waitで寝る時間を、一番近いconnectの期限までに縮めます
+func (e *EpollNetEngine) waitMsec(msec int) int {
+	for _, deadline := range e.dials {
+		if deadline.IsZero() {
+			continue
+		}
+		// 期限を過ぎてから起きるように切り上げる
+		until := int((time.Until(deadline) + time.Millisecond - 1) / time.Millisecond)
+		if until < 0 {
+			until = 0
+		}
+		if msec < 0 || until < msec {
+			msec = until
+		}
+	}
+	return msec
+}
+
+func (e *EpollNetEngine) completeConnect(fd int32, err error) {
+	e.events = append(e.events, &NetEvent{
+		EventType: event.EVENT_TYPE_CONNECT,
+		Fd:        fd,
+		Err:       err,
+	})
+}
+
+func (e *EpollNetEngine) completeWrite(fd int32, n int, err error) {
+	ev := &NetEvent{
+		EventType: event.EVENT_TYPE_WRITE,
+		Fd:        fd,
+	}
+	if err != nil {
+		ev.Err = err
+	} else {
+		ev.SentLength = n
+	}
+	e.events = append(e.events, ev)
+}
+
+func (e *EpollNetEngine) flush(ctx context.Context, f *epollFd) {
+	for len(f.pending) > 0 {
+		n, err := unix.Writev(int(f.fd), f.pending[0])
+		if errors.Is(err, unix.EAGAIN) {
+			break
+		}
+		e.completeWrite(f.fd, n, err)
+		f.pending = f.pending[1:]
+	}
+	if err := e.update(f); err != nil {
+		slog.WarnContext(ctx, "Failed to update epoll interest", "fd", f.fd, "error", err)
+	}
+}
+
+func (e *EpollNetEngine) handleAccept(ctx context.Context, f *epollFd) {
+	for {
+		nfd, _, err := unix.Accept4(int(f.fd), unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				return
+			}
+			slog.WarnContext(ctx, "Accept failed", "fd", f.fd, "error", err)
+			var errno unix.Errno
+			if errors.As(err, &errno) {
+				e.events = append(e.events, &NetEvent{
+					EventType: event.EVENT_TYPE_ACCEPT,
+					Fd:        -int32(errno),
+				})
+			}
+			return
+		}
+		e.events = append(e.events, &NetEvent{
+			EventType: event.EVENT_TYPE_ACCEPT,
+			Fd:        int32(nfd),
+		})
+	}
+}
+
+func (e *EpollNetEngine) handleRead(ctx context.Context, f *epollFd) {
+	n, err := unix.Read(int(f.fd), e.buffer)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return
+		}
+		slog.WarnContext(ctx, "Read failed", "fd", f.fd, "error", err)
+		n = 0
+	}
+
+	if n == 0 {
+		// EOFかエラー: レベルトリガーなので読み込みの監視をやめないと毎回通知される
+		f.readable = false
+		if err := e.update(f); err != nil {
+			slog.WarnContext(ctx, "Failed to update epoll interest", "fd", f.fd, "error", err)
+		}
+	}
+
+	b := make([]byte, n)
+	copy(b, e.buffer[:n])
+	slog.DebugContext(ctx, "Read event", "fd", f.fd, "bytesRead", n)
+	e.events = append(e.events, &NetEvent{
+		EventType: event.EVENT_TYPE_READ,
+		Fd:        f.fd,
+		Data:      b,
+		Err:       err,
+	})
+}
+
+func (e *EpollNetEngine) handleRecvMsg(ctx context.Context, f *epollFd) {
+	for {
+		n, from, err := unix.Recvfrom(int(f.fd), e.buffer, unix.MSG_DONTWAIT)
+		if err != nil {
+			if !errors.Is(err, unix.EAGAIN) && !errors.Is(err, unix.EINTR) {
+				slog.WarnContext(ctx, "Recvfrom failed", "fd", f.fd, "error", err)
+			}
+			return
+		}
+
+		remoteAddr, err := toAddrPort(from)
+		if err != nil {
+			slog.WarnContext(ctx, "Unsupported address family", "fd", f.fd, "error", err)
+		}
+
+		b := make([]byte, n)
+		copy(b, e.buffer[:n])
+		e.events = append(e.events, &NetEvent{
+			EventType:  event.EVENT_TYPE_RECVMSG,
+			Fd:         f.fd,
+			Data:       b,
+			RemoteAddr: remoteAddr,
+		})
+	}
+}
+
+var _ NetEngine = (*EpollNetEngine)(nil)
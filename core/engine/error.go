@@ -1,5 +1,10 @@
 package engine
 
+import "errors"
+
+// ErrUnsupportedProtocol はListenに知らないプロトコルを渡したときのエラーです
+var ErrUnsupportedProtocol = errors.New("unsupported protocol")
+
 const (
 	ENOBUFS = 105
 )
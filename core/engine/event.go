@@ -12,4 +12,19 @@ type NetEvent struct {
 	Data       []byte
 	RemoteAddr netip.AddrPort
 	SentLength int
+	// Err はREAD/WRITE/CLOSE/CONNECTが失敗したときのエラーです。READならECONNRESETなどでDataは空、WRITEならSentLengthは0です
+	// CONNECTがタイムアウトしたときはcontext.DeadlineExceededです
+	// ACCEPTで返るときはFdがリスナーで、そのリスナーの受け付けは止まっています
+	Err error
+	// Fixed はAcceptかDialした接続が固定ファイルテーブルに登録されたことを示し、FixedIndexがそのスロットです
+	Fixed      bool
+	FixedIndex int32
+	// Lease はゼロコピー受信でDataが指しているバッファです (コピー受信ではnil)
+	Lease *BufferLease
+}
+
+// Release はDataが借りているバッファを返します
+// Dataはこれ以降使えないので、イベントを処理し終えてから呼びます。コピー受信では何もしません
+func (ev *NetEvent) Release() {
+	ev.Lease.Release()
 }
@@ -0,0 +1,128 @@
+//go:build linux
+
+package engine
+
+import (
+	"github.com/touka-aoi/low-level-server/core/core"
+)
+
+// directFdBase は直接固定ファイルテーブルに受け付けた接続に割り当てるfdの始まりです
+// 直接受け付けた接続にはfdがないので、スロット番号にこれを足した値をfdの代わりに使います
+const directFdBase int32 = 1 << 30
+
+// fixedFileTable は固定ファイルテーブルのスロットとfdの対応を管理します
+// 受け付けたfdをスロットに入れておくと、READ/WRITEのたびにカーネルがfdを引かなくて済む
+// スロットの入れ替えはIORING_OP_FILES_UPDATEとしてほかのSQEと一緒に提出するので、io_uring_registerを呼びません
+type fixedFileTable struct {
+	uring   *core.Uring
+	encode  func(seq uint32) uint64
+	direct  bool // スロットはACCEPTのときにカーネルが選ぶ (IORING_FILE_INDEX_ALLOC)
+	free    []int32
+	slots   map[int32]int32 // fd -> スロット
+	next    uint32
+	updates map[uint32]*fileUpdate // 更新番号 -> 提出中のFILES_UPDATE
+}
+
+// fileUpdate は提出中のFILES_UPDATEです。fdsはCQEが返るまでカーネルが読みます
+type fileUpdate struct {
+	fds   [1]int32
+	index int32
+}
+
+func newFixedFileTable(uring *core.Uring, entries int, direct bool, encode func(seq uint32) uint64) (*fixedFileTable, error) {
+	if err := uring.RegisterFiles(entries); err != nil {
+		return nil, err
+	}
+
+	t := &fixedFileTable{
+		uring:   uring,
+		encode:  encode,
+		direct:  direct,
+		slots:   make(map[int32]int32, entries),
+		updates: make(map[uint32]*fileUpdate),
+	}
+	if !direct {
+		t.free = make([]int32, entries)
+		for i := range t.free {
+			// 小さい番号から使うように後ろから積む
+			t.free[i] = int32(entries - 1 - i)
+		}
+	}
+	return t, nil
+}
+
+// install はfdを空いているスロットに入れるFILES_UPDATEを積んで、スロット番号を返します
+// FILES_UPDATEは提出したその場で済むので、後ろに積んだSQEからはもうスロットが使えます
+// 空きがない場合はfalseを返すので、呼び出し側は通常のfdで続けます
+// スロットをカーネルが選ぶ (direct) ときは、こちらで選んだスロットと重なるので入れません
+func (t *fixedFileTable) install(fd int32) (int32, bool) {
+	if len(t.free) == 0 {
+		return -1, false
+	}
+	index := t.free[len(t.free)-1]
+	if err := t.update(index, fd); err != nil {
+		return -1, false
+	}
+	t.free = t.free[:len(t.free)-1]
+	t.slots[fd] = index
+	return index, true
+}
+
+func (t *fixedFileTable) lookup(fd int32) (int32, bool) {
+	if isDirectFd(fd) {
+		return fd - directFdBase, true
+	}
+	index, ok := t.slots[fd]
+	return index, ok
+}
+
+// remove はfdのスロットを空けるFILES_UPDATEを積みます
+// SQEは積んだ順に提出されるので、空けたスロットはすぐに次のfdへ使えます
+// 直接受け付けた接続のスロットは、ClosePeerがIORING_OP_CLOSEで閉じます
+func (t *fixedFileTable) remove(fd int32) error {
+	index, ok := t.slots[fd]
+	if !ok {
+		return nil
+	}
+	delete(t.slots, fd)
+	t.free = append(t.free, index)
+	return t.update(index, -1)
+}
+
+func (t *fixedFileTable) update(index int32, fd int32) error {
+	seq := t.nextSeq()
+	u := &fileUpdate{fds: [1]int32{fd}, index: index}
+	if err := t.uring.Queue(t.uring.FilesUpdate(index, u.fds[:], t.encode(seq))); err != nil {
+		return err
+	}
+	t.updates[seq] = u
+	return nil
+}
+
+func (t *fixedFileTable) nextSeq() uint32 {
+	t.next++
+	return t.next
+}
+
+// done はCQEが返ったFILES_UPDATEを手放します
+// fdを入れられなかったときは、そのfdを通常のfdで使い続けるように対応を外します
+func (t *fixedFileTable) done(seq uint32, res int32) {
+	u, ok := t.updates[seq]
+	if !ok {
+		return
+	}
+	delete(t.updates, seq)
+	fd := u.fds[0]
+	if res >= 0 || fd < 0 {
+		return
+	}
+	if index, ok := t.slots[fd]; ok && index == u.index {
+		delete(t.slots, fd)
+		t.free = append(t.free, index)
+	}
+}
+
+// isDirectFd はfdが直接固定ファイルテーブルに受け付けた接続のものかを返します
+func isDirectFd(fd int32) bool {
+	return fd >= directFdBase
+}
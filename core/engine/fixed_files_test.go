@@ -0,0 +1,140 @@
+//go:build linux
+
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"golang.org/x/sys/unix"
+)
+
+func newTestUring(t *testing.T) *core.Uring {
+	t.Helper()
+	if err := core.ProbeUring(); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	u := core.CreateUring(16)
+	t.Cleanup(func() { _ = u.Close() })
+	return u
+}
+
+// completeUpdates は積んだFILES_UPDATEを提出して、CQEをすべてテーブルに返します
+func completeUpdates(t *testing.T, u *core.Uring, table *fixedFileTable) {
+	t.Helper()
+	for len(table.updates) > 0 {
+		if err := u.WaitEvent(); err != nil {
+			t.Fatalf("WaitEvent: %v", err)
+		}
+		cqes, err := u.PeekBatchEvents(16)
+		if err != nil && !errors.Is(err, toukaerrors.ErrWouldBlock) {
+			t.Fatalf("PeekBatchEvents: %v", err)
+		}
+		for _, cqe := range cqes {
+			table.done(uint32(cqe.UserData), cqe.Res)
+		}
+	}
+}
+
+func TestFixedFileTable(t *testing.T) {
+	const badFd = -2 // 開いていないfdとして扱う
+
+	tests := []struct {
+		name      string
+		entries   int
+		install   []int // 開いたfdの番号、badFdなら開いていないfd
+		remove    []int
+		reinstall []int
+		want      map[int]int32 // fdの番号 -> スロット
+		wantFull  []int         // 空きがなくて入らなかったfdの番号
+	}{
+		{
+			name:    "lowest slot first",
+			entries: 2,
+			install: []int{0, 1},
+			want:    map[int]int32{0: 0, 1: 1},
+		},
+		{
+			name:     "full",
+			entries:  1,
+			install:  []int{0, 1},
+			want:     map[int]int32{0: 0},
+			wantFull: []int{1},
+		},
+		{
+			name:      "removed slot is reused",
+			entries:   2,
+			install:   []int{0, 1},
+			remove:    []int{0},
+			reinstall: []int{2},
+			want:      map[int]int32{1: 1, 2: 0},
+		},
+		{
+			name:      "failed update frees slot",
+			entries:   1,
+			install:   []int{badFd},
+			reinstall: []int{0},
+			want:      map[int]int32{0: 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := newTestUring(t)
+			table, err := newFixedFileTable(u, tt.entries, false, func(seq uint32) uint64 { return uint64(seq) })
+			if err != nil {
+				t.Skipf("fixed files are not available: %v", err)
+			}
+
+			var fds [3]int32
+			for i := range fds {
+				var p [2]int
+				if err := unix.Pipe(p[:]); err != nil {
+					t.Fatalf("Pipe: %v", err)
+				}
+				t.Cleanup(func() { _ = unix.Close(p[0]); _ = unix.Close(p[1]) })
+				fds[i] = int32(p[0])
+			}
+			fd := func(n int) int32 {
+				if n == badFd {
+					return 1 << 20
+				}
+				return fds[n]
+			}
+
+			full := map[int]bool{}
+			install := func(ns []int) {
+				for _, n := range ns {
+					if _, ok := table.install(fd(n)); !ok {
+						full[n] = true
+					}
+				}
+				completeUpdates(t, u, table)
+			}
+			install(tt.install)
+			for _, n := range tt.remove {
+				if err := table.remove(fd(n)); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+			}
+			completeUpdates(t, u, table)
+			install(tt.reinstall)
+
+			for n, want := range tt.want {
+				got, ok := table.lookup(fd(n))
+				if !ok || got != want {
+					t.Errorf("lookup(fd %d) = %d, %v, want %d", n, got, ok, want)
+				}
+			}
+			if len(table.slots) != len(tt.want) {
+				t.Errorf("slots = %v, want %d entries", table.slots, len(tt.want))
+			}
+			for _, n := range tt.wantFull {
+				if !full[n] {
+					t.Errorf("fd %d was installed, want table full", n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package engine
+
+import "math"
+
+// allocID はuserDataの上位16ビットに入れる送信IDを払い出します。0は「IDなし」に使うので払い出しません
+// inFlightで使用中のIDを飛ばし、65535個すべてが使用中ならfalseを返します (呼び出し側は完了を待ってからやり直します)
+func allocID(next *uint16, inFlight func(id uint16) bool) (uint16, bool) {
+	for range math.MaxUint16 {
+		*next++
+		if *next == 0 {
+			*next++
+		}
+		if !inFlight(*next) {
+			return *next, true
+		}
+	}
+	return 0, false
+}
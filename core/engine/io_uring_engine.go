@@ -4,11 +4,9 @@ package engine
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/netip"
 	"slices"
 	"time"
@@ -21,27 +19,99 @@ import (
 )
 
 type userData struct {
-	eventType event.EventType
-	fd        int32
+	eventType   event.EventType
+	fd          int32
+	bufferGroup uint16 // バッファを選ぶ操作で使ったグループID
 }
 
-type SockAddr struct {
-	Fd         int32
-	LocalAddr  netip.AddrPort
-	RemoteAddr netip.AddrPort
+type UringNetEngine struct {
+	uring      *core.Uring
+	caps       *core.Capabilities // カーネルが使える機能。操作ごとに使うopcodeを選ぶ
+	fixedFiles *fixedFileTable    // nilなら固定ファイルを使わない
+	buffers    *bufferPool
+	readClass  map[int32]int  // RegisterReadされているfdと、それぞれが使うバッファのclass
+	zeroCopy   bool           // 受信データをコピーせずBufferLeaseで渡す
+	zcSends    *zeroCopySends // nilならSEND_ZCを使わない
+	direct     bool
+	// directAccepts はリスナーごとの直接受け付け中のACCEPTです
+	directAccepts map[int32]*directAccept
+	// directPeers は直接受け付けた接続のアドレスです。fdがないのでgetpeernameで引けません
+	directPeers map[int32]*SockAddr
+	// acceptBackoff はACCEPTを待ってから登録し直しているリスナーと、直前に待った時間です
+	acceptBackoff map[int32]time.Duration
+	iovecs        *pinnedIovecs         // 送信中のWRITEVのiovec
+	dials         map[int32]*dialTarget // CONNECT中のfd
+	msgs          *datagramMsgs         // RECVMSG/SENDMSGのmsghdr
+	wakeFd        int32                 // Kickで書き込むeventfd。リングで常にREADしておく
+	wakeBuf       [8]byte
 }
 
-type UringNetEngine struct {
-	uring *core.Uring
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// directAccept は提出中の直接受け付けのACCEPTです。addrとaddrLenはCQEが返るまでカーネルが書きます
+type directAccept struct {
+	addr      unix.RawSockaddrAny
+	addrLen   uint32
+	localAddr netip.AddrPort
 }
 
 func (e *UringNetEngine) CancelAccept(ctx context.Context, listener Listener) error {
-	e.uring.Cancel(listener.Fd(), e.encodeUserData(event.EVENT_TYPE_ACCEPT, listener.Fd()), e.encodeUserData(event.EVENT_TYPE_CANCEL, 0))
-	return nil
+	if _, ok := e.acceptBackoff[listener.Fd()]; ok {
+		// 登録し直す前のタイマーも止める
+		delete(e.acceptBackoff, listener.Fd())
+		if err := e.uring.Cancel(listener.Fd(), e.encodeUserData(event.EVENT_TYPE_ACCEPT_RETRY, listener.Fd()), e.encodeUserData(event.EVENT_TYPE_CANCEL, 0)); err != nil {
+			return err
+		}
+	}
+	return e.uring.Cancel(listener.Fd(), e.encodeUserData(event.EVENT_TYPE_ACCEPT, listener.Fd()), e.encodeUserData(event.EVENT_TYPE_CANCEL, 0))
 }
 
+// ClosePeer はfdに残っている操作をすべてキャンセルしてから、IORING_OP_CLOSEでfdを閉じます
+// 閉じ終わるとEVENT_TYPE_CLOSEが返るので、それまで送信中のバッファは手放さないでください
 func (e *UringNetEngine) ClosePeer(ctx context.Context, fd int32) error {
-	return nil
+	delete(e.readClass, fd)
+	closeUserData := e.encodeUserData(event.EVENT_TYPE_CLOSE, fd)
+	if isDirectFd(fd) {
+		// 直接受け付けた接続はスロットでしか引けないので、スロットでキャンセルしてからスロットを閉じる
+		delete(e.directPeers, fd)
+		cancel := e.uring.CancelFixed(fd-directFdBase, e.encodeUserData(event.EVENT_TYPE_CANCEL, fd))
+		cancel.Flags |= core.IOSQE_IO_HARDLINK
+		if err := e.uring.Queue(cancel); err != nil {
+			return err
+		}
+		return e.uring.Queue(e.uring.CloseFixed(fd-directFdBase, closeUserData))
+	}
+
+	if e.fixedFiles != nil {
+		if err := e.fixedFiles.remove(fd); err != nil {
+			slog.WarnContext(ctx, "Failed to release fixed file", "fd", fd, "error", err)
+		}
+	}
+
+	cancel := e.uring.CancelFd(fd, e.encodeUserData(event.EVENT_TYPE_CANCEL, fd))
+	if e.caps.Supports(core.IORING_OP_CLOSE) {
+		// キャンセルする操作がなくても (-ENOENT) 閉じるように、LINKではなくHARDLINKでつなぐ
+		cancel.Flags |= core.IOSQE_IO_HARDLINK
+		if err := e.uring.Queue(cancel); err != nil {
+			return err
+		}
+		return e.uring.Queue(e.uring.CloseFd(fd, closeUserData))
+	}
+
+	// 古いカーネルではキャンセルを提出し終えてから自分で閉じ、完了はNOPで知らせる
+	// closeした後だとfdからリクエストを引けないので、キャンセルはここで提出まで済ませる
+	if err := e.uring.Queue(cancel); err != nil {
+		slog.WarnContext(ctx, "Failed to queue cancel", "fd", fd, "error", err)
+	} else if err := e.uring.FlushSync(); err != nil {
+		slog.WarnContext(ctx, "Failed to submit cancel", "fd", fd, "error", err)
+	}
+	if err := unix.Close(int(fd)); err != nil {
+		return err
+	}
+	return e.uring.Queue(e.uring.Nop(closeUserData))
 }
 
 func (e *UringNetEngine) WaitEvent() error {
@@ -52,24 +122,291 @@ func (e *UringNetEngine) WaitEventWithTimeout(d time.Duration) error {
 	return e.uring.WaitEventWithTimeout(d)
 }
 
-func NewUringNetEngine() *UringNetEngine {
-	uring := core.CreateUring(4096)
-	uring.RegisterRingBuffer(256, core.MaxBufferSize, 1)
-	return &UringNetEngine{
-		uring: uring,
+// UringOption はNewUringNetEngineに渡すオプションです
+type UringOption func(*uringConfig)
+
+type uringConfig struct {
+	entries      uint32
+	setup        core.UringSetup
+	fixedFiles   int
+	bufferGroups []BufferGroupConfig
+	direct       bool
+	zeroCopy     bool
+	zcThreshold  int // 0ならSEND_ZCを使わない
+}
+
+// WithSQPoll はSQPOLLモードを有効にします
+// idleの間SQEが来なければポーリングスレッドは寝て、次のSubmitで起こされます
+func WithSQPoll(idle time.Duration) UringOption {
+	return func(c *uringConfig) {
+		c.setup.SQPoll = true
+		c.setup.SQThreadIdle = idle
+	}
+}
+
+// WithSQThreadCPU はSQPOLLのポーリングスレッドを指定したCPUに固定します
+func WithSQThreadCPU(cpu int) UringOption {
+	return func(c *uringConfig) {
+		c.setup.SQThreadCPU = cpu
+	}
+}
+
+// WithFixedFiles はslots個の固定ファイルテーブルを登録し、受け付けた接続をそこに入れます
+// 接続のREAD/WRITEはIOSQE_FIXED_FILEで発行されるので、SQEごとのfdの参照取得がなくなります
+func WithFixedFiles(slots int) UringOption {
+	return func(c *uringConfig) {
+		c.fixedFiles = slots
+	}
+}
+
+// WithDirectAccept は受け付けた接続をfdにせず、カーネルが選んだ固定ファイルテーブルのスロットに直接入れます (Linux 5.19以降)
+// WithFixedFilesと一緒に使います。相手のアドレスはACCEPTが書いたsockaddrから読みます
+// 接続ごとにsockaddrを受け取るため、ACCEPTはマルチショットにせず1回ずつ出し直します
+// スロットが空いていないとカーネルは受け付けた接続を閉じ、ACCEPTはENFILEで返ります
+func WithDirectAccept() UringOption {
+	return func(c *uringConfig) {
+		c.direct = true
+	}
+}
+
+// WithBufferGroups は受信に使うバッファグループを設定します
+// 接続は一番小さいグループから読み始め、バッファを使い切るデータが来ると次に大きいグループに移ります
+func WithBufferGroups(groups ...BufferGroupConfig) UringOption {
+	return func(c *uringConfig) {
+		c.bufferGroups = groups
+	}
+}
+
+// WithZeroCopyReceive は受信データをコピーせず、プロバイドバッファをそのままNetEvent.Dataに渡します
+// 受け取った側はNetEvent.Releaseでバッファを返す必要があります
+func WithZeroCopyReceive() UringOption {
+	return func(c *uringConfig) {
+		c.zeroCopy = true
+	}
+}
+
+// WithZeroCopySend はthresholdバイト以上のWriteをIORING_OP_SEND_ZCで送ります
+// WRITEイベントはカーネルがバッファを使い終わった通知の後に届くので、それまでWriteに渡したバッファを書き換えてはいけません
+// threshold が0以下なら16KiBを使います
+func WithZeroCopySend(threshold int) UringOption {
+	return func(c *uringConfig) {
+		if threshold <= 0 {
+			threshold = defaultZeroCopySendThreshold
+		}
+		c.zcThreshold = threshold
+	}
+}
+
+func NewUringNetEngine(opts ...UringOption) *UringNetEngine {
+	config := &uringConfig{
+		entries:      4096,
+		setup:        core.UringSetup{SQThreadCPU: -1},
+		bufferGroups: defaultBufferGroups,
+	}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	uring := core.CreateUringWithSetup(config.entries, config.setup)
+	caps, err := uring.Probe()
+	if err != nil {
+		// PROBEがない古いカーネルでは、どの拡張も使わない
+		slog.Warn("Failed to probe io_uring capabilities", "err", err)
+		caps = &core.Capabilities{Features: uring.Features}
+	}
+	if !caps.BufferRing() {
+		slog.Warn("Kernel may not support provided buffer rings", "lastOp", caps.LastOp)
+	}
+	buffers, err := newBufferPool(uring, config.bufferGroups)
+	if err != nil {
+		slog.Error("Failed to register buffer groups", "err", err)
+		panic(err)
+	}
+	e := &UringNetEngine{
+		uring:         uring,
+		caps:          caps,
+		buffers:       buffers,
+		readClass:     make(map[int32]int),
+		acceptBackoff: make(map[int32]time.Duration),
+		zeroCopy:      config.zeroCopy,
+		iovecs:        newPinnedIovecs(),
+		dials:         make(map[int32]*dialTarget),
+		msgs:          newDatagramMsgs(),
+	}
+	if config.zcThreshold > 0 {
+		if caps.Supports(core.IORING_OP_SEND_ZC) {
+			e.zcSends = newZeroCopySends(config.zcThreshold)
+		} else {
+			slog.Warn("SEND_ZC is not supported, using copying sends")
+		}
+	}
+
+	wakeFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		slog.Error("Failed to create eventfd", "err", err)
+		panic(err)
+	}
+	e.wakeFd = int32(wakeFd)
+	if err := e.armWakeup(); err != nil {
+		slog.Error("Failed to arm wakeup", "err", err)
+		panic(err)
+	}
+
+	if config.fixedFiles > 0 {
+		fixedFiles, err := newFixedFileTable(uring, config.fixedFiles, config.direct, e.encodeFilesUpdate)
+		if err != nil {
+			slog.Warn("Fixed files are not available, using plain fds", "err", err)
+		} else {
+			e.fixedFiles = fixedFiles
+			e.direct = config.direct
+			e.directAccepts = make(map[int32]*directAccept)
+			e.directPeers = make(map[int32]*SockAddr)
+		}
 	}
+	return e
+}
+
+// Capabilities はProbeで調べたカーネルの機能を返します
+func (e *UringNetEngine) Capabilities() *core.Capabilities {
+	return e.caps
 }
 
 func (e *UringNetEngine) Accept(ctx context.Context, listener Listener) error {
-	op := e.uring.AcceptMultishot(listener.Fd(), e.encodeUserData(event.EVENT_TYPE_ACCEPT, listener.Fd()))
-	e.uring.Submit(op)
+	if e.direct {
+		if err := e.prepareDirectAccept(listener.Fd()); err != nil {
+			return err
+		}
+	}
+	if err := e.armAccept(listener.Fd()); err != nil {
+		return err
+	}
+	return e.uring.Flush()
+}
+
+// Dial はIORING_OP_CONNECTでつなぎます。ctxに期限があればIORING_OP_LINK_TIMEOUTをつないでおきます
+func (e *UringNetEngine) Dial(ctx context.Context, network, address string, opts ...DialOption) (int32, error) {
+	if !e.caps.Supports(core.IORING_OP_CONNECT) {
+		return -1, fmt.Errorf("%w: IORING_OP_CONNECT", errors.ErrUnsupported)
+	}
+	d, err := openDialSocket(ctx, network, address, opts)
+	if err != nil {
+		return -1, err
+	}
+
+	connect := e.uring.Connect(d.fd, d.addr, d.addrLen, e.encodeUserData(event.EVENT_TYPE_CONNECT, d.fd))
+	if d.deadline.IsZero() {
+		d.pending = 1
+		err = e.uring.Queue(connect)
+	} else {
+		d.pending = 2
+		d.timeout = unix.NsecToTimespec(max(time.Until(d.deadline), time.Microsecond).Nanoseconds())
+		connect.Flags |= core.IOSQE_IO_LINK
+		if err = e.uring.Queue(connect); err == nil {
+			err = e.uring.Queue(e.uring.LinkTimeout(&d.timeout, e.encodeUserData(event.EVENT_TYPE_TIMEOUT, d.fd)))
+		}
+	}
+	if err != nil {
+		unix.Close(int(d.fd))
+		return -1, err
+	}
+	e.dials[d.fd] = d
+	return d.fd, nil
+}
+
+// finishDial はDialのCQEを1つ受け取ったことにします
+// CONNECTとLINK_TIMEOUTの両方が返るまではnilを返し、dialsのエントリを残しておきます
+func (e *UringNetEngine) finishDial(d *dialTarget) *NetEvent {
+	d.pending--
+	if d.pending > 0 {
+		return nil
+	}
+	delete(e.dials, d.fd)
+	ev := &NetEvent{
+		EventType: event.EVENT_TYPE_CONNECT,
+		Fd:        d.fd,
+	}
+	switch {
+	case d.res == -int32(unix.ECANCELED) && d.timedOut:
+		// LINK_TIMEOUTの期限が来てCONNECTがキャンセルされた
+		ev.Err = context.DeadlineExceeded
+	case d.res < 0:
+		ev.Err = unix.Errno(-d.res)
+	case e.fixedFiles != nil:
+		ev.FixedIndex, ev.Fixed = e.fixedFiles.install(d.fd)
+	}
+	return ev
+}
+
+// armAccept は使えればmultishot、なければ1回だけのACCEPTを登録します
+// 固定ファイルテーブルに直接受け付けるときは、接続ごとにアドレスを受け取るため1回だけのACCEPTにします
+func (e *UringNetEngine) armAccept(fd int32) error {
+	ud := e.encodeUserData(event.EVENT_TYPE_ACCEPT, fd)
+	if a, ok := e.directAccepts[fd]; ok {
+		return e.uring.Queue(e.uring.AcceptDirect(fd, &a.addr, &a.addrLen, ud))
+	}
+	if e.caps.MultishotAccept() {
+		return e.uring.Queue(e.uring.AcceptMultishot(fd, ud))
+	}
+	return e.uring.Queue(e.uring.Accept(fd, ud))
+}
+
+// prepareDirectAccept はリスナーのアドレスを調べて、直接受け付けるACCEPTのsockaddrを用意します
+func (e *UringNetEngine) prepareDirectAccept(fd int32) error {
+	sa, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return err
+	}
+	localAddr, err := toAddrPort(sa)
+	if err != nil {
+		return err
+	}
+	e.directAccepts[fd] = &directAccept{localAddr: localAddr}
 	return nil
 }
 
+// directAccepted は直接受け付けた接続の相手のアドレスを覚えて、接続のイベントにします
+func (e *UringNetEngine) directAccepted(ctx context.Context, a *directAccept, slot int32) *NetEvent {
+	fd := directFdBase + slot
+	sockAddr := &SockAddr{Fd: fd, LocalAddr: a.localAddr}
+	remoteAddr, err := parseRawSockaddr(unsafe.Slice((*byte)(unsafe.Pointer(&a.addr)), a.addrLen))
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to parse accepted address", "fd", fd, "error", err)
+	}
+	sockAddr.RemoteAddr = remoteAddr
+	e.directPeers[fd] = sockAddr
+	return &NetEvent{
+		EventType:  event.EVENT_TYPE_ACCEPT,
+		Fd:         fd,
+		Fixed:      true,
+		FixedIndex: slot,
+	}
+}
+
+// retryableAccept はfdやメモリが足りないなど、待てば受け付けられるようになるエラーかを返します
+func retryableAccept(errno unix.Errno) bool {
+	switch errno {
+	case unix.EMFILE, unix.ENFILE, unix.ENOBUFS, unix.ENOMEM, unix.ECONNABORTED:
+		return true
+	}
+	return false
+}
+
+// backoffAccept は少し待ってからACCEPTを登録し直すタイマーを出します
+// すぐに登録し直しても同じエラーのCQEが返り続けるだけなので、待つ時間は失敗するたびに倍にします
+func (e *UringNetEngine) backoffAccept(ctx context.Context, fd int32, errno unix.Errno) error {
+	d := min(max(e.acceptBackoff[fd]*2, acceptBackoffMin), acceptBackoffMax)
+	e.acceptBackoff[fd] = d
+	slog.WarnContext(ctx, "Accept failed, retrying later", "fd", fd, "error", errno, "delay", d)
+	return e.uring.Timeout(d, e.encodeUserData(event.EVENT_TYPE_ACCEPT_RETRY, fd))
+}
+
 func (e *UringNetEngine) RecvFrom(ctx context.Context, listener Listener) error {
-	op := e.uring.RecvFrom(listener.Fd(), e.encodeUserData(event.EVENT_TYPE_RECVMSG, listener.Fd()))
-	e.uring.Submit(op)
-	return nil
+	// fdが別のソケットに使い回されているかもしれないので、アドレスファミリーは調べ直す
+	delete(e.msgs.families, listener.Fd())
+	if err := e.armRecvMsg(listener.Fd()); err != nil {
+		return err
+	}
+	return e.uring.Flush()
 }
 
 // ReceiveData関数は一つのCQEイベントを処理して、イベントとして返します
@@ -87,97 +424,265 @@ func (e *UringNetEngine) ReceiveData(ctx context.Context) ([]*NetEvent, error) {
 	// slog.DebugContext(ctx, "Received CQE events", "cqeEvents", cqeEvents)
 
 	netEvents := make([]*NetEvent, 0, len(cqeEvents))
+	// カーネルが止めた操作は、このバッチのバッファを戻してから再登録する
+	var rearm []*userData
 
 	for cqeEvent := range slices.Values(cqeEvents) {
 		userData := e.decodeUserData(cqeEvent.UserData)
 
 		switch userData.eventType {
 		case event.EVENT_TYPE_ACCEPT:
+			more := cqeEvent.Flags&core.IORING_CQE_F_MORE != 0
 			if cqeEvent.Res < 0 {
-				if errors.Is(unix.Errno(-cqeEvent.Res), unix.ECANCELED) {
+				errno := unix.Errno(-cqeEvent.Res)
+				switch {
+				case errors.Is(errno, unix.ECANCELED):
 					slog.DebugContext(ctx, "Accept operation canceled", "fd", userData.fd)
-					continue
+				case more:
+					// multishotは続いているので、この接続を諦めるだけ
+					slog.WarnContext(ctx, "Accept failed", "fd", userData.fd, "error", errno)
+				case retryableAccept(errno):
+					if err := e.backoffAccept(ctx, userData.fd, errno); err != nil {
+						slog.ErrorContext(ctx, "Failed to schedule accept retry", "fd", userData.fd, "error", err)
+					}
+				default:
+					// 登録し直しても同じエラーになるので、受け付けを止めてサーバーに知らせる
+					slog.ErrorContext(ctx, "Accept failed, stopped accepting", "fd", userData.fd, "error", errno)
+					netEvents = append(netEvents, &NetEvent{
+						EventType: event.EVENT_TYPE_ACCEPT,
+						Fd:        userData.fd,
+						Err:       errno,
+					})
 				}
+				continue
 			}
-			netEvents = append(netEvents, &NetEvent{
+			delete(e.acceptBackoff, userData.fd)
+			// 1回だけのACCEPTか、カーネルがmultishotを止めた
+			if !more {
+				rearm = append(rearm, userData)
+			}
+			if a, ok := e.directAccepts[userData.fd]; ok {
+				netEvents = append(netEvents, e.directAccepted(ctx, a, cqeEvent.Res))
+				continue
+			}
+			acceptEvent := &NetEvent{
 				EventType: event.EVENT_TYPE_ACCEPT,
 				Fd:        cqeEvent.Res,
 				Data:      nil,
-			})
+			}
+			if e.fixedFiles != nil && cqeEvent.Res >= 0 {
+				acceptEvent.FixedIndex, acceptEvent.Fixed = e.fixedFiles.install(cqeEvent.Res)
+			}
+			netEvents = append(netEvents, acceptEvent)
+		case event.EVENT_TYPE_CONNECT:
+			d, ok := e.dials[userData.fd]
+			if !ok {
+				continue
+			}
+			d.res = cqeEvent.Res
+			if ev := e.finishDial(d); ev != nil {
+				netEvents = append(netEvents, ev)
+			}
 		case event.EVENT_TYPE_READ:
-			if cqeEvent.Flags&core.IORING_CQE_F_MORE == 0 {
-				// 再度Readイベントを起こす
-				// 再度必要用のイベントで返せばいいか？？？考え中...
+			more := cqeEvent.Flags&core.IORING_CQE_F_MORE != 0
+			if !more {
+				e.buffers.done(userData.bufferGroup)
 			}
 			if cqeEvent.Res == -ENOBUFS {
-				// これってどういう状況？
-				slog.WarnContext(ctx, "No buffer available for read", "fd", userData.fd)
-				return nil, nil
+				// グループのバッファを使い切った。増やせるなら増やして、READを登録し直す
+				slog.DebugContext(ctx, "No buffer available for read", "fd", userData.fd, "bufferGroup", userData.bufferGroup)
+				e.buffers.expandGroup(userData.bufferGroup)
+				rearm = append(rearm, userData)
+				continue
+			}
+			if cqeEvent.Res < 0 {
+				if errors.Is(unix.Errno(-cqeEvent.Res), unix.ECANCELED) {
+					slog.DebugContext(ctx, "Read operation canceled", "fd", userData.fd)
+					continue
+				}
+				// ECONNRESETなどでもう読めないので、エラーをつけて切断として返す
+				slog.WarnContext(ctx, "Read failed", "fd", userData.fd, "err", unix.Errno(-cqeEvent.Res))
+				netEvents = append(netEvents, &NetEvent{
+					EventType: event.EVENT_TYPE_READ,
+					Fd:        userData.fd,
+					Err:       unix.Errno(-cqeEvent.Res),
+				})
+				continue
+			}
+			// カーネルがmultishotを止めたので登録し直す (0バイトはEOFなので登録しない)
+			if !more && cqeEvent.Res > 0 {
+				rearm = append(rearm, userData)
 			}
 
-			if cqeEvent.Flags&core.IORING_CQE_F_BUFFER == 0 {
+			var b []byte
+			var lease *BufferLease
+			if cqeEvent.Flags&core.IORING_CQE_F_BUFFER != 0 {
+				var ok bool
+				b, lease, ok = e.takeBuffer(userData, cqeEvent)
+				if !ok {
+					continue
+				}
+				// バッファを使い切ったら、次からは大きいグループで読む
+				if ring, ok := e.buffers.ring(userData.bufferGroup); ok && len(b) == ring.Size() {
+					e.readClass[userData.fd] = e.buffers.next(e.buffers.classOf(userData.bufferGroup))
+				}
+			} else if cqeEvent.Res != 0 {
 				slog.WarnContext(ctx, "Read event without buffer flag", "fd", userData.fd, "flags", cqeEvent.Flags)
-				return nil, nil
-			}
-			idx := cqeEvent.Flags >> core.IORING_CQE_BUFFER_SHIFT
-			buff := e.uring.GetRingBuffer(uint16(idx))
-			// recvの場合ここからvalidationが必要
-			slog.DebugContext(ctx, "Read buffer", "fd", userData.fd, "bufferIndex", idx, "dataLength", len(buff))
-			// engineが持っているバッファ領域にコピーしてあげたいが今回は新しく作っておく
-			b := make([]byte, cqeEvent.Res)
-			copy(b, buff[:cqeEvent.Res])
+				continue
+			}
 			slog.DebugContext(ctx, "Read event", "fd", userData.fd, "bytesRead", cqeEvent.Res, "flags", cqeEvent.Flags)
 			netEvents = append(netEvents, &NetEvent{
 				EventType: event.EVENT_TYPE_READ,
 				Fd:        userData.fd,
 				Data:      b,
+				Lease:     lease,
 			})
 		case event.EVENT_TYPE_WRITE:
-			// エラーハンドリング
-			netEvents = append(netEvents, &NetEvent{
-				EventType:  event.EVENT_TYPE_WRITE,
-				Fd:         userData.fd,
-				SentLength: int(cqeEvent.Res),
-			})
+			res := cqeEvent.Res
+			if userData.bufferGroup != 0 {
+				var done bool
+				if res, done = e.zcSends.complete(userData.bufferGroup, cqeEvent); !done {
+					continue
+				}
+				if res == -int32(unix.EINVAL) || res == -int32(unix.EOPNOTSUPP) {
+					slog.WarnContext(ctx, "SEND_ZC is not supported, falling back to copying sends", "fd", userData.fd, "res", res)
+					e.zcSends.disable()
+				}
+			}
+			ev := &NetEvent{
+				EventType: event.EVENT_TYPE_WRITE,
+				Fd:        userData.fd,
+			}
+			if res < 0 {
+				ev.Err = unix.Errno(-res)
+			} else {
+				ev.SentLength = int(res)
+			}
+			netEvents = append(netEvents, ev)
+		case event.EVENT_TYPE_WRITEV:
+			e.iovecs.unpin(userData.bufferGroup)
+			ev := &NetEvent{
+				EventType: event.EVENT_TYPE_WRITE,
+				Fd:        userData.fd,
+			}
+			if cqeEvent.Res < 0 {
+				ev.Err = unix.Errno(-cqeEvent.Res)
+			} else {
+				ev.SentLength = int(cqeEvent.Res)
+			}
+			netEvents = append(netEvents, ev)
 		case event.EVENT_TYPE_RECVMSG:
+			more := cqeEvent.Flags&core.IORING_CQE_F_MORE != 0
+			if !more {
+				e.buffers.done(userData.bufferGroup)
+			}
+			if cqeEvent.Res == -ENOBUFS {
+				slog.DebugContext(ctx, "No buffer available for recvmsg", "fd", userData.fd, "bufferGroup", userData.bufferGroup)
+				e.buffers.expandGroup(userData.bufferGroup)
+				rearm = append(rearm, userData)
+				continue
+			}
+			msg := e.msgs.recvs[userData.fd]
+			if !more {
+				e.msgs.endRecv(userData.fd)
+			}
+			if cqeEvent.Res < 0 {
+				// リスナーを閉じてキャンセルされたなど。登録し直さない
+				slog.DebugContext(ctx, "Recvmsg finished", "fd", userData.fd, "err", unix.Errno(-cqeEvent.Res))
+				continue
+			}
 			if cqeEvent.Flags&core.IORING_CQE_F_BUFFER == 0 {
 				slog.WarnContext(ctx, "Read event without buffer flag", "fd", userData.fd, "flags", cqeEvent.Flags)
-				return nil, nil
-			}
-			idx := cqeEvent.Flags >> core.IORING_CQE_BUFFER_SHIFT
-			buff := e.uring.GetRingBuffer(uint16(idx))
-			b := make([]byte, cqeEvent.Res)
-			copy(b, buff[:cqeEvent.Res])
-
-			addrBytes := unsafe.Slice(e.uring.Msghdr.Name, e.uring.Msghdr.Namelen)
-			family := binary.LittleEndian.Uint16(addrBytes[0:2])
-			var remoteAddr netip.AddrPort
-			if family == unix.AF_INET && len(addrBytes) >= 16 {
-				// IPv4の場合
-				port := binary.BigEndian.Uint16(addrBytes[2:4])
-				ip := net.IPv4(addrBytes[4], addrBytes[5], addrBytes[6], addrBytes[7])
-				addr := fmt.Sprintf("%s:%d", ip, port)
-				remoteAddr = netip.MustParseAddrPort(addr)
-			}
-			if cqeEvent.Flags&core.IORING_CQE_F_MORE == 0 {
-				// F_MOREの原因はどうやって判定したらいいのか
+				continue
+			}
+			b, lease, ok := e.takeBuffer(userData, cqeEvent)
+			if !ok {
+				continue
+			}
+			if !more {
 				slog.DebugContext(ctx, "F_MORE flag not set, submitting new recvmsg operation", "fd", userData.fd)
-				op := e.uring.RecvFrom(userData.fd, e.encodeUserData(event.EVENT_TYPE_RECVMSG, userData.fd))
-				e.uring.Submit(op)
+				rearm = append(rearm, userData)
+			}
+			if msg == nil {
+				slog.WarnContext(ctx, "Recvmsg completed without msghdr", "fd", userData.fd)
+				lease.Release()
+				continue
+			}
+			remoteAddr, data, truncated, err := msg.datagram(b)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to parse recvmsg result", "fd", userData.fd, "error", err)
+				lease.Release()
+				continue
+			}
+			if truncated {
+				slog.WarnContext(ctx, "Datagram truncated", "fd", userData.fd, "remote", remoteAddr, "length", len(data))
 			}
 			netEvents = append(netEvents, &NetEvent{
 				EventType:  event.EVENT_TYPE_RECVMSG,
 				Fd:         userData.fd,
-				Data:       b,
+				Data:       data,
 				RemoteAddr: remoteAddr,
+				Lease:      lease,
 			})
+		case event.EVENT_TYPE_FILES_UPDATE:
+			if cqeEvent.Res < 0 {
+				slog.WarnContext(ctx, "Failed to update fixed file", "res", cqeEvent.Res)
+			}
+			e.fixedFiles.done(uint32(userData.fd), cqeEvent.Res)
+		case event.EVENT_TYPE_ACCEPT_RETRY:
+			if errors.Is(unix.Errno(-cqeEvent.Res), unix.ECANCELED) {
+				continue
+			}
+			// 待ち終わったので、同じリスナーにACCEPTを登録し直す
+			userData.eventType = event.EVENT_TYPE_ACCEPT
+			rearm = append(rearm, userData)
+		case event.EVENT_TYPE_SENDMSG:
+			ev := &NetEvent{
+				EventType: event.EVENT_TYPE_SENDMSG,
+				Fd:        userData.fd,
+			}
+			if msg := e.msgs.unpinSend(userData.bufferGroup); msg != nil {
+				ev.RemoteAddr = msg.to
+			}
+			if cqeEvent.Res < 0 {
+				ev.Err = unix.Errno(-cqeEvent.Res)
+			} else {
+				ev.SentLength = int(cqeEvent.Res)
+			}
+			netEvents = append(netEvents, ev)
 		case event.EVENT_TYPE_TIMEOUT:
+			if d, ok := e.dials[userData.fd]; ok {
+				// CONNECTにつないだLINK_TIMEOUT。期限が来たときだけ-ETIMEで返る
+				d.timedOut = cqeEvent.Res == -int32(unix.ETIME)
+				if ev := e.finishDial(d); ev != nil {
+					netEvents = append(netEvents, ev)
+				}
+				continue
+			}
 			if cqeEvent.Res < 0 {
 				if errors.Is(unix.Errno(-cqeEvent.Res), unix.ECANCELED) {
 					slog.DebugContext(ctx, "Timeout operation canceled", "fd", userData.fd)
 					continue
 				}
 			}
+		case event.EVENT_TYPE_WAKEUP:
+			// KickかKickRingで起こされただけなので、イベントは返さない
+			if cqeEvent.Res < 0 {
+				slog.WarnContext(ctx, "Wakeup failed", "fd", userData.fd, "err", unix.Errno(-cqeEvent.Res))
+			}
+			if userData.fd == e.wakeFd {
+				rearm = append(rearm, userData)
+			}
+			continue
+		case event.EVENT_TYPE_CLOSE:
+			ev := &NetEvent{
+				EventType: event.EVENT_TYPE_CLOSE,
+				Fd:        userData.fd,
+			}
+			if cqeEvent.Res < 0 {
+				ev.Err = unix.Errno(-cqeEvent.Res)
+			}
+			netEvents = append(netEvents, ev)
 		case event.EVENT_TYPE_CANCEL:
 			if cqeEvent.Res < 0 {
 				if errors.Is(unix.Errno(-cqeEvent.Res), unix.ECANCELED) {
@@ -191,95 +696,246 @@ func (e *UringNetEngine) ReceiveData(ctx context.Context) ([]*NetEvent, error) {
 			slog.WarnContext(ctx, "Unknown event type", "eventType", userData.eventType)
 			// 他のイベントタイプはここで処理する必要があります
 			// なんかエラーを出したいなぁという気分ではあります。
-			return nil, nil
+			continue
+		}
+	}
+
+	for _, ud := range rearm {
+		var err error
+		switch ud.eventType {
+		case event.EVENT_TYPE_WAKEUP:
+			err = e.armWakeup()
+		case event.EVENT_TYPE_ACCEPT:
+			err = e.armAccept(ud.fd)
+		case event.EVENT_TYPE_READ:
+			if !e.reading(ud.fd) {
+				// このバッチの間にClosePeerされた
+				continue
+			}
+			err = e.armRead(ctx, ud.fd)
+		case event.EVENT_TYPE_RECVMSG:
+			err = e.armRecvMsg(ud.fd)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to rearm receive", "fd", ud.fd, "eventType", ud.eventType, "error", err)
 		}
 	}
 	return netEvents, nil
 }
 
+// takeBuffer はCQEが指すバッファのデータを取り出します
+// ゼロコピーならバッファを貸し出し、そうでなければコピーしてすぐにグループへ戻します
+func (e *UringNetEngine) takeBuffer(ud *userData, cqe *core.UringCQE) ([]byte, *BufferLease, bool) {
+	ring, ok := e.buffers.ring(ud.bufferGroup)
+	if !ok {
+		slog.Warn("Unknown buffer group", "fd", ud.fd, "bufferGroup", ud.bufferGroup)
+		return nil, nil, false
+	}
+	bid := uint16(cqe.Flags >> core.IORING_CQE_BUFFER_SHIFT)
+	ring.Consumed()
+	data := ring.Buffer(bid, int(cqe.Res))
+
+	if e.zeroCopy {
+		return data, &BufferLease{ring: ring, bid: bid}, true
+	}
+
+	b := make([]byte, len(data))
+	copy(b, data)
+	ring.Recycle(bid)
+	return b, nil, true
+}
+
 func (e *UringNetEngine) PrepareClose() error {
-	ud := e.encodeUserData(event.EVENT_TYPE_TIMEOUT, 0)
-	//TODO: using engine config timeout time
-	//e.uring.Timeout(2*time.Second, ud)
-	//TODO:  timeOut時間を短くすると、syscall sys_io_uring_enter failed" err="interrupted system call" errno=4
-	e.uring.TimeoutWithMultiShot(2*time.Millisecond, ud)
+	// WaitEventはKickで起こせるので、ループを回すためのタイマーは不要
 	slog.Debug("Engine PrepareClose")
-	return nil
+	return e.Kick(context.Background())
 }
 
+// RegisterRead はfdにmultishotのRECVを登録します
+// カーネルが途中で止めた場合はReceiveDataが登録し直すので、呼ぶのは接続ごとに1回です
 func (e *UringNetEngine) RegisterRead(ctx context.Context, fd int32) error {
-	ud := e.encodeUserData(event.EVENT_TYPE_READ, fd)
-	op := e.uring.ReadMultishot(fd, ud)
-	slog.DebugContext(ctx, "Registering read operation", "fd", fd, "userData", ud)
-	e.uring.Submit(op)
+	if _, ok := e.readClass[fd]; !ok {
+		e.readClass[fd] = 0
+	}
+	return e.armRead(ctx, fd)
+}
+
+// reading はfdがRegisterReadされていて、まだClosePeerされていないかを返します
+func (e *UringNetEngine) reading(fd int32) bool {
+	_, ok := e.readClass[fd]
+	return ok
+}
+
+// armRead はfdのclassから空きのあるグループを選んでRECVを登録します
+// multishotが使えないカーネルでは1回だけのRECVになり、CQEごとに登録し直します
+func (e *UringNetEngine) armRead(ctx context.Context, fd int32) error {
+	ring := e.buffers.pick(e.readClass[fd])
+	ud := e.encodeBufferUserData(event.EVENT_TYPE_READ, fd, ring.GroupID)
+	var op *core.UringSQE
+	if e.caps.MultishotRecv() {
+		op = e.uring.RecvMultishot(fd, ring.GroupID, ud)
+	} else {
+		op = e.uring.Recv(fd, ring.GroupID, ud)
+	}
+	op = e.fixed(op, fd)
+	slog.DebugContext(ctx, "Registering read operation", "fd", fd, "userData", ud, "bufferGroup", ring.GroupID)
+	return e.uring.Queue(op)
+}
+
+// armRecvMsg はfd専用のmsghdrでRECVMSGを登録します。使えればmultishotにします
+// データグラムは分割して受け取れないので、一番大きいグループを使います
+func (e *UringNetEngine) armRecvMsg(fd int32) error {
+	ring := e.buffers.pick(len(e.buffers.classes) - 1)
+	ud := e.encodeBufferUserData(event.EVENT_TYPE_RECVMSG, fd, ring.GroupID)
+	msg := e.msgs.recv(fd, e.caps.MultishotRecv())
+	var op *core.UringSQE
+	if msg.multishot {
+		op = e.uring.RecvMsgMultishot(fd, &msg.hdr, ring.GroupID, ud)
+	} else {
+		op = e.uring.RecvMsg(fd, &msg.hdr, ring.GroupID, ud)
+	}
+	if err := e.uring.Queue(op); err != nil {
+		e.msgs.endRecv(fd)
+		return err
+	}
 	return nil
 }
 
 func (e *UringNetEngine) Close() error {
+	if err := unix.Close(int(e.wakeFd)); err != nil {
+		slog.Warn("Failed to close eventfd", "err", err)
+	}
 	return e.uring.Close()
 }
 
+// fixed はfdが固定ファイルテーブルに入っていれば、SQEをスロット指定に書き換えます
+// userDataは元のfdのままなので、完了イベントはfdで返ります
+func (e *UringNetEngine) fixed(op *core.UringSQE, fd int32) *core.UringSQE {
+	if e.fixedFiles == nil {
+		return op
+	}
+	if index, ok := e.fixedFiles.lookup(fd); ok {
+		return op.WithFixedFile(index)
+	}
+	return op
+}
+
 func (e *UringNetEngine) encodeUserData(ev event.EventType, fd int32) uint64 {
-	ud := uint64(ev)<<32 | uint64(fd)
+	return e.encodeBufferUserData(ev, fd, 0)
+}
+
+// userDataのレイアウト: | bufferGroup(16) | eventType(16) | fd(32) |
+// WRITEではbufferGroupの代わりにSEND_ZCの送信IDを入れます (0なら通常のWRITE)
+// WRITEVとSENDMSGではmsghdrやiovecを引き当てる送信IDを入れます
+func (e *UringNetEngine) encodeBufferUserData(ev event.EventType, fd int32, bufferGroup uint16) uint64 {
+	ud := uint64(bufferGroup)<<48 | uint64(uint16(ev))<<32 | uint64(uint32(fd))
 	return ud
 }
 
+func (e *UringNetEngine) encodeFilesUpdate(seq uint32) uint64 {
+	return e.encodeUserData(event.EVENT_TYPE_FILES_UPDATE, int32(seq))
+}
+
 func (e *UringNetEngine) decodeUserData(data uint64) *userData {
 	return &userData{
-		eventType: event.EventType(data >> 32),
-		fd:        int32(data & 0xFFFFFFFF),
+		eventType:   event.EventType(uint16(data >> 32)),
+		fd:          int32(data & 0xFFFFFFFF),
+		bufferGroup: uint16(data >> 48),
 	}
 }
 
 func (e *UringNetEngine) GetSockAddr(ctx context.Context, fd int32) (*SockAddr, error) {
-	localSockAddr, err := unix.Getsockname(int(fd))
-	if err != nil {
-		return nil, err
+	if isDirectFd(fd) {
+		sockAddr, ok := e.directPeers[fd]
+		if !ok {
+			return nil, unix.EBADF
+		}
+		return sockAddr, nil
 	}
+	return getSockAddr(fd)
+}
 
-	remoteSockAddr, err := unix.Getpeername(int(fd))
-	if err != nil {
-		return nil, err
+func (e *UringNetEngine) Write(ctx context.Context, fd int32, data []byte) error {
+	if e.zcSends != nil && e.zcSends.use(len(data)) {
+		if id, ok := e.zcSends.begin(); ok {
+			userData := e.encodeBufferUserData(event.EVENT_TYPE_WRITE, fd, id)
+			return e.uring.Queue(e.fixed(e.uring.SendZC(fd, data, userData), fd))
+		}
 	}
+	userData := e.encodeUserData(event.EVENT_TYPE_WRITE, fd)
+	op := e.fixed(e.uring.Write(fd, data, userData), fd)
+	//slog.DebugContext(ctx, "Submitted write operation", "fd", fd, "dataLength", len(data))
+	return e.uring.Queue(op)
+}
 
-	var localAddrPort netip.AddrPort
-	switch addr := localSockAddr.(type) {
-	case *unix.SockaddrInet4:
-		ip := netip.AddrFrom4([4]byte{addr.Addr[0], addr.Addr[1], addr.Addr[2], addr.Addr[3]})
-		localAddrPort = netip.AddrPortFrom(ip, uint16(addr.Port))
-	case *unix.SockaddrInet6:
-		ip := netip.AddrFrom16(addr.Addr)
-		localAddrPort = netip.AddrPortFrom(ip, uint16(addr.Port))
-	default:
-		return nil, unix.EAFNOSUPPORT
+// Writev はbufsをIORING_OP_WRITEVで1回で書き込みます
+// bufsは完了のWRITEイベントが届くまで書き換えてはいけません
+func (e *UringNetEngine) Writev(ctx context.Context, fd int32, bufs [][]byte) error {
+	id, iovecs, err := e.iovecs.pin(bufs)
+	if err != nil || iovecs == nil {
+		return err
+	}
+	userData := e.encodeBufferUserData(event.EVENT_TYPE_WRITEV, fd, id)
+	if err := e.uring.Queue(e.fixed(e.uring.Writev(fd, iovecs, userData), fd)); err != nil {
+		e.iovecs.unpin(id)
+		return err
 	}
+	return nil
+}
 
-	var remoteAddrPort netip.AddrPort
-	switch addr := remoteSockAddr.(type) {
-	case *unix.SockaddrInet4:
-		ip := netip.AddrFrom4([4]byte{addr.Addr[0], addr.Addr[1], addr.Addr[2], addr.Addr[3]})
-		remoteAddrPort = netip.AddrPortFrom(ip, uint16(addr.Port))
-	case *unix.SockaddrInet6:
-		ip := netip.AddrFrom16(addr.Addr)
-		remoteAddrPort = netip.AddrPortFrom(ip, uint16(addr.Port))
-	default:
-		return nil, unix.EAFNOSUPPORT
+// SendTo はIORING_OP_SENDMSGでtoへdataを1つのデータグラムとして送ります
+// dataは完了のSENDMSGイベントが届くまで書き換えてはいけません
+func (e *UringNetEngine) SendTo(ctx context.Context, fd int32, to netip.AddrPort, data []byte) error {
+	id, msg, err := e.msgs.pinSend(fd, to, data)
+	if err != nil {
+		return err
+	}
+	userData := e.encodeBufferUserData(event.EVENT_TYPE_SENDMSG, fd, id)
+	if err := e.uring.Queue(e.uring.SendMsg(fd, &msg.hdr, userData)); err != nil {
+		e.msgs.unpinSend(id)
+		return err
 	}
+	return nil
+}
 
-	return &SockAddr{
-		Fd:         fd,
-		LocalAddr:  localAddrPort,
-		RemoteAddr: remoteAddrPort,
-	}, nil
+// Flush はRegisterReadやWriteで積んだSQEを1回のio_uring_enterでまとめて提出します
+// イベントループの1周につき1回呼ぶ想定です
+func (e *UringNetEngine) Flush(ctx context.Context) error {
+	return e.uring.Flush()
 }
 
-func (e *UringNetEngine) Write(ctx context.Context, fd int32, data []byte) error {
-	userData := e.encodeUserData(event.EVENT_TYPE_WRITE, fd)
-	e.uring.Write(fd, data, userData)
-	//slog.DebugContext(ctx, "Submitted write operation", "fd", fd, "dataLength", len(data))
-	return nil
+// EnterCalls はio_uring_enterを呼んだ回数を返します
+func (e *UringNetEngine) EnterCalls() uint64 {
+	return e.uring.EnterCalls()
 }
 
+// Kick はeventfdに書き込んで、WaitEventで寝ているイベントループを起こします
+// どのゴルーチンから呼んでもかまいません。何回Kickしても1回起きるだけです
 func (e *UringNetEngine) Kick(ctx context.Context) error {
-	return nil
+	var b [8]byte
+	b[0] = 1
+	_, err := unix.Write(int(e.wakeFd), b[:])
+	return err
 }
+
+// KickRing はIORING_OP_MSG_RINGでtargetのリングに直接CQEを積んで起こします
+// targetがio_uringでないか、カーネルがMSG_RINGを持っていなければtarget.Kickを使います
+func (e *UringNetEngine) KickRing(ctx context.Context, target NetEngine) error {
+	t, ok := target.(*UringNetEngine)
+	if !ok || !e.caps.Supports(core.IORING_OP_MSG_RING) {
+		return target.Kick(ctx)
+	}
+	// fdが-1のWAKEUPは再登録しない (送信側に返る結果のCQEも同じuserDataになる)
+	ud := e.encodeUserData(event.EVENT_TYPE_WAKEUP, -1)
+	return e.uring.Queue(e.uring.MsgRing(t.uring.Fd, 0, ud, ud))
+}
+
+// armWakeup はKick用のeventfdにREADを登録します
+func (e *UringNetEngine) armWakeup() error {
+	return e.uring.Queue(e.uring.Read(e.wakeFd, e.wakeBuf[:], e.encodeUserData(event.EVENT_TYPE_WAKEUP, e.wakeFd)))
+}
+
+var (
+	_ NetEngine  = (*UringNetEngine)(nil)
+	_ RingKicker = (*UringNetEngine)(nil)
+)
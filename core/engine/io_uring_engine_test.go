@@ -0,0 +1,296 @@
+//go:build linux
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"github.com/touka-aoi/low-level-server/core/event"
+	"golang.org/x/sys/unix"
+)
+
+// waitNetEvent はeventTypeのイベントが返るまでエンジンを回します
+func waitNetEvent(t *testing.T, e *UringNetEngine, eventType event.EventType) *NetEvent {
+	t.Helper()
+	for range 100 {
+		if err := e.WaitEvent(); err != nil {
+			t.Fatalf("WaitEvent: %v", err)
+		}
+		events, err := e.ReceiveData(context.Background())
+		if err != nil && !errors.Is(err, toukaerrors.ErrWouldBlock) {
+			t.Fatalf("ReceiveData: %v", err)
+		}
+		for _, ev := range events {
+			if ev.EventType == eventType {
+				return ev
+			}
+		}
+	}
+	t.Fatalf("no %s event", eventType)
+	return nil
+}
+
+// listenTCP は127.0.0.1の空いているポートで待ち受け、そのポートにつなぐアドレスを返します
+func listenTCP(t *testing.T) (Listener, *net.TCPAddr) {
+	t.Helper()
+	listener, err := Listen("tcp", "127.0.0.1:0", 8)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	sa, err := unix.Getsockname(int(listener.Fd()))
+	if err != nil {
+		t.Fatalf("Getsockname: %v", err)
+	}
+	return listener, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*unix.SockaddrInet4).Port}
+}
+
+func dialTCP(t *testing.T, addr *net.TCPAddr) *net.TCPConn {
+	t.Helper()
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestUringDirectAccept(t *testing.T) {
+	if err := core.ProbeUring(); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	ctx := context.Background()
+	e := NewUringNetEngine(WithFixedFiles(4), WithDirectAccept())
+	t.Cleanup(func() { _ = e.Close() })
+	if e.fixedFiles == nil {
+		t.Skip("fixed files are not available")
+	}
+
+	listener, addr := listenTCP(t)
+	if err := e.Accept(ctx, listener); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	for i := range 2 {
+		conn := dialTCP(t, addr)
+		accepted := waitNetEvent(t, e, event.EVENT_TYPE_ACCEPT)
+		if !accepted.Fixed || !isDirectFd(accepted.Fd) {
+			t.Fatalf("accept %d: fd %d fixed %v, want a direct slot", i, accepted.Fd, accepted.Fixed)
+		}
+		sockAddr, err := e.GetSockAddr(ctx, accepted.Fd)
+		if err != nil {
+			t.Fatalf("GetSockAddr: %v", err)
+		}
+		if got, want := sockAddr.RemoteAddr.String(), conn.LocalAddr().String(); got != want {
+			t.Errorf("accept %d: remote addr = %s, want %s", i, got, want)
+		}
+		if got, want := sockAddr.LocalAddr.String(), conn.RemoteAddr().String(); got != want {
+			t.Errorf("accept %d: local addr = %s, want %s", i, got, want)
+		}
+
+		if err := e.RegisterRead(ctx, accepted.Fd); err != nil {
+			t.Fatalf("RegisterRead: %v", err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		read := waitNetEvent(t, e, event.EVENT_TYPE_READ)
+		if read.Fd != accepted.Fd || string(read.Data) != "ping" {
+			t.Errorf("accept %d: read fd %d data %q, want fd %d data %q", i, read.Fd, read.Data, accepted.Fd, "ping")
+		}
+
+		// スロットはリングの中で閉じるので、CLOSEが返ったら相手からはEOFに見える
+		if err := e.ClosePeer(ctx, accepted.Fd); err != nil {
+			t.Fatalf("ClosePeer: %v", err)
+		}
+		closed := waitNetEvent(t, e, event.EVENT_TYPE_CLOSE)
+		if closed.Fd != accepted.Fd || closed.Err != nil {
+			t.Errorf("accept %d: close fd %d err %v, want fd %d", i, closed.Fd, closed.Err, accepted.Fd)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Errorf("accept %d: client read after close = %v, want EOF", i, err)
+		}
+	}
+}
+
+func TestUringAcceptBacksOffWhenTableIsFull(t *testing.T) {
+	if err := core.ProbeUring(); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	ctx := context.Background()
+	// スロットが1つしかないので、2つ目の接続はENFILEになる
+	e := NewUringNetEngine(WithFixedFiles(1), WithDirectAccept())
+	t.Cleanup(func() { _ = e.Close() })
+	if e.fixedFiles == nil {
+		t.Skip("fixed files are not available")
+	}
+	listener, addr := listenTCP(t)
+	if err := e.Accept(ctx, listener); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	dialTCP(t, addr)
+	first := waitNetEvent(t, e, event.EVENT_TYPE_ACCEPT)
+	dialTCP(t, addr)
+	for range 100 {
+		if _, ok := e.acceptBackoff[listener.Fd()]; ok {
+			break
+		}
+		if err := e.WaitEvent(); err != nil {
+			t.Fatalf("WaitEvent: %v", err)
+		}
+		events, err := e.ReceiveData(ctx)
+		if err != nil && !errors.Is(err, toukaerrors.ErrWouldBlock) {
+			t.Fatalf("ReceiveData: %v", err)
+		}
+		if len(events) > 0 {
+			t.Fatalf("got %v while the table is full", events[0])
+		}
+	}
+	if _, ok := e.acceptBackoff[listener.Fd()]; !ok {
+		t.Fatalf("accept is not backing off")
+	}
+
+	// ENFILEになった接続はカーネルが閉じているので、スロットを空けてからつなぎ直す
+	// 待ち終わって登録し直したACCEPTがその接続を受け付ける
+	if err := e.ClosePeer(ctx, first.Fd); err != nil {
+		t.Fatalf("ClosePeer: %v", err)
+	}
+	dialTCP(t, addr)
+	second := waitNetEvent(t, e, event.EVENT_TYPE_ACCEPT)
+	if second.Err != nil || !second.Fixed {
+		t.Fatalf("second accept = fd %d err %v, want a direct slot", second.Fd, second.Err)
+	}
+	if _, ok := e.acceptBackoff[listener.Fd()]; ok {
+		t.Errorf("backoff was not reset after a successful accept")
+	}
+}
+
+// rawListener はlistenしていないソケットをリスナーとして渡すためのものです
+type rawListener int32
+
+func (l rawListener) Fd() int32    { return int32(l) }
+func (l rawListener) Close() error { return unix.Close(int(l)) }
+
+func TestUringAcceptStopsOnError(t *testing.T) {
+	if err := core.ProbeUring(); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+	ctx := context.Background()
+	e := NewUringNetEngine()
+	t.Cleanup(func() { _ = e.Close() })
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Socket: %v", err)
+	}
+	listener := rawListener(fd)
+	t.Cleanup(func() { _ = listener.Close() })
+	if err := e.Accept(ctx, listener); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+
+	ev := waitNetEvent(t, e, event.EVENT_TYPE_ACCEPT)
+	if !errors.Is(ev.Err, unix.EINVAL) || ev.Fd != listener.Fd() {
+		t.Fatalf("accept = fd %d err %v, want listener %d with EINVAL", ev.Fd, ev.Err, listener.Fd())
+	}
+	if _, ok := e.acceptBackoff[listener.Fd()]; ok {
+		t.Errorf("accept is backing off after a permanent error")
+	}
+}
+
+// listenFull はacceptキューが埋まっていて、新しいSYNに応えないリスナーのアドレスを返します
+func listenFull(t *testing.T) string {
+	t.Helper()
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Socket: %v", err)
+	}
+	t.Cleanup(func() { _ = unix.Close(fd) })
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+	if err := unix.Listen(fd, 0); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("Getsockname: %v", err)
+	}
+	// backlogが0でも1つはキューに入るので、acceptしない接続で埋める
+	for range 2 {
+		c, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			t.Fatalf("Socket: %v", err)
+		}
+		t.Cleanup(func() { _ = unix.Close(c) })
+		if err := unix.Connect(c, sa); err != nil && !errors.Is(err, unix.EINPROGRESS) {
+			t.Fatalf("Connect: %v", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*unix.SockaddrInet4).Port))
+}
+
+func TestUringDial(t *testing.T) {
+	if err := core.ProbeUring(); err != nil {
+		t.Skipf("io_uring is not available: %v", err)
+	}
+
+	_, open := listenTCP(t)
+	closed, closedAddr := listenTCP(t)
+	_ = closed.Close()
+
+	tests := []struct {
+		name    string
+		address string
+		timeout time.Duration // 0なら期限なし
+		wantErr error
+	}{
+		{name: "connected", address: open.String()},
+		{name: "connected before deadline", address: open.String(), timeout: time.Second},
+		{name: "refused", address: closedAddr.String(), wantErr: unix.ECONNREFUSED},
+		{name: "refused before deadline", address: closedAddr.String(), timeout: time.Second, wantErr: unix.ECONNREFUSED},
+		{name: "timed out", address: listenFull(t), timeout: 50 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewUringNetEngine()
+			t.Cleanup(func() { _ = e.Close() })
+			if !e.caps.Supports(core.IORING_OP_CONNECT) {
+				t.Skip("IORING_OP_CONNECT is not available")
+			}
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			fd, err := e.Dial(ctx, "tcp", tt.address)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			t.Cleanup(func() { _ = unix.Close(int(fd)) })
+			if err := e.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+
+			ev := waitNetEvent(t, e, event.EVENT_TYPE_CONNECT)
+			if ev.Fd != fd || !errors.Is(ev.Err, tt.wantErr) {
+				t.Errorf("CONNECT fd %d err %v, want fd %d err %v", ev.Fd, ev.Err, fd, tt.wantErr)
+			}
+			if len(e.dials) != 0 {
+				t.Errorf("%d dials left after CONNECT", len(e.dials))
+			}
+		})
+	}
+}
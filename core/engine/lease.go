@@ -0,0 +1,25 @@
+//go:build linux
+
+package engine
+
+import (
+	"github.com/touka-aoi/low-level-server/core/core"
+)
+
+// BufferLease はカーネルと共有しているプロバイドバッファを借りている状態です
+// ゼロコピー受信ではNetEvent.Dataがこのバッファを直接指すので、使い終わったらReleaseで返します
+// Releaseはイベントループのゴルーチンから呼ぶ必要があります (リングはスレッドセーフではない)
+type BufferLease struct {
+	ring     *core.BufferRing
+	bid      uint16
+	released bool
+}
+
+// Release はバッファをリングに戻します。2回目以降の呼び出しは何もしません
+func (l *BufferLease) Release() {
+	if l == nil || l.released {
+		return
+	}
+	l.released = true
+	l.ring.Recycle(l.bid)
+}
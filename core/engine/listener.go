@@ -3,9 +3,12 @@
 package engine
 
 import (
+	"fmt"
 	"net/netip"
+	"os"
 
 	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
 )
 
 type Listener interface {
@@ -21,7 +24,46 @@ type UDPListener struct {
 	socket *core.Socket
 }
 
-func Listen(protocol, externalAddress string, listenMaxConnection int) (Listener, error) {
+// ListenOption はListenに渡すオプションです
+type ListenOption func(*listenConfig)
+
+type listenConfig struct {
+	socketMode os.FileMode
+	socket     SocketOptions
+}
+
+// WithSocketMode はunixソケットのファイルのパーミッションを指定します
+// 指定しなければumaskのままです。抽象名前空間のソケットにはファイルがないので使われません
+func WithSocketMode(mode os.FileMode) ListenOption {
+	return func(c *listenConfig) {
+		c.socketMode = mode
+	}
+}
+
+// Listen はprotocolのListenerを作ります
+// protocolは"tcp"・"udp"・"unix"・"unixpacket"で、unixならexternalAddressはソケットのパスです (@で始まれば抽象名前空間)
+func Listen(protocol, externalAddress string, listenMaxConnection int, opts ...ListenOption) (Listener, error) {
+	return listen(protocol, externalAddress, listenMaxConnection, false, opts)
+}
+
+// ListenReusePort はSO_REUSEPORTを立てたListenerを作ります
+// 同じアドレスで何個でも作れるので、リアクターごとに1つずつ持たせて接続を振り分けます
+func ListenReusePort(protocol, externalAddress string, listenMaxConnection int, opts ...ListenOption) (Listener, error) {
+	return listen(protocol, externalAddress, listenMaxConnection, true, opts)
+}
+
+func listen(protocol, externalAddress string, listenMaxConnection int, reusePort bool, opts []ListenOption) (Listener, error) {
+	var config listenConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if reusePort {
+		config.socket.ReusePort = true
+	}
+	if config.socket.Backlog > 0 {
+		listenMaxConnection = config.socket.Backlog
+	}
+
 	switch protocol {
 	case "tcp":
 		addr, err := netip.ParseAddrPort(externalAddress)
@@ -29,10 +71,17 @@ func Listen(protocol, externalAddress string, listenMaxConnection int) (Listener
 			return nil, err
 		}
 
-		s := core.CreateTCPSocket()
-		s.Bind(addr)
+		s, err := core.CreateTCPSocket(core.Family(addr.Addr()))
+		if err != nil {
+			return nil, err
+		}
+		if err := prepareSocket(s, protocol, addr, config.socket); err != nil {
+			s.Close()
+			return nil, err
+		}
 		err = s.Listen(listenMaxConnection)
 		if err != nil {
+			s.Close()
 			return nil, err
 		}
 
@@ -44,15 +93,45 @@ func Listen(protocol, externalAddress string, listenMaxConnection int) (Listener
 		if err != nil {
 			return nil, err
 		}
-		s := core.CreateUDPSocket()
-		s.Bind(addr)
+		s, err := core.CreateUDPSocket(core.Family(addr.Addr()))
+		if err != nil {
+			return nil, err
+		}
+		if err := prepareSocket(s, protocol, addr, config.socket); err != nil {
+			s.Close()
+			return nil, err
+		}
 
 		return &UDPListener{
 			socket: s,
 		}, nil
+	case "unix", "unixpacket":
+		if config.socket.ReusePort {
+			// unixソケットでは同じパスを共有して振り分けられない
+			return nil, fmt.Errorf("%w: SO_REUSEPORT with %s", ErrUnsupportedProtocol, protocol)
+		}
+		sockType := unix.SOCK_STREAM
+		if protocol == "unixpacket" {
+			sockType = unix.SOCK_SEQPACKET
+		}
+		return listenUnix(sockType, externalAddress, listenMaxConnection, config)
 	}
 
-	return nil, nil
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedProtocol, protocol)
+}
+
+// prepareSocket はソケットオプションを設定してaddrにbindします
+// IPv6のソケットはIPV6_V6ONLYを切って、[::]で待てばIPv4の接続も受け付けるようにします
+func prepareSocket(s *core.Socket, protocol string, addr netip.AddrPort, o SocketOptions) error {
+	if err := setsockopts(s.Fd, o.listenerOptions(protocol)); err != nil {
+		return err
+	}
+	if core.Family(addr.Addr()) == unix.AF_INET6 {
+		if err := s.SetV6Only(false); err != nil {
+			return fmt.Errorf("setsockopt IPV6_V6ONLY: %w", err)
+		}
+	}
+	return s.Bind(addr)
 }
 
 func (l *TCPListener) Close() error {
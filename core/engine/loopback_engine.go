@@ -0,0 +1,394 @@
+//go:build linux
+
+package engine
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"github.com/touka-aoi/low-level-server/core/event"
+	"golang.org/x/sys/unix"
+)
+
+// LoopbackNetEngine はカーネルを使わないメモリ上のNetEngineです
+// テストからAccept/Read/エラー/切断をNetEventとして注入し、fdごとに書き込まれたデータを確認できます
+type LoopbackNetEngine struct {
+	mu        sync.Mutex
+	events    []*NetEvent
+	notify    chan struct{}
+	sockAddrs map[int32]*SockAddr
+	reading   map[int32]bool
+	written   map[int32][]byte
+	// writeLimit は1回のWriteで送信できる最大バイト数 (部分書き込みの再現用)
+	writeLimit map[int32]int
+	writeErr   map[int32]unix.Errno
+	closed     map[int32]bool
+	accepting  map[int32]bool
+	// nextDialFd はDialで割り当てるfdです。InjectAcceptで使うfdとぶつからないように大きい番号から始めます
+	nextDialFd int32
+	dialed     map[int32]string
+	dialErr    error
+	sentTo     map[int32][]Datagram
+}
+
+// Datagram はSendToで送られたデータグラムです
+type Datagram struct {
+	To   netip.AddrPort
+	Data []byte
+}
+
+func NewLoopbackNetEngine() *LoopbackNetEngine {
+	return &LoopbackNetEngine{
+		notify:     make(chan struct{}, 1),
+		sockAddrs:  make(map[int32]*SockAddr),
+		reading:    make(map[int32]bool),
+		written:    make(map[int32][]byte),
+		writeLimit: make(map[int32]int),
+		writeErr:   make(map[int32]unix.Errno),
+		closed:     make(map[int32]bool),
+		accepting:  make(map[int32]bool),
+		nextDialFd: 1 << 20,
+		dialed:     make(map[int32]string),
+		sentTo:     make(map[int32][]Datagram),
+	}
+}
+
+// LoopbackListener はソケットを持たないListenerです
+type LoopbackListener struct {
+	fd int32
+}
+
+func NewLoopbackListener(fd int32) *LoopbackListener {
+	return &LoopbackListener{fd: fd}
+}
+
+func (l *LoopbackListener) Fd() int32 {
+	return l.fd
+}
+
+func (l *LoopbackListener) Close() error {
+	return nil
+}
+
+// InjectAccept は新しい接続を受け付けたイベントを注入します
+func (e *LoopbackNetEngine) InjectAccept(fd int32, localAddr, remoteAddr netip.AddrPort) {
+	e.mu.Lock()
+	e.sockAddrs[fd] = &SockAddr{
+		Fd:         fd,
+		LocalAddr:  localAddr,
+		RemoteAddr: remoteAddr,
+	}
+	e.mu.Unlock()
+	e.InjectEvent(&NetEvent{
+		EventType: event.EVENT_TYPE_ACCEPT,
+		Fd:        fd,
+	})
+}
+
+// InjectRead はfdからデータを受信したイベントを注入します
+func (e *LoopbackNetEngine) InjectRead(fd int32, data []byte) {
+	b := make([]byte, len(data))
+	copy(b, data)
+	e.InjectEvent(&NetEvent{
+		EventType: event.EVENT_TYPE_READ,
+		Fd:        fd,
+		Data:      b,
+	})
+}
+
+// InjectDisconnect はピアが切断した (0バイトのREAD) イベントを注入します
+func (e *LoopbackNetEngine) InjectDisconnect(fd int32) {
+	e.InjectEvent(&NetEvent{
+		EventType: event.EVENT_TYPE_READ,
+		Fd:        fd,
+		Data:      []byte{},
+	})
+}
+
+// InjectDatagram はUDPのデータグラムを受信したイベントを注入します
+func (e *LoopbackNetEngine) InjectDatagram(fd int32, from netip.AddrPort, data []byte) {
+	b := make([]byte, len(data))
+	copy(b, data)
+	e.InjectEvent(&NetEvent{
+		EventType:  event.EVENT_TYPE_RECVMSG,
+		Fd:         fd,
+		Data:       b,
+		RemoteAddr: from,
+	})
+}
+
+// InjectEvent は任意のNetEventをそのまま注入します (エラー結果など)
+func (e *LoopbackNetEngine) InjectEvent(ev *NetEvent) {
+	e.mu.Lock()
+	e.events = append(e.events, ev)
+	e.mu.Unlock()
+	e.wake()
+}
+
+// SetWriteLimit はfdへの1回のWriteで送信されるバイト数を制限し、部分書き込みを起こします
+// 0以下を指定すると制限を解除します
+func (e *LoopbackNetEngine) SetWriteLimit(fd int32, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if n <= 0 {
+		delete(e.writeLimit, fd)
+		return
+	}
+	e.writeLimit[fd] = n
+}
+
+// FailWrites はfdへのWriteを指定したerrnoで失敗させます
+// 0を指定すると元に戻します
+func (e *LoopbackNetEngine) FailWrites(fd int32, errno unix.Errno) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if errno == 0 {
+		delete(e.writeErr, fd)
+		return
+	}
+	e.writeErr[fd] = errno
+}
+
+// FailDials はこれからのDialをerrで失敗させます (EVENT_TYPE_CONNECTのErrになります)
+// nilを指定すると元に戻します
+func (e *LoopbackNetEngine) FailDials(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dialErr = err
+}
+
+// Dialed はDialで割り当てたfdのつなぎ先を返します
+func (e *LoopbackNetEngine) Dialed(fd int32) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	address, ok := e.dialed[fd]
+	return address, ok
+}
+
+// Written はfdに書き込まれたデータを返します
+func (e *LoopbackNetEngine) Written(fd int32) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b := make([]byte, len(e.written[fd]))
+	copy(b, e.written[fd])
+	return b
+}
+
+// SentDatagrams はfdからSendToで送られたデータグラムを送った順に返します
+func (e *LoopbackNetEngine) SentDatagrams(fd int32) []Datagram {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Datagram(nil), e.sentTo[fd]...)
+}
+
+// Reading はfdに対してRegisterReadされているかを返します
+func (e *LoopbackNetEngine) Reading(fd int32) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.reading[fd]
+}
+
+// Closed はfdがClosePeerで閉じられたかを返します
+func (e *LoopbackNetEngine) Closed(fd int32) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.closed[fd]
+}
+
+// Pending はまだReceiveDataで取り出されていないイベントの数を返します
+func (e *LoopbackNetEngine) Pending() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.events)
+}
+
+func (e *LoopbackNetEngine) Accept(ctx context.Context, listener Listener) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.accepting[listener.Fd()] = true
+	return nil
+}
+
+// Dial はfdを割り当てて、すぐにつながった (FailDialsしていれば失敗した) CONNECTイベントを積みます
+func (e *LoopbackNetEngine) Dial(ctx context.Context, network, address string, opts ...DialOption) (int32, error) {
+	e.mu.Lock()
+	fd := e.nextDialFd
+	e.nextDialFd++
+	e.dialed[fd] = address
+	sockAddr := &SockAddr{Fd: fd}
+	if network == "tcp" {
+		// つなぎ先がIPアドレスならRemoteAddrにする
+		sockAddr.RemoteAddr, _ = netip.ParseAddrPort(address)
+	}
+	e.sockAddrs[fd] = sockAddr
+	e.events = append(e.events, &NetEvent{
+		EventType: event.EVENT_TYPE_CONNECT,
+		Fd:        fd,
+		Err:       e.dialErr,
+	})
+	e.mu.Unlock()
+	e.wake()
+	return fd, nil
+}
+
+func (e *LoopbackNetEngine) CancelAccept(ctx context.Context, listener Listener) error {
+	if listener == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.accepting, listener.Fd())
+	return nil
+}
+
+func (e *LoopbackNetEngine) RecvFrom(ctx context.Context, listener Listener) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reading[listener.Fd()] = true
+	return nil
+}
+
+func (e *LoopbackNetEngine) ReceiveData(ctx context.Context) ([]*NetEvent, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.events) == 0 {
+		return nil, toukaerrors.ErrWouldBlock
+	}
+	netEvents := e.events
+	e.events = nil
+	return netEvents, nil
+}
+
+// WaitEvent はイベントが積まれるかKickされるまで待ちます
+func (e *LoopbackNetEngine) WaitEvent() error {
+	if e.Pending() == 0 {
+		<-e.notify
+	}
+	return nil
+}
+
+func (e *LoopbackNetEngine) WaitEventWithTimeout(d time.Duration) error {
+	if e.Pending() > 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-e.notify:
+	case <-timer.C:
+		return toukaerrors.ErrWouldBlock
+	}
+	return nil
+}
+
+func (e *LoopbackNetEngine) RegisterRead(ctx context.Context, fd int32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reading[fd] = true
+	return nil
+}
+
+// Write関数は書き込み制限やエラーの設定に従ってデータを記録し、完了イベントを積みます
+func (e *LoopbackNetEngine) Write(ctx context.Context, fd int32, data []byte) error {
+	e.mu.Lock()
+	ev := &NetEvent{
+		EventType: event.EVENT_TYPE_WRITE,
+		Fd:        fd,
+	}
+	if errno, ok := e.writeErr[fd]; ok {
+		ev.Err = errno
+	} else {
+		sent := len(data)
+		if limit, ok := e.writeLimit[fd]; ok && sent > limit {
+			sent = limit
+		}
+		e.written[fd] = append(e.written[fd], data[:sent]...)
+		ev.SentLength = sent
+	}
+	e.events = append(e.events, ev)
+	e.mu.Unlock()
+	e.wake()
+	return nil
+}
+
+// Writev関数はbufsをつなげて1回のWriteとして記録します
+func (e *LoopbackNetEngine) Writev(ctx context.Context, fd int32, bufs [][]byte) error {
+	var data []byte
+	for _, b := range bufs {
+		data = append(data, b...)
+	}
+	return e.Write(ctx, fd, data)
+}
+
+// SendTo はdataのコピーを記録し、完了イベントを積みます。FailWritesしたfdでは失敗させます
+func (e *LoopbackNetEngine) SendTo(ctx context.Context, fd int32, to netip.AddrPort, data []byte) error {
+	e.mu.Lock()
+	ev := &NetEvent{
+		EventType:  event.EVENT_TYPE_SENDMSG,
+		Fd:         fd,
+		RemoteAddr: to,
+	}
+	if errno, ok := e.writeErr[fd]; ok {
+		ev.Err = errno
+	} else {
+		e.sentTo[fd] = append(e.sentTo[fd], Datagram{To: to, Data: append([]byte(nil), data...)})
+		ev.SentLength = len(data)
+	}
+	e.events = append(e.events, ev)
+	e.mu.Unlock()
+	e.wake()
+	return nil
+}
+
+func (e *LoopbackNetEngine) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (e *LoopbackNetEngine) PrepareClose() error {
+	e.wake()
+	return nil
+}
+
+func (e *LoopbackNetEngine) GetSockAddr(ctx context.Context, fd int32) (*SockAddr, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sockAddr, ok := e.sockAddrs[fd]
+	if !ok {
+		return nil, unix.ENOTCONN
+	}
+	return sockAddr, nil
+}
+
+func (e *LoopbackNetEngine) ClosePeer(ctx context.Context, fd int32) error {
+	e.mu.Lock()
+	delete(e.reading, fd)
+	e.closed[fd] = true
+	e.events = append(e.events, &NetEvent{
+		EventType: event.EVENT_TYPE_CLOSE,
+		Fd:        fd,
+	})
+	e.mu.Unlock()
+	e.wake()
+	return nil
+}
+
+func (e *LoopbackNetEngine) Kick(ctx context.Context) error {
+	e.wake()
+	return nil
+}
+
+func (e *LoopbackNetEngine) Close() error {
+	return nil
+}
+
+func (e *LoopbackNetEngine) wake() {
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+var _ NetEngine = (*LoopbackNetEngine)(nil)
@@ -0,0 +1,84 @@
+//go:build linux
+
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"github.com/touka-aoi/low-level-server/core/event"
+	"golang.org/x/sys/unix"
+)
+
+func TestLoopbackWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		errno    unix.Errno
+		data     string
+		wantSent int
+		written  string
+	}{
+		{name: "whole", data: "hello", wantSent: 5, written: "hello"},
+		{name: "limited", limit: 3, data: "hello", wantSent: 3, written: "hel"},
+		{name: "under limit", limit: 10, data: "hello", wantSent: 5, written: "hello"},
+		{name: "failed", errno: unix.EPIPE, data: "hello", wantSent: 0, written: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewLoopbackNetEngine()
+			e.SetWriteLimit(10, tt.limit)
+			e.FailWrites(10, tt.errno)
+			if err := e.Write(context.Background(), 10, []byte(tt.data)); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			events, err := e.ReceiveData(context.Background())
+			if err != nil {
+				t.Fatalf("ReceiveData: %v", err)
+			}
+			if len(events) != 1 || events[0].EventType != event.EVENT_TYPE_WRITE {
+				t.Fatalf("events = %v, want one write", events)
+			}
+			if tt.errno != 0 && !errors.Is(events[0].Err, tt.errno) {
+				t.Errorf("Err = %v, want %v", events[0].Err, tt.errno)
+			}
+			if events[0].SentLength != tt.wantSent {
+				t.Errorf("SentLength = %d, want %d", events[0].SentLength, tt.wantSent)
+			}
+			if got := string(e.Written(10)); got != tt.written {
+				t.Errorf("Written = %q, want %q", got, tt.written)
+			}
+		})
+	}
+}
+
+func TestLoopbackInjectedEvents(t *testing.T) {
+	e := NewLoopbackNetEngine()
+	if _, err := e.ReceiveData(context.Background()); !errors.Is(err, toukaerrors.ErrWouldBlock) {
+		t.Fatalf("ReceiveData on an empty engine = %v, want ErrWouldBlock", err)
+	}
+
+	data := []byte("request")
+	e.InjectRead(10, data)
+	data[0] = 'X'
+	e.InjectDisconnect(10)
+
+	events, err := e.ReceiveData(context.Background())
+	if err != nil {
+		t.Fatalf("ReceiveData: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if got := string(events[0].Data); got != "request" {
+		t.Errorf("injected read = %q, want a copy of the original data", got)
+	}
+	if len(events[1].Data) != 0 {
+		t.Errorf("disconnect carried %d bytes", len(events[1].Data))
+	}
+	if e.Pending() != 0 {
+		t.Errorf("Pending = %d after ReceiveData", e.Pending())
+	}
+}
@@ -4,19 +4,61 @@ package engine
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"time"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
 )
 
 type NetEngine interface {
 	Accept(ctx context.Context, listener Listener) error
+	// Dial はnetwork/addressにつなぐソケットを作ってconnectを始め、そのfdを返します
+	// つながるか失敗するとEVENT_TYPE_CONNECTが返ります (失敗ならErr)。ctxの期限がconnectのタイムアウトになります
+	// 失敗したfdも、呼び出し側がClosePeerで閉じます
+	Dial(ctx context.Context, network, address string, opts ...DialOption) (int32, error)
 	CancelAccept(ctx context.Context, listener Listener) error
 	RecvFrom(ctx context.Context, listener Listener) error
 	ReceiveData(ctx context.Context) ([]*NetEvent, error)
 	WaitEvent() error
+	// WaitEventWithTimeout はイベントが来るかKickされるまで最大d待ちます。タイムアウトしたらErrWouldBlockを返します
+	WaitEventWithTimeout(d time.Duration) error
 	RegisterRead(ctx context.Context, fd int32) error
 	Write(ctx context.Context, fd int32, data []byte) error
+	// Writev はbufsを順番に1回の書き込みで送ります。完了はWriteと同じくEVENT_TYPE_WRITEで返ります
+	Writev(ctx context.Context, fd int32, bufs [][]byte) error
+	// SendTo はRecvFromしているfdからtoへdataを1つのデータグラムとして送ります
+	// 完了はEVENT_TYPE_SENDMSGで返ります (失敗ならErr)。dataはそれまで書き換えてはいけません
+	SendTo(ctx context.Context, fd int32, to netip.AddrPort, data []byte) error
+	Flush(ctx context.Context) error
 	PrepareClose() error
 	GetSockAddr(ctx context.Context, fd int32) (*SockAddr, error)
+	// ClosePeer はfdの操作をキャンセルして閉じます。閉じ終わるとEVENT_TYPE_CLOSEが返ります
 	ClosePeer(ctx context.Context, fd int32) error
 	Kick(ctx context.Context) error
 	Close() error
 }
+
+// RingKicker は自分のリングから別のエンジンのイベントループを起こせるエンジンです
+// リアクター間の通知でeventfdへのwriteを省けます。自分のイベントループのゴルーチンからだけ呼べます
+type RingKicker interface {
+	KickRing(ctx context.Context, target NetEngine) error
+}
+
+// NewNetEngine はio_uringが使える場合はUringNetEngineを、
+// io_uring_setupがENOSYS/EPERMで失敗する環境ではEpollNetEngineを返します
+// optsはUringNetEngineが選ばれた場合にだけ使われます
+func NewNetEngine(opts ...UringOption) (NetEngine, error) {
+	err := core.ProbeUring()
+	switch {
+	case err == nil:
+		return NewUringNetEngine(opts...), nil
+	case errors.Is(err, unix.ENOSYS), errors.Is(err, unix.EPERM):
+		slog.Warn("io_uring is not available, falling back to epoll", "err", err)
+		return NewEpollNetEngine()
+	default:
+		return nil, err
+	}
+}
@@ -0,0 +1,73 @@
+//go:build linux
+
+package engine
+
+import (
+	"math"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+)
+
+// defaultZeroCopySendThreshold はWithZeroCopySendで閾値を指定しなかったときの値です
+// 小さい送信はページのピン留めや通知CQEのコストの方が大きいので通常のWRITEにする
+const defaultZeroCopySendThreshold = 16 * 1024
+
+// zeroCopySends は送信中のSEND_ZCを追跡します
+// SEND_ZCは送信結果と通知の2つのCQEを返すので、通知が届くまで結果を預かっておき、
+// 送信したバッファを解放してよくなった時点でまとめてWRITEイベントにします
+type zeroCopySends struct {
+	threshold int
+	next      uint16
+	pending   map[uint16]int32 // 送信ID -> 1つ目のCQEの結果
+}
+
+func newZeroCopySends(threshold int) *zeroCopySends {
+	if threshold <= 0 {
+		threshold = defaultZeroCopySendThreshold
+	}
+	return &zeroCopySends{
+		threshold: threshold,
+		pending:   make(map[uint16]int32),
+	}
+}
+
+// use はこの長さの送信にSEND_ZCを使うかを返します
+func (z *zeroCopySends) use(n int) bool {
+	return n >= z.threshold
+}
+
+// disable は以降の送信をすべて通常のWRITEにします
+// 送信中のSEND_ZCの通知はそのまま受け取れるように追跡は続けます
+func (z *zeroCopySends) disable() {
+	z.threshold = math.MaxInt
+}
+
+// begin は新しい送信IDを払い出します
+// 65535個のSEND_ZCが通知待ちならfalseを返すので、その送信は通常のWRITEにします
+func (z *zeroCopySends) begin() (uint16, bool) {
+	id, ok := allocID(&z.next, func(id uint16) bool {
+		_, inFlight := z.pending[id]
+		return inFlight
+	})
+	if ok {
+		z.pending[id] = 0
+	}
+	return id, ok
+}
+
+// complete はSEND_ZCのCQEを受け取り、バッファを解放してよければ送信結果とtrueを返します
+func (z *zeroCopySends) complete(id uint16, cqe *core.UringCQE) (int32, bool) {
+	if cqe.Flags&core.IORING_CQE_F_NOTIF != 0 {
+		res := z.pending[id]
+		delete(z.pending, id)
+		return res, true
+	}
+	if cqe.Flags&core.IORING_CQE_F_MORE != 0 {
+		// 通知がまだ来るのでカーネルはバッファを使っている
+		z.pending[id] = cqe.Res
+		return 0, false
+	}
+	// 通知が来ない (エラーなど) のでこのCQEで終わり
+	delete(z.pending, id)
+	return cqe.Res, true
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+package engine
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+type SockAddr struct {
+	Fd         int32
+	LocalAddr  netip.AddrPort
+	RemoteAddr netip.AddrPort
+}
+
+// getSockAddr はエンジンの実装によらず、fdからローカル/リモートのアドレスを取得します
+func getSockAddr(fd int32) (*SockAddr, error) {
+	localSockAddr, err := unix.Getsockname(int(fd))
+	if err != nil {
+		return nil, err
+	}
+
+	remoteSockAddr, err := unix.Getpeername(int(fd))
+	if err != nil {
+		return nil, err
+	}
+
+	localAddrPort, err := toAddrPort(localSockAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteAddrPort, err := toAddrPort(remoteSockAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SockAddr{
+		Fd:         fd,
+		LocalAddr:  localAddrPort,
+		RemoteAddr: remoteAddrPort,
+	}, nil
+}
+
+// toAddrPort はunix.Sockaddrをnetip.AddrPortにします
+// デュアルスタックのソケットに来たIPv4の接続 (::ffff:a.b.c.d) はIPv4のアドレスにします
+func toAddrPort(sa unix.Sockaddr) (netip.AddrPort, error) {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		ip := netip.AddrFrom4(addr.Addr)
+		return netip.AddrPortFrom(ip, uint16(addr.Port)), nil
+	case *unix.SockaddrInet6:
+		ip := inet6Addr(addr.Addr, addr.ZoneId)
+		return netip.AddrPortFrom(ip, uint16(addr.Port)), nil
+	case *unix.SockaddrUnix:
+		// unixソケットにはIPアドレスがない
+		return netip.AddrPort{}, nil
+	default:
+		return netip.AddrPort{}, unix.EAFNOSUPPORT
+	}
+}
+
+// parseRawSockaddr はカーネルが書いたsockaddr_in/sockaddr_in6 (ACCEPTのaddrやrecvmsgのmsg_nameなど) を読みます
+func parseRawSockaddr(b []byte) (netip.AddrPort, error) {
+	if len(b) < 2 {
+		return netip.AddrPort{}, unix.EINVAL
+	}
+	// sa_familyはホストのバイトオーダー、ポートはネットワークバイトオーダー
+	switch binary.NativeEndian.Uint16(b[0:2]) {
+	case unix.AF_INET:
+		if len(b) < unix.SizeofSockaddrInet4 {
+			return netip.AddrPort{}, unix.EINVAL
+		}
+		ip := netip.AddrFrom4([4]byte(b[4:8]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[2:4])), nil
+	case unix.AF_INET6:
+		if len(b) < unix.SizeofSockaddrInet6 {
+			return netip.AddrPort{}, unix.EINVAL
+		}
+		ip := inet6Addr([16]byte(b[8:24]), binary.NativeEndian.Uint32(b[24:28]))
+		return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[2:4])), nil
+	default:
+		return netip.AddrPort{}, unix.EAFNOSUPPORT
+	}
+}
+
+func inet6Addr(b [16]byte, scopeID uint32) netip.Addr {
+	ip := netip.AddrFrom16(b)
+	if ip.Is4In6() {
+		return ip.Unmap()
+	}
+	if scopeID != 0 {
+		zone := strconv.FormatUint(uint64(scopeID), 10)
+		if ifi, err := net.InterfaceByIndex(int(scopeID)); err == nil {
+			zone = ifi.Name
+		}
+		ip = ip.WithZone(zone)
+	}
+	return ip
+}
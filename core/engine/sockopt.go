@@ -0,0 +1,129 @@
+//go:build linux
+
+package engine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
+)
+
+// SocketOptions はListenerと接続のソケットオプションです。ゼロ値のフィールドは設定しません (カーネルのデフォルトのまま)
+// Listenerに設定したオプションは、Linuxではacceptした接続にも引き継がれます
+// TCPだけのオプションはUDPとunixソケットでは使いません
+type SocketOptions struct {
+	// NoDelay はTCP_NODELAYを立てて、Nagleアルゴリズムで小さい書き込みを待たせないようにします
+	NoDelay bool
+	// ReusePort はSO_REUSEPORTを立てます (ListenReusePortと同じ)
+	ReusePort bool
+	// RecvBuffer, SendBuffer はSO_RCVBUF, SO_SNDBUFのバイト数です
+	RecvBuffer int
+	SendBuffer int
+	// DeferAccept はTCP_DEFER_ACCEPTで、最初のデータが届くまで最大この時間acceptを遅らせます (秒単位)
+	DeferAccept time.Duration
+	// FastOpen はTCP_FASTOPENのキューの長さです
+	FastOpen int
+	// KeepAlive はSO_KEEPALIVEを立てます。KeepAliveIdle, KeepAliveInterval, KeepAliveCountのどれかを指定しても立ちます
+	KeepAlive         bool
+	KeepAliveIdle     time.Duration // TCP_KEEPIDLE (秒単位)
+	KeepAliveInterval time.Duration // TCP_KEEPINTVL (秒単位)
+	KeepAliveCount    int           // TCP_KEEPCNT
+	// UserTimeout はTCP_USER_TIMEOUTで、送ったデータのACKが来ないまま接続を切るまでの時間です (ミリ秒単位)
+	UserTimeout time.Duration
+	// BusyPoll はSO_BUSY_POLLで、受信を待つときにデバイスをビジーポーリングする時間です (マイクロ秒単位)
+	BusyPoll time.Duration
+	// Backlog はlistenのbacklogです。0ならListenの引数を使います
+	Backlog int
+}
+
+// WithSocketOptions はListenerのソケットオプションを指定します
+func WithSocketOptions(o SocketOptions) ListenOption {
+	return func(c *listenConfig) {
+		c.socket = o
+	}
+}
+
+type sockopt struct {
+	name  string
+	level int
+	opt   int
+	value int
+}
+
+// ApplyConn はfdの接続にオプションを設定します。失敗したオプションがあればそこでエラーを返します
+// acceptした接続はListenerから引き継いでいるので、自分で作った接続 (connectなど) に使います
+func (o SocketOptions) ApplyConn(fd int32) error {
+	return setsockopts(fd, o.connOptions(true))
+}
+
+// connOptions は接続ごとのオプションです
+func (o SocketOptions) connOptions(tcp bool) []sockopt {
+	var opts []sockopt
+	if o.RecvBuffer > 0 {
+		opts = append(opts, sockopt{"SO_RCVBUF", unix.SOL_SOCKET, unix.SO_RCVBUF, o.RecvBuffer})
+	}
+	if o.SendBuffer > 0 {
+		opts = append(opts, sockopt{"SO_SNDBUF", unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer})
+	}
+	if o.BusyPoll > 0 {
+		opts = append(opts, sockopt{"SO_BUSY_POLL", unix.SOL_SOCKET, unix.SO_BUSY_POLL, int(o.BusyPoll.Microseconds())})
+	}
+	if !tcp {
+		return opts
+	}
+	if o.NoDelay {
+		opts = append(opts, sockopt{"TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY, 1})
+	}
+	if o.KeepAlive || o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0 {
+		opts = append(opts, sockopt{"SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1})
+	}
+	if o.KeepAliveIdle > 0 {
+		opts = append(opts, sockopt{"TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, seconds(o.KeepAliveIdle)})
+	}
+	if o.KeepAliveInterval > 0 {
+		opts = append(opts, sockopt{"TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds(o.KeepAliveInterval)})
+	}
+	if o.KeepAliveCount > 0 {
+		opts = append(opts, sockopt{"TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.KeepAliveCount})
+	}
+	if o.UserTimeout > 0 {
+		opts = append(opts, sockopt{"TCP_USER_TIMEOUT", unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout.Milliseconds())})
+	}
+	return opts
+}
+
+// listenerOptions はbindする前にListenerに設定するオプションです
+func (o SocketOptions) listenerOptions(protocol string) []sockopt {
+	tcp := protocol == "tcp"
+	var opts []sockopt
+	if o.ReusePort {
+		opts = append(opts, sockopt{"SO_REUSEPORT", unix.SOL_SOCKET, unix.SO_REUSEPORT, 1})
+	}
+	opts = append(opts, o.connOptions(tcp)...)
+	if !tcp {
+		return opts
+	}
+	if o.DeferAccept > 0 {
+		opts = append(opts, sockopt{"TCP_DEFER_ACCEPT", unix.IPPROTO_TCP, unix.TCP_DEFER_ACCEPT, seconds(o.DeferAccept)})
+	}
+	if o.FastOpen > 0 {
+		opts = append(opts, sockopt{"TCP_FASTOPEN", unix.IPPROTO_TCP, unix.TCP_FASTOPEN, o.FastOpen})
+	}
+	return opts
+}
+
+func setsockopts(fd int32, opts []sockopt) error {
+	for _, o := range opts {
+		if err := core.SetsockoptInt(fd, o.level, o.opt, o.value); err != nil {
+			return fmt.Errorf("setsockopt %s=%d: %w", o.name, o.value, err)
+		}
+	}
+	return nil
+}
+
+// seconds は秒単位のオプションの値です。1秒より短くても0 (無効) にはしません
+func seconds(d time.Duration) int {
+	return max(int((d+time.Second-1)/time.Second), 1)
+}
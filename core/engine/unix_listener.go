@@ -0,0 +1,102 @@
+//go:build linux
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/touka-aoi/low-level-server/core/core"
+	"golang.org/x/sys/unix"
+)
+
+// UnixListener はunixドメインソケットのListenerです
+type UnixListener struct {
+	socket *core.Socket
+	path   string // 閉じるときに消すソケットファイル (抽象名前空間なら空)
+}
+
+func listenUnix(sockType int, path string, listenMaxConnection int, config listenConfig) (Listener, error) {
+	abstract := strings.HasPrefix(path, "@")
+	if !abstract {
+		if err := removeStaleSocket(sockType, path); err != nil {
+			return nil, err
+		}
+	}
+
+	s, err := core.CreateUnixSocket(sockType)
+	if err != nil {
+		return nil, err
+	}
+	if err := setsockopts(s.Fd, config.socket.listenerOptions("unix")); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.BindUnix(path); err != nil {
+		s.Close()
+		return nil, err
+	}
+	l := &UnixListener{socket: s}
+	if !abstract {
+		l.path = path
+		if config.socketMode != 0 {
+			// listenする前に変えて、意図しない相手がつなげる時間を作らない
+			if err := os.Chmod(path, config.socketMode); err != nil {
+				l.Close()
+				return nil, err
+			}
+		}
+	}
+	if err := s.Listen(listenMaxConnection); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket は前に動いていたプロセスが残したソケットファイルを消します
+// つなげてみて誰も待っていなければ (ECONNREFUSED) 古いものとみなします。待っていればEADDRINUSEを返します
+func removeStaleSocket(sockType int, path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s already exists and is not a socket", path)
+	}
+
+	fd, err := unix.Socket(unix.AF_UNIX, sockType|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	err = unix.Connect(fd, &unix.SockaddrUnix{Name: path})
+	switch {
+	case err == nil:
+		return fmt.Errorf("%s: %w", path, unix.EADDRINUSE)
+	case errors.Is(err, unix.ECONNREFUSED):
+		return os.Remove(path)
+	default:
+		return err
+	}
+}
+
+func (l *UnixListener) Close() error {
+	err := l.socket.Close()
+	if l.path != "" {
+		if rmErr := os.Remove(l.path); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+			err = errors.Join(err, rmErr)
+		}
+	}
+	return err
+}
+
+func (l *UnixListener) Fd() int32 {
+	return l.socket.Fd
+}
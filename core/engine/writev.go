@@ -0,0 +1,53 @@
+//go:build linux
+
+package engine
+
+import (
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"golang.org/x/sys/unix"
+)
+
+// pinnedIovecs はカーネルが読み終わっていないWRITEVのiovecを持っておきます
+// iovecとそれが指すバッファをここから参照している間はGCに回収されないので、CQEが届くまでここに置きます
+type pinnedIovecs struct {
+	next     uint16
+	inFlight map[uint16][]unix.Iovec // 送信ID -> iovec
+}
+
+func newPinnedIovecs() *pinnedIovecs {
+	return &pinnedIovecs{
+		inFlight: make(map[uint16][]unix.Iovec),
+	}
+}
+
+// pin はbufsのiovecを作って保持し、CQEで引き当てる送信IDを返します
+// 空のバッファは飛ばします。書くものがなければiovecはnilです
+// 送信IDが65535個すべて使われていればErrWouldBlockを返すので、完了を待ってから送り直します
+func (p *pinnedIovecs) pin(bufs [][]byte) (uint16, []unix.Iovec, error) {
+	iovecs := make([]unix.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+		iov := unix.Iovec{Base: &b[0]}
+		iov.SetLen(len(b))
+		iovecs = append(iovecs, iov)
+	}
+	if len(iovecs) == 0 {
+		return 0, nil, nil
+	}
+	id, ok := allocID(&p.next, func(id uint16) bool {
+		_, used := p.inFlight[id]
+		return used
+	})
+	if !ok {
+		return 0, nil, toukaerrors.ErrWouldBlock
+	}
+	p.inFlight[id] = iovecs
+	return id, iovecs, nil
+}
+
+// unpin はCQEが届いたWRITEVのiovecを手放します
+func (p *pinnedIovecs) unpin(id uint16) {
+	delete(p.inFlight, id)
+}
@@ -15,6 +15,12 @@ const (
 	EVENT_TYPE_TIMEOUT
 	EVENT_TYPE_CANCEL
 	EVENT_TYPE_SENDMSG
+	EVENT_TYPE_FILES_UPDATE
+	EVENT_TYPE_ACCEPT_RETRY
+	EVENT_TYPE_WAKEUP
+	EVENT_TYPE_WRITEV
+	EVENT_TYPE_CLOSE
+	EVENT_TYPE_CONNECT
 	EVENT_TYPE_LAST
 )
 
@@ -36,6 +42,18 @@ func (et EventType) String() string {
 		return "EVENT_TYPE_SENDMSG"
 	case EVENT_TYPE_CANCEL:
 		return "EVENT_TYPE_CANCEL"
+	case EVENT_TYPE_FILES_UPDATE:
+		return "EVENT_TYPE_FILES_UPDATE"
+	case EVENT_TYPE_ACCEPT_RETRY:
+		return "EVENT_TYPE_ACCEPT_RETRY"
+	case EVENT_TYPE_WAKEUP:
+		return "EVENT_TYPE_WAKEUP"
+	case EVENT_TYPE_WRITEV:
+		return "EVENT_TYPE_WRITEV"
+	case EVENT_TYPE_CLOSE:
+		return "EVENT_TYPE_CLOSE"
+	case EVENT_TYPE_CONNECT:
+		return "EVENT_TYPE_CONNECT"
 	case EVENT_TYPE_LAST:
 		return "EVENT_TYPE_LAST"
 	default:
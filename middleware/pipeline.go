@@ -18,6 +18,7 @@ type MiddlewareFunc func(*Context, NextFunc) error
 
 type Pipeline struct {
 	middlewares []MiddlewareFunc
+	stateHooks  []peer.StateHook
 }
 
 func NewPipeline() *Pipeline {
@@ -31,6 +32,17 @@ func (p *Pipeline) Use(middleware MiddlewareFunc) *Pipeline {
 	return p
 }
 
+// OnStateChange は全ての接続の状態が変わったときに呼ぶhookを追加します
+func (p *Pipeline) OnStateChange(hook peer.StateHook) *Pipeline {
+	p.stateHooks = append(p.stateHooks, hook)
+	return p
+}
+
+// StateHooks はOnStateChangeで追加されたhookを返します
+func (p *Pipeline) StateHooks() []peer.StateHook {
+	return p.stateHooks
+}
+
 func (p *Pipeline) Execute(ctx *Context) error {
 	return p.executeMiddleware(0, ctx)
 }
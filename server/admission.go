@@ -0,0 +1,213 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTooManyConnections はMaxConnectionsを超えたので拒否したことを表します
+	ErrTooManyConnections = errors.New("too many connections")
+	// ErrTooManyConnectionsFromIP はMaxConnectionsPerIPを超えたので拒否したことを表します
+	ErrTooManyConnectionsFromIP = errors.New("too many connections from the same address")
+	// ErrAcceptRateExceeded はAcceptRateを超えたので拒否したことを表します
+	ErrAcceptRateExceeded = errors.New("accept rate exceeded")
+	// ErrAddressDenied はCIDRFilterで許可されていない送信元だったことを表します
+	ErrAddressDenied = errors.New("address is not allowed")
+)
+
+// AdmissionFunc は受け付けた接続をOnConnectの前に調べる関数です。エラーを返すとその接続を閉じます
+// 全リアクターから同時に呼ばれるので、ゴルーチンセーフである必要があります
+type AdmissionFunc func(remote netip.AddrPort) error
+
+// CIDRFilter は送信元アドレスを許可リストと拒否リストで調べます
+// 拒否リストに入っていれば拒否し、許可リストが空でなければそこに入っているものだけ通します
+// IPアドレスのない接続 (unixソケット) は同じホストからなので調べずに通します
+type CIDRFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewCIDRFilter は"10.0.0.0/8"や"::1/128"の形のリストからCIDRFilterを作ります
+func NewCIDRFilter(allow, deny []string) (*CIDRFilter, error) {
+	var f CIDRFilter
+	var err error
+	if f.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Admit はAdmissionFuncとして使えます
+func (f *CIDRFilter) Admit(remote netip.AddrPort) error {
+	// デュアルスタックのソケットでは::ffff:a.b.c.dで来るので、IPv4のリストと比べられるようにする
+	addr := remote.Addr().Unmap()
+	if !addr.IsValid() {
+		return nil
+	}
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return ErrAddressDenied
+		}
+	}
+	if len(f.allow) == 0 {
+		return nil
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	return ErrAddressDenied
+}
+
+// Stats は接続の受け付けの統計です
+type Stats struct {
+	// Active は今つながっている (受け付けてからfdを閉じ終えるまでの) 接続の数です
+	Active int
+	// Accepted は受け付けた接続の数です
+	Accepted uint64
+	// Rejected は拒否した接続の数です。内訳が以下のRejected...です
+	Rejected uint64
+
+	RejectedMaxConnections uint64
+	RejectedPerIP          uint64
+	RejectedRate           uint64
+	RejectedAdmission      uint64 // AdmissionFuncが拒否した数
+	RejectedDraining       uint64 // シャットダウン中に届いた数
+}
+
+// admission は接続数と受け付けの速さを制限します
+// MultiReactorServerでは全リアクターで1つを共有するので、制限はサーバー全体にかかります
+type admission struct {
+	maxConnections int
+	maxPerIP       int
+	rate           float64
+	burst          float64
+	admit          AdmissionFunc
+
+	lock   sync.Mutex
+	active int
+	perIP  map[netip.Addr]int
+	tokens float64
+	last   time.Time
+
+	accepted               atomic.Uint64
+	rejectedMaxConnections atomic.Uint64
+	rejectedPerIP          atomic.Uint64
+	rejectedRate           atomic.Uint64
+	rejectedAdmission      atomic.Uint64
+	rejectedDraining       atomic.Uint64
+}
+
+func newAdmission(config NetworkServerConfig) *admission {
+	burst := float64(config.AcceptBurst)
+	if burst <= 0 {
+		burst = max(config.AcceptRate, 1)
+	}
+	return &admission{
+		maxConnections: config.MaxConnections,
+		maxPerIP:       config.MaxConnectionsPerIP,
+		rate:           config.AcceptRate,
+		burst:          burst,
+		admit:          config.Admit,
+		perIP:          make(map[netip.Addr]int),
+		tokens:         burst,
+	}
+}
+
+// acquire はremoteからの接続を受け付けてよいかを調べ、よければ接続数に数えます
+// 受け付けた接続は閉じ終えたところでreleaseします
+func (a *admission) acquire(remote netip.AddrPort, now time.Time) error {
+	if a.admit != nil {
+		if err := a.admit(remote); err != nil {
+			a.rejectedAdmission.Add(1)
+			return err
+		}
+	}
+
+	addr := remote.Addr().Unmap()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.rate > 0 {
+		// トークンバケット: 1秒にrate個たまり、burst個まで持てる
+		if !a.last.IsZero() {
+			a.tokens = min(a.tokens+now.Sub(a.last).Seconds()*a.rate, a.burst)
+		}
+		a.last = now
+		if a.tokens < 1 {
+			a.rejectedRate.Add(1)
+			return ErrAcceptRateExceeded
+		}
+	}
+	if a.maxConnections > 0 && a.active >= a.maxConnections {
+		a.rejectedMaxConnections.Add(1)
+		return ErrTooManyConnections
+	}
+	// unixソケットの接続にはIPアドレスがないので、MaxConnectionsPerIPは数えない
+	if a.maxPerIP > 0 && addr.IsValid() && a.perIP[addr] >= a.maxPerIP {
+		a.rejectedPerIP.Add(1)
+		return ErrTooManyConnectionsFromIP
+	}
+	if a.rate > 0 {
+		a.tokens--
+	}
+	a.active++
+	if addr.IsValid() {
+		a.perIP[addr]++
+	}
+	a.accepted.Add(1)
+	return nil
+}
+
+// release はacquireした接続を数から外します
+func (a *admission) release(remote netip.AddrPort) {
+	addr := remote.Addr().Unmap()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.active--
+	if !addr.IsValid() {
+		return
+	}
+	if a.perIP[addr] <= 1 {
+		delete(a.perIP, addr)
+	} else {
+		a.perIP[addr]--
+	}
+}
+
+func (a *admission) stats() Stats {
+	a.lock.Lock()
+	active := a.active
+	a.lock.Unlock()
+	s := Stats{
+		Active:                 active,
+		Accepted:               a.accepted.Load(),
+		RejectedMaxConnections: a.rejectedMaxConnections.Load(),
+		RejectedPerIP:          a.rejectedPerIP.Load(),
+		RejectedRate:           a.rejectedRate.Load(),
+		RejectedAdmission:      a.rejectedAdmission.Load(),
+		RejectedDraining:       a.rejectedDraining.Load(),
+	}
+	s.Rejected = s.RejectedMaxConnections + s.RejectedPerIP + s.RejectedRate + s.RejectedAdmission + s.RejectedDraining
+	return s
+}
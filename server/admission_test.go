@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCIDRFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		remote string
+		want   error
+	}{
+		{name: "no lists", remote: "192.0.2.1:80"},
+		{name: "allowed", allow: []string{"10.0.0.0/8"}, remote: "10.1.2.3:80"},
+		{name: "not in allow list", allow: []string{"10.0.0.0/8"}, remote: "192.0.2.1:80", want: ErrAddressDenied},
+		{name: "denied", deny: []string{"192.0.2.0/24"}, remote: "192.0.2.1:80", want: ErrAddressDenied},
+		{name: "deny wins over allow", allow: []string{"192.0.2.0/24"}, deny: []string{"192.0.2.1/32"}, remote: "192.0.2.1:80", want: ErrAddressDenied},
+		{name: "unmasked prefix", allow: []string{"10.1.2.3/8"}, remote: "10.200.0.1:80"},
+		{name: "IPv4-mapped IPv6", allow: []string{"10.0.0.0/8"}, remote: "[::ffff:10.0.0.1]:80"},
+		{name: "IPv6", deny: []string{"2001:db8::/32"}, remote: "[2001:db8::1]:80", want: ErrAddressDenied},
+		{name: "IPv6 not in IPv4 allow list", allow: []string{"10.0.0.0/8"}, remote: "[::1]:80", want: ErrAddressDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewCIDRFilter(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatalf("NewCIDRFilter: %v", err)
+			}
+			if err := f.Admit(netip.MustParseAddrPort(tt.remote)); !errors.Is(err, tt.want) {
+				t.Errorf("Admit(%s) = %v, want %v", tt.remote, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewCIDRFilterInvalid(t *testing.T) {
+	if _, err := NewCIDRFilter([]string{"10.0.0.0"}, nil); err == nil {
+		t.Error("NewCIDRFilter accepted an address without a prefix length")
+	}
+	if _, err := NewCIDRFilter(nil, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("NewCIDRFilter accepted an out of range prefix length")
+	}
+}
+
+// admissionStep はテストでadmissionに順に行う操作です
+type admissionStep struct {
+	remote  string
+	at      time.Duration // 最初のacquireからの時間
+	release bool
+	wantErr error
+}
+
+func TestAdmission(t *testing.T) {
+	deny := func(remote netip.AddrPort) error {
+		if remote.Port() == 666 {
+			return ErrAddressDenied
+		}
+		return nil
+	}
+	tests := []struct {
+		name      string
+		config    NetworkServerConfig
+		steps     []admissionStep
+		wantStats Stats
+	}{
+		{
+			name: "no limits",
+			steps: []admissionStep{
+				{remote: "192.0.2.1:1"},
+				{remote: "192.0.2.1:2"},
+				{remote: "192.0.2.1:3"},
+			},
+			wantStats: Stats{Active: 3, Accepted: 3},
+		},
+		{
+			name:   "max connections",
+			config: NetworkServerConfig{MaxConnections: 2},
+			steps: []admissionStep{
+				{remote: "192.0.2.1:1"},
+				{remote: "192.0.2.2:1"},
+				{remote: "192.0.2.3:1", wantErr: ErrTooManyConnections},
+				{remote: "192.0.2.1:1", release: true},
+				{remote: "192.0.2.3:1"},
+			},
+			wantStats: Stats{Active: 2, Accepted: 3, Rejected: 1, RejectedMaxConnections: 1},
+		},
+		{
+			name:   "max connections per IP",
+			config: NetworkServerConfig{MaxConnectionsPerIP: 1},
+			steps: []admissionStep{
+				{remote: "192.0.2.1:1"},
+				{remote: "192.0.2.1:2", wantErr: ErrTooManyConnectionsFromIP},
+				// IPv4-mapped IPv6でも同じアドレスとして数える
+				{remote: "[::ffff:192.0.2.1]:3", wantErr: ErrTooManyConnectionsFromIP},
+				{remote: "192.0.2.2:1"},
+				{remote: "192.0.2.1:1", release: true},
+				{remote: "192.0.2.1:4"},
+			},
+			wantStats: Stats{Active: 2, Accepted: 3, Rejected: 2, RejectedPerIP: 2},
+		},
+		{
+			name:   "token bucket burst and refill",
+			config: NetworkServerConfig{AcceptRate: 10, AcceptBurst: 2},
+			steps: []admissionStep{
+				{remote: "192.0.2.1:1"},
+				{remote: "192.0.2.1:2"},
+				{remote: "192.0.2.1:3", wantErr: ErrAcceptRateExceeded},
+				{remote: "192.0.2.1:4", at: 50 * time.Millisecond, wantErr: ErrAcceptRateExceeded},
+				{remote: "192.0.2.1:5", at: 100 * time.Millisecond},
+				{remote: "192.0.2.1:6", at: 100 * time.Millisecond, wantErr: ErrAcceptRateExceeded},
+				// 長く空いてもburstより多くはたまらない
+				{remote: "192.0.2.1:7", at: time.Minute},
+				{remote: "192.0.2.1:8", at: time.Minute},
+				{remote: "192.0.2.1:9", at: time.Minute, wantErr: ErrAcceptRateExceeded},
+			},
+			wantStats: Stats{Active: 5, Accepted: 5, Rejected: 4, RejectedRate: 4},
+		},
+		{
+			name:   "burst defaults to rate",
+			config: NetworkServerConfig{AcceptRate: 3},
+			steps: []admissionStep{
+				{remote: "192.0.2.1:1"},
+				{remote: "192.0.2.1:2"},
+				{remote: "192.0.2.1:3"},
+				{remote: "192.0.2.1:4", wantErr: ErrAcceptRateExceeded},
+			},
+			wantStats: Stats{Active: 3, Accepted: 3, Rejected: 1, RejectedRate: 1},
+		},
+		{
+			name:   "rejection by limit keeps the token",
+			config: NetworkServerConfig{AcceptRate: 1, AcceptBurst: 1, MaxConnections: 1},
+			steps: []admissionStep{
+				{remote: "192.0.2.1:1", at: -time.Second},
+				{remote: "192.0.2.2:1", wantErr: ErrTooManyConnections},
+				{remote: "192.0.2.1:1", release: true},
+				{remote: "192.0.2.2:1"},
+			},
+			wantStats: Stats{Active: 1, Accepted: 2, Rejected: 1, RejectedMaxConnections: 1},
+		},
+		{
+			name:   "admission func",
+			config: NetworkServerConfig{Admit: deny, MaxConnections: 1},
+			steps: []admissionStep{
+				{remote: "192.0.2.1:666", wantErr: ErrAddressDenied},
+				{remote: "192.0.2.1:1"},
+			},
+			wantStats: Stats{Active: 1, Accepted: 1, Rejected: 1, RejectedAdmission: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdmission(tt.config)
+			start := time.Unix(1000, 0)
+			for i, step := range tt.steps {
+				remote := netip.MustParseAddrPort(step.remote)
+				if step.release {
+					a.release(remote)
+					continue
+				}
+				if err := a.acquire(remote, start.Add(step.at)); !errors.Is(err, step.wantErr) {
+					t.Fatalf("step %d: acquire(%s) = %v, want %v", i, step.remote, err, step.wantErr)
+				}
+			}
+			if got := a.stats(); got != tt.wantStats {
+				t.Errorf("stats = %+v, want %+v", got, tt.wantStats)
+			}
+		})
+	}
+}
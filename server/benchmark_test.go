@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/touka-aoi/low-level-server/core/engine"
+	"github.com/touka-aoi/low-level-server/transport/http"
+	"golang.org/x/sys/unix"
+)
+
+// BenchmarkServeHTTP はUringNetEngineで動かしたNetworkServerに、1つのkeep-alive接続でHTTPリクエストを送ります
+// 1リクエストあたりのio_uring_enterの回数をenters/reqとして報告します
+func BenchmarkServeHTTP(b *testing.B) {
+	e := engine.NewUringNetEngine()
+	router := http.NewRouter()
+	router.GET("/", func(r *http.Request) (*http.ResponseBuilder, error) {
+		return http.NewResponse().Status(200).Text("hello"), nil
+	})
+	ns := NewNetworkServer(e, NetworkServerConfig{Protocol: "tcp"}, nil, http.NewHTTPApplication(router))
+
+	listener, err := engine.Listen("tcp", "127.0.0.1:0", 128)
+	if err != nil {
+		b.Fatalf("Listen: %v", err)
+	}
+	sa, err := unix.Getsockname(int(listener.Fd()))
+	if err != nil {
+		b.Fatalf("Getsockname: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*unix.SockaddrInet4).Port}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := ns.Attach(ctx, listener); err != nil {
+		b.Fatalf("Attach: %v", err)
+	}
+	go ns.Serve(ctx)
+
+	request := []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	buf := make([]byte, 4096)
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		b.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	enters := e.EnterCalls()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := conn.Write(request); err != nil {
+			b.Fatalf("Write: %v", err)
+		}
+		var n int
+		for !bytes.HasSuffix(buf[:n], []byte("hello")) {
+			m, err := conn.Read(buf[n:])
+			if err != nil {
+				b.Fatalf("Read: %v", err)
+			}
+			n += m
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(e.EnterCalls()-enters)/float64(b.N), "enters/req")
+}
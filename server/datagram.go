@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+
+	"github.com/touka-aoi/low-level-server/core/engine"
+	"github.com/touka-aoi/low-level-server/transport"
+)
+
+// ErrNotDatagram はUDPで待ち受けていないサーバーでSendToを呼んだことを表します
+var ErrNotDatagram = errors.New("server is not listening on udp")
+
+// SendTo はこのサーバーのUDPソケットからtoへdataを1つのデータグラムとして送ります。どのゴルーチンから呼んでもかまいません
+// dataは送り終わるまで書き換えないでください。結果はSENDMSGイベントで受け取り、失敗はログに出します
+func (ns *NetworkServer) SendTo(ctx context.Context, to netip.AddrPort, data []byte) error {
+	if ns.config.Protocol != "udp" {
+		return ErrNotDatagram
+	}
+	return ns.Post(ctx, func(ctx context.Context) {
+		if ns.listener == nil || ns.status == Stopped {
+			slog.WarnContext(ctx, "Dropped datagram because the server is not listening", "to", to)
+			return
+		}
+		ns.sendTo(ctx, ns.listener.Fd(), to, data)
+	})
+}
+
+func (ns *NetworkServer) sendTo(ctx context.Context, fd int32, to netip.AddrPort, data []byte) {
+	if err := ns.engine.SendTo(ctx, fd, to, data); err != nil {
+		slog.ErrorContext(ctx, "Failed to send datagram", "fd", fd, "to", to, "error", err)
+	}
+}
+
+// handleDatagram はRECVMSGで届いたデータグラムをappのOnDatagramに渡し、返事があれば送信元へ送ります
+func (ns *NetworkServer) handleDatagram(ctx context.Context, event *engine.NetEvent) {
+	// OnDatagramが返ればdataは使わないので、ゼロコピー受信のバッファはすぐに返す
+	defer event.Release()
+
+	app, ok := ns.app.(transport.DatagramTransport)
+	if !ok {
+		slog.DebugContext(ctx, "Received datagram", "fd", event.Fd, "from", event.RemoteAddr, "dataLength", len(event.Data))
+		return
+	}
+	reply, err := app.OnDatagram(ctx, event.RemoteAddr, event.Data)
+	if err != nil {
+		slog.ErrorContext(ctx, "Application error", "fd", event.Fd, "from", event.RemoteAddr, "error", err)
+		return
+	}
+	if len(reply) == 0 {
+		return
+	}
+	ns.sendTo(ctx, event.Fd, event.RemoteAddr, reply)
+}
+
+// handleSendTo はSendToの完了を受け取ります。UDPなので失敗しても送り直しません
+func (ns *NetworkServer) handleSendTo(ctx context.Context, event *engine.NetEvent) {
+	if event.Err != nil {
+		slog.WarnContext(ctx, "Failed to send datagram", "fd", event.Fd, "to", event.RemoteAddr, "error", event.Err)
+	}
+}
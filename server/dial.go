@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/touka-aoi/low-level-server/core/engine"
+	"github.com/touka-aoi/low-level-server/server/peer"
+)
+
+// DialFunc はDialの結果を受け取る関数で、Dialしたリアクターのイベントループから呼ばれます
+// 失敗したときはpがnilで、errに理由が入ります
+type DialFunc func(ctx context.Context, p *peer.Peer, err error)
+
+// pendingDial はconnectの完了を待っているDialです
+type pendingDial struct {
+	network string
+	address string
+	onDial  DialFunc
+}
+
+func (d *pendingDial) done(ctx context.Context, p *peer.Peer, err error) {
+	if d.onDial == nil {
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("dial %s %s: %w", d.network, d.address, err)
+	}
+	d.onDial(ctx, p, err)
+}
+
+// Dial はこのイベントループからnetwork/addressにつなぎます。どのゴルーチンから呼んでもかまいません
+// networkは"tcp"・"unix"・"unixpacket"で、tcpのaddressはIPアドレスとポートです
+// つながった接続は受け付けた接続と同じくPeerになり、app.OnConnectの後にonDialに渡されます。その後はOnData・OnDisconnectも同じです
+// ctxの期限がconnectのタイムアウトになります (期限がなければカーネルがあきらめるまで待ちます)
+func (ns *NetworkServer) Dial(ctx context.Context, network, address string, onDial DialFunc) error {
+	dialCtx := ctx
+	return ns.Post(ctx, func(ctx context.Context) {
+		d := &pendingDial{network: network, address: address, onDial: onDial}
+		if ns.status != Running {
+			d.done(ctx, nil, ErrServerClosed)
+			return
+		}
+		fd, err := ns.engine.Dial(dialCtx, network, address, engine.WithDialSocketOptions(ns.config.SocketOptions))
+		if err != nil {
+			d.done(ctx, nil, err)
+			return
+		}
+		ns.dialing[fd] = d
+	})
+}
+
+// handleConnect はDialしたconnectの結果を受け取り、つながっていればPeerにします
+func (ns *NetworkServer) handleConnect(ctx context.Context, event *engine.NetEvent) {
+	fd := event.Fd
+	d, ok := ns.dialing[fd]
+	if !ok {
+		// abortDialsでやめた接続
+		slog.DebugContext(ctx, "Connect completed without pending dial", "fd", fd)
+		return
+	}
+	delete(ns.dialing, fd)
+
+	if event.Err != nil {
+		slog.DebugContext(ctx, "Failed to connect", "fd", fd, "address", d.address, "error", event.Err)
+		ns.reject(ctx, fd)
+		d.done(ctx, nil, event.Err)
+		return
+	}
+	sockAddr, err := ns.engine.GetSockAddr(ctx, fd)
+	if err != nil {
+		ns.reject(ctx, fd)
+		d.done(ctx, nil, err)
+		return
+	}
+
+	p := ns.newPeer(ctx, sockAddr, event)
+	p.SetOutbound()
+	slog.DebugContext(ctx, "Connected to peer", "fd", fd, "address", d.address, "localAddr", p.LocalAddr(), "remoteAddr", p.RemoteAddr())
+	if err := ns.establish(ctx, p); err != nil {
+		d.done(ctx, nil, err)
+		return
+	}
+	d.done(ctx, p, nil)
+}
+
+// abortDials はconnect中のDialをすべてやめて、errで失敗させます
+func (ns *NetworkServer) abortDials(ctx context.Context, err error) {
+	for fd, d := range ns.dialing {
+		delete(ns.dialing, fd)
+		ns.reject(ctx, fd)
+		d.done(ctx, nil, err)
+	}
+}
@@ -0,0 +1,160 @@
+//go:build linux
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"runtime"
+	"sync"
+
+	"github.com/touka-aoi/low-level-server/core/engine"
+	"github.com/touka-aoi/low-level-server/middleware"
+	"github.com/touka-aoi/low-level-server/server/peer"
+	"github.com/touka-aoi/low-level-server/transport"
+	"golang.org/x/sys/unix"
+)
+
+type MultiReactorConfig struct {
+	NetworkServerConfig
+	// Reactors はリアクターの数です。0以下ならCPUの数だけ作ります
+	Reactors int
+	// PinCPU はリアクターiのスレッドをCPU i%NumCPUに固定します
+	PinCPU bool
+	// NewEngine はリアクターごとのエンジンを作ります。nilならengine.NewNetEngine()を使います
+	NewEngine func(reactor int) (engine.NetEngine, error)
+}
+
+// MultiReactorServer はリアクター (リング・Listener・接続表を1つずつ持つNetworkServer) をN個動かします
+// ListenerはSO_REUSEPORTで同じポートにbindするので、カーネルが接続をリアクターに振り分けます
+// appとpipelineは全リアクターから同時に呼ばれるので、ゴルーチンセーフである必要があります
+type MultiReactorServer struct {
+	config   MultiReactorConfig
+	reactors []*NetworkServer
+	engines  []engine.NetEngine
+}
+
+func NewMultiReactorServer(config MultiReactorConfig, pipeline *middleware.Pipeline, app transport.Transport) (*MultiReactorServer, error) {
+	if config.Reactors <= 0 {
+		config.Reactors = runtime.NumCPU()
+	}
+	if config.NewEngine == nil {
+		config.NewEngine = func(int) (engine.NetEngine, error) {
+			return engine.NewNetEngine()
+		}
+	}
+	config.ReusePort = true
+
+	s := &MultiReactorServer{config: config}
+	// 接続数の制限はサーバー全体にかけるので、全リアクターで共有する
+	shared := newAdmission(config.NetworkServerConfig)
+	for i := range config.Reactors {
+		e, err := config.NewEngine(i)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("reactor %d: %w", i, err), s.Close())
+		}
+		ns := NewNetworkServer(e, config.NetworkServerConfig, pipeline, app)
+		ns.id = i
+		ns.admission = shared
+		s.engines = append(s.engines, e)
+		s.reactors = append(s.reactors, ns)
+	}
+	return s, nil
+}
+
+// Listen はリアクターごとにSO_REUSEPORTのListenerを作って受け付けを始めます
+func (s *MultiReactorServer) Listen(ctx context.Context) error {
+	for i, ns := range s.reactors {
+		if err := ns.Listen(ctx); err != nil {
+			return fmt.Errorf("reactor %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Serve はリアクターごとにOSスレッドを占有するゴルーチンでイベントループを回し、全部止まるまで待ちます
+// 各リアクターのServeが返したエラーをまとめて返します
+func (s *MultiReactorServer) Serve(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(s.reactors))
+	for i, ns := range s.reactors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+
+			if s.config.PinCPU {
+				var cpus unix.CPUSet
+				cpus.Set(i % runtime.NumCPU())
+				if err := unix.SchedSetaffinity(0, &cpus); err != nil {
+					slog.WarnContext(ctx, "Failed to pin reactor to CPU", "reactor", i, "error", err)
+				}
+			}
+			slog.DebugContext(ctx, "Reactor started", "reactor", i)
+			if err := ns.Serve(ctx); err != nil {
+				errs[i] = fmt.Errorf("reactor %d: %w", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Reactors はリアクターの一覧を返します
+func (s *MultiReactorServer) Reactors() []*NetworkServer {
+	return s.reactors
+}
+
+// Stats は全リアクターを合わせた接続の受け付けの統計を返します
+func (s *MultiReactorServer) Stats() Stats {
+	if len(s.reactors) == 0 {
+		return Stats{}
+	}
+	return s.reactors[0].Stats()
+}
+
+// Post はfnをreactor番目のリアクターのイベントループで実行します
+func (s *MultiReactorServer) Post(ctx context.Context, reactor int, fn func(ctx context.Context)) error {
+	if reactor < 0 || reactor >= len(s.reactors) {
+		return fmt.Errorf("reactor %d does not exist", reactor)
+	}
+	return s.reactors[reactor].Post(ctx, fn)
+}
+
+// Dial はreactor番目のリアクターからnetwork/addressにつなぎます (NetworkServer.Dial)
+func (s *MultiReactorServer) Dial(ctx context.Context, reactor int, network, address string, onDial DialFunc) error {
+	if reactor < 0 || reactor >= len(s.reactors) {
+		return fmt.Errorf("reactor %d does not exist", reactor)
+	}
+	return s.reactors[reactor].Dial(ctx, network, address, onDial)
+}
+
+// SendTo はreactor番目のリアクターのUDPソケットからtoへdataを送ります (NetworkServer.SendTo)
+func (s *MultiReactorServer) SendTo(ctx context.Context, reactor int, to netip.AddrPort, data []byte) error {
+	if reactor < 0 || reactor >= len(s.reactors) {
+		return fmt.Errorf("reactor %d does not exist", reactor)
+	}
+	return s.reactors[reactor].SendTo(ctx, to, data)
+}
+
+// PostToPeer はpを持っているリアクターでfnを実行し、fnが返したデータをpに送信します
+// 別のリアクターが持っている接続に書き込むときに使います
+func (s *MultiReactorServer) PostToPeer(ctx context.Context, p *peer.Peer, fn func(ctx context.Context, p *peer.Peer) []byte) error {
+	if p.Reactor() < 0 || p.Reactor() >= len(s.reactors) {
+		return fmt.Errorf("reactor %d does not exist", p.Reactor())
+	}
+	return s.reactors[p.Reactor()].PostToPeer(ctx, p, fn)
+}
+
+// Close はリアクターのエンジンを閉じます
+func (s *MultiReactorServer) Close() error {
+	var errs []error
+	for _, e := range s.engines {
+		errs = append(errs, e.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -4,8 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"os"
 	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/touka-aoi/low-level-server/core/engine"
@@ -17,13 +22,52 @@ import (
 )
 
 const (
-	maxConnections = 65535
+	defaultDrainTimeout  = 10 * time.Second
+	defaultListenBacklog = 1024
+	// eventWaitTimeout はイベントがないときに寝る最大時間です (Drainingの期限を確認するため)
+	eventWaitTimeout = 100 * time.Millisecond
 )
 
+// reactorKey はServeがハンドラに渡すctxに、実行中のNetworkServerを入れるキーです
+type reactorKey struct{}
+
 type NetworkServerConfig struct {
+	// Protocol は"tcp"・"udp"・"unix"・"unixpacket"のどれかです
 	Protocol string
-	Address  string
-	Port     int
+	// Address はListenするアドレスです。unixソケットならソケットのパスで (@で始まれば抽象名前空間)、Portは使いません
+	Address string
+	Port    int
+	// SendBufferSize は接続ごとの送信バッファの大きさです。0ならpeerのデフォルトを使います
+	SendBufferSize int
+	// OnStateChange は接続の状態が変わるたびに呼ばれます
+	OnStateChange peer.StateHook
+
+	// IdleTimeout は何も読み書きしていない接続 (NewかIdle) を閉じるまでの時間です。0なら閉じません
+	IdleTimeout time.Duration
+	// HeaderReadTimeout はリクエストを読み始めてから、アプリケーションがヘッダを読み終える
+	// (peer.SetReadDeadlineで期限を消す) までの時間です。0なら期限を立てません
+	HeaderReadTimeout time.Duration
+	// WriteTimeout は送信キューにデータがあるのに送信が進まない接続を閉じるまでの時間です。0なら閉じません
+	WriteTimeout time.Duration
+	// DrainTimeout はシャットダウンで接続が閉じ終わるのを待つ時間です。過ぎたら残りを強制的に閉じます。0なら10秒です
+	DrainTimeout time.Duration
+	// ReusePort はSO_REUSEPORTでListenします (同じポートを複数のリアクターで共有するとき)
+	ReusePort bool
+	// SocketOptions はListenerのソケットオプションです。acceptした接続にも引き継がれます
+	SocketOptions engine.SocketOptions
+	// SocketMode はProtocolが"unix"・"unixpacket"のときのソケットファイルのパーミッションです。0ならumaskのままです
+	SocketMode os.FileMode
+
+	// MaxConnections は同時につなげる接続の数です。超えた接続は受け付けてすぐ閉じます。0なら制限しません
+	MaxConnections int
+	// MaxConnectionsPerIP は送信元IPごとの同時接続数です。0なら制限しません
+	MaxConnectionsPerIP int
+	// AcceptRate は1秒あたりに受け付ける接続の数です。0なら制限しません
+	AcceptRate float64
+	// AcceptBurst はAcceptRateに関係なく続けて受け付けられる数です。0ならAcceptRateの1秒分です
+	AcceptBurst int
+	// Admit はOnConnectの前に呼ばれ、エラーを返した接続を拒否します (CIDRFilter.Admitなど)
+	Admit AdmissionFunc
 }
 
 type SrvStatus int
@@ -52,27 +96,47 @@ type NetworkServer struct {
 	pipeline     *middleware.Pipeline
 	app          transport.Transport
 	status       SrvStatus
-	sendingPeer  chan int32
-	sendingQueue []int32
+	sendingQueue []int32                // Sendされて送信待ちのあるピア
+	closing      map[int32]*peer.Peer   // ClosePeerしてEVENT_TYPE_CLOSEを待っている接続 (送信中のバッファを持っておく)
+	dialing      map[int32]*pendingDial // Dialしてconnectの完了を待っているfd
+	admission    *admission
+
+	timers *timerWheel // タイムアウトを見る時刻ごとの接続。タイムアウトがなければnil
+
+	id       int // MultiReactorServerの中でのリアクター番号
+	postLock sync.Mutex
+	posted   []func(ctx context.Context) // 他のゴルーチンから頼まれた、このイベントループで実行する処理
 }
 
 func NewNetworkServer(netEngine engine.NetEngine, config NetworkServerConfig, pipeline *middleware.Pipeline, app transport.Transport) *NetworkServer {
-	return &NetworkServer{
+	ns := &NetworkServer{
 		engine:      netEngine,
 		config:      config,
 		connections: make(map[int32]*peer.Peer),
+		closing:     make(map[int32]*peer.Peer),
+		dialing:     make(map[int32]*pendingDial),
 		pipeline:    pipeline,
 		app:         app,
+		admission:   newAdmission(config),
 		//oreore:      oreore, オレオレも所有してオレオレする必要がありそう
-
-		sendingPeer:  make(chan int32, maxConnections),
-		sendingQueue: make([]int32, maxConnections),
 	}
+	if interval := ns.timeoutCheckInterval(); interval > 0 {
+		ns.timers = newTimerWheel(interval, time.Now())
+	}
+	return ns
+}
+
+// Stats は接続の受け付けの統計を返します。どのゴルーチンから呼んでもかまいません
+func (ns *NetworkServer) Stats() Stats {
+	return ns.admission.stats()
 }
 
-func (ns *NetworkServer) Serve(ctx context.Context) {
+// Serve はctxがキャンセルされるまでイベントループを回し、その後接続を閉じ終えるまで (Draining) 回してから返ります
+// DrainTimeoutまでに閉じ終わらず強制的に閉じた接続があれば、ErrDrainTimeoutを包んだエラーを返します
+func (ns *NetworkServer) Serve(ctx context.Context) error {
 	ns.status = Running
-	var drainingDeadline time.Time
+	var drainingStarted, drainingDeadline time.Time
+	ctx = context.WithValue(ctx, reactorKey{}, ns)
 
 	go func() {
 		select {
@@ -84,150 +148,282 @@ func (ns *NetworkServer) Serve(ctx context.Context) {
 		}
 	}()
 
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case p := <-ns.sendingPeer:
-				ns.sendingQueue = append(ns.sendingQueue, p)
-				if len(ns.sendingQueue) <= 1 {
-					err := ns.engine.Kick(ctx)
-					if err != nil {
-						slog.ErrorContext(ctx, "Failed to kick", "error", err)
-					}
-				}
-			}
-		}
-	}()
-
 	for {
-		for _, fd := range ns.sendingQueue {
-			p := ns.connections[fd]
-			if p.Writer.Length()-p.Writer.QueuedByte() > 0 {
-				b1, b2, ok := p.Writer.ViewFrom(p.Writer.QueuedByte(), p.Writer.Length()-p.Writer.QueuedByte())
-				if !ok {
-					slog.ErrorContext(ctx, "Failed to view data", "error", ok)
-					continue
-				}
-				if len(b1) != 0 {
-					err := ns.engine.Write(ctx, p.Fd(), b1)
-					if err != nil {
-						slog.ErrorContext(ctx, "Failed to write data", "error", err)
-					}
-				}
-				if len(b2) != 0 {
-					err := ns.engine.Write(ctx, p.Fd(), b2)
-					if err != nil {
-						slog.ErrorContext(ctx, "Failed to write data", "error", err)
-					}
-				}
-				p.Writer.Advance2(len(b1) + len(b2))
-			}
-		}
-
-		netEvents, recvError := ns.engine.ReceiveData(ctx)
-		if recvError != nil && !errors.Is(recvError, toukaerrors.ErrWouldBlock) {
-			slog.ErrorContext(ctx, "Failed to receive data", "error", recvError)
+		stepErr := ns.step(ctx)
+		if stepErr != nil && !errors.Is(stepErr, toukaerrors.ErrWouldBlock) {
+			slog.ErrorContext(ctx, "Failed to receive data", "error", stepErr)
 			continue
 		}
 
-		for NetEvent := range slices.Values(netEvents) {
-			switch NetEvent.EventType {
-			case event.EVENT_TYPE_ACCEPT:
-				ns.handleAccept(ctx, NetEvent)
-			case event.EVENT_TYPE_READ:
-				ns.handleRead(ctx, NetEvent)
-			case event.EVENT_TYPE_WRITE:
-				ns.handleWrite(NetEvent)
-			case event.EVENT_TYPE_RECVMSG:
-				slog.DebugContext(ctx, "Received data from peer", "fd", NetEvent.Fd, "dataLength", len(NetEvent.Data), "data", string(NetEvent.Data))
-			default:
-				// 未知のイベントタイプの処理
-			}
-		}
-
 		if ns.status == Running && ctx.Err() != nil {
 			ns.status = Draining
-			drainingDeadline = time.Now().Add(10 * time.Second)
+			drainingStarted = time.Now()
+			drainTimeout := ns.config.DrainTimeout
+			if drainTimeout <= 0 {
+				drainTimeout = defaultDrainTimeout
+			}
+			drainingDeadline = drainingStarted.Add(drainTimeout)
 			err := ns.PrepareClose(ctx)
 			if err != nil {
 				slog.ErrorContext(ctx, "Failed to prepare shutdown", "error", err)
 			}
-			for _, conn := range ns.connections {
-				if conn.Status() == peer.StateIdle.String() {
-					if err := ns.app.OnDisconnect(ctx, conn); err != nil {
-						slog.ErrorContext(ctx, "Application error", "error", err)
-					}
-					//TODO: update peer status compare and swap
-					err := ns.engine.ClosePeer(ctx, conn.Fd())
-					if err != nil {
-						slog.WarnContext(ctx, "Failed to close peer", "error", err)
-					}
-				}
-			}
 		}
 
 		if ns.status == Draining {
-			var unCloseConnections int
-			for _, conn := range ns.connections {
-				if conn.Status() != peer.StateClosed.String() {
-					unCloseConnections++
-				}
+			ns.closeIdlePeers(ctx)
+			if len(ns.connections) == 0 && len(ns.closing) == 0 {
+				ns.status = Stopped
+				slog.InfoContext(ctx, "Server drained", "elapsed", time.Since(drainingStarted))
+				return nil
 			}
-			//if unCloseConnections == 0 {
-			//	ns.status = Stopped
-			//	return
-			//}
 			if time.Now().After(drainingDeadline) {
 				ns.status = Stopped
-				slog.WarnContext(ctx, "Draining timeout exceeded")
-				return
+				remaining := len(ns.connections)
+				slog.WarnContext(ctx, "Draining timeout exceeded, closing remaining connections", "remaining", remaining)
+				for _, conn := range ns.connections {
+					ns.closePeer(ctx, conn, ErrServerClosed)
+				}
+				// 閉じるのを頼んだところで終わる。fdはエンジンのCloseで片付く
+				if err := ns.engine.Flush(ctx); err != nil {
+					slog.ErrorContext(ctx, "Failed to flush submissions", "error", err)
+				}
+				return fmt.Errorf("%w: %d connections were closed forcibly", ErrDrainTimeout, remaining)
 			}
 		}
 
-		// checkPeerStatus
+		ns.checkTimeouts(ctx)
+
+		// 何も起きていなければ、イベントかKickが来るまで寝る
+		if errors.Is(stepErr, toukaerrors.ErrWouldBlock) {
+			err := ns.engine.WaitEventWithTimeout(eventWaitTimeout)
+			if err != nil && !errors.Is(err, toukaerrors.ErrWouldBlock) {
+				slog.ErrorContext(ctx, "Failed to wait event", "error", err)
+			}
+		}
+
+	}
+}
+
+// step はイベントループを1周回します。送信待ちを書き込んでから、届いているイベントを処理します
+// 処理するイベントがなければErrWouldBlockを返します
+func (ns *NetworkServer) step(ctx context.Context) error {
+	ns.runPosted(ctx)
+
+	ns.flushSends(ctx)
+
+	// 前の周のハンドラと上の送信で積んだ操作をまとめて提出する
+	if err := ns.engine.Flush(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to flush submissions", "error", err)
+	}
+
+	netEvents, err := ns.engine.ReceiveData(ctx)
+	if err != nil {
+		return err
+	}
+
+	for NetEvent := range slices.Values(netEvents) {
+		switch NetEvent.EventType {
+		case event.EVENT_TYPE_ACCEPT:
+			ns.handleAccept(ctx, NetEvent)
+		case event.EVENT_TYPE_READ:
+			ns.handleRead(ctx, NetEvent)
+		case event.EVENT_TYPE_WRITE:
+			ns.handleWrite(ctx, NetEvent)
+		case event.EVENT_TYPE_CLOSE:
+			ns.handleClose(ctx, NetEvent)
+		case event.EVENT_TYPE_CONNECT:
+			ns.handleConnect(ctx, NetEvent)
+		case event.EVENT_TYPE_RECVMSG:
+			ns.handleDatagram(ctx, NetEvent)
+		case event.EVENT_TYPE_SENDMSG:
+			ns.handleSendTo(ctx, NetEvent)
+		default:
+			// 未知のイベントタイプの処理
+		}
+	}
+	return nil
+}
+
+// Post はfnをこのサーバーのイベントループで実行します
+// 接続やエンジンはイベントループからしか触れないので、他のゴルーチンからはPost経由で操作します
+func (ns *NetworkServer) Post(ctx context.Context, fn func(ctx context.Context)) error {
+	ns.postLock.Lock()
+	ns.posted = append(ns.posted, fn)
+	ns.postLock.Unlock()
+	return ns.wake(ctx)
+}
+
+// wake はこのサーバーのイベントループを起こします
+// 別のリアクターのイベントループから呼ばれた場合は、そのリングからMSG_RINGで直接起こします
+func (ns *NetworkServer) wake(ctx context.Context) error {
+	if from, ok := ctx.Value(reactorKey{}).(*NetworkServer); ok && from != ns {
+		if kicker, ok := from.engine.(engine.RingKicker); ok {
+			return kicker.KickRing(ctx, ns.engine)
+		}
+	}
+	return ns.engine.Kick(ctx)
+}
 
-		//if errors.Is(recvError, toukaerrors.ErrWouldBlock) {
-		//	err := ns.engine.WaitEvent()
-		//	//slog.DebugContext(ctx, "Wait event Done")
-		//	if err != nil {
-		//		slog.ErrorContext(ctx, "Failed to wait event", "error", err)
-		//	}
-		//}
+// PostToPeer はpを持っているイベントループでfnを実行し、fnが返したデータをpに送信します
+// 実行されるまでにpが切断されていれば、fnは呼ばれません
+// fnが返したデータはコピーせずに積むので、送り終わるまで書き換えないでください
+func (ns *NetworkServer) PostToPeer(ctx context.Context, p *peer.Peer, fn func(ctx context.Context, p *peer.Peer) []byte) error {
+	return ns.Post(ctx, func(ctx context.Context) {
+		if ns.connections[p.Fd()] != p {
+			slog.DebugContext(ctx, "Peer already closed, dropping posted work", "fd", p.Fd())
+			return
+		}
+		ns.send(ctx, p, fn(ctx, p))
+	})
+}
 
+// send はイベントループからpにdataを送り、送信キューに残っている分と一緒に送信待ちにします
+// Sendと同じ送信キューに積むので、他のゴルーチンからSendされたデータと順番が入れ替わりません
+// dataはコピーせずに参照で積むので、大きさにかかわらず送れます (送り終わるまで書き換えてはいけません)
+func (ns *NetworkServer) send(ctx context.Context, p *peer.Peer, data []byte) {
+	if err := p.EnqueueBuffers(data); err != nil {
+		// Closeされた後の送信は捨てる
+		slog.DebugContext(ctx, "Dropping data sent after close", "fd", p.Fd(), "dataLength", len(data), "error", err)
+	}
+	if p.Buffered() > 0 {
+		ns.scheduleSend(p.Fd())
 	}
 }
 
+// flushSends は送信待ちの接続のキューの先頭をエンジンに渡します
+// エンジンが一時的に受け付けられなければ (ErrWouldBlock) 次の周で送り直し、それ以外の失敗では接続を閉じます
+func (ns *NetworkServer) flushSends(ctx context.Context) {
+	var retry []int32
+	for _, fd := range ns.sendingQueue {
+		p, ok := ns.connections[fd]
+		if !ok {
+			// 送信待ちの間に切断された
+			continue
+		}
+		// 送信中の範囲があれば、その完了 (handleWrite) で続きを送る
+		var err error
+		switch bufs := p.TakeUnsent(); len(bufs) {
+		case 0:
+			continue
+		case 1:
+			err = ns.engine.Write(ctx, fd, bufs[0])
+		default:
+			err = ns.engine.Writev(ctx, fd, bufs)
+		}
+		if err == nil {
+			continue
+		}
+		// 渡せなかった範囲は未送信に戻す
+		p.CompleteSend(0)
+		if errors.Is(err, toukaerrors.ErrWouldBlock) {
+			retry = append(retry, fd)
+			continue
+		}
+		slog.ErrorContext(ctx, "Failed to write data, closing peer", "fd", fd, "error", err)
+		ns.closePeer(ctx, p, err)
+	}
+	ns.sendingQueue = append(ns.sendingQueue[:0], retry...)
+}
+
+// scheduleSend はfdを送信待ちに積みます。イベントループからだけ呼びます
+func (ns *NetworkServer) scheduleSend(fd int32) {
+	if !slices.Contains(ns.sendingQueue, fd) {
+		ns.sendingQueue = append(ns.sendingQueue, fd)
+	}
+}
+
+// runPosted はPostされた処理をすべて実行します
+func (ns *NetworkServer) runPosted(ctx context.Context) {
+	ns.postLock.Lock()
+	posted := ns.posted
+	ns.posted = nil
+	ns.postLock.Unlock()
+
+	for _, fn := range posted {
+		fn(ctx)
+	}
+}
+
+// PrepareClose は受け付けをやめ、アプリケーションに接続ごとの別れの挨拶を頼みます (transport.Drainer)
+// 接続はその後、送信キューが空になって待ちに戻ったところでcloseIdlePeersが閉じます
 func (ns *NetworkServer) PrepareClose(ctx context.Context) error {
 	slog.InfoContext(ctx, "Server Prepare to close")
-	if ns.config.Protocol == "tcp" {
+	if isStream(ns.config.Protocol) && ns.listener != nil {
 		slog.DebugContext(ctx, "Shut Prepare to close")
 		err := ns.engine.CancelAccept(ctx, ns.listener)
 		if err != nil {
 			slog.ErrorContext(context.Background(), "Failed to cancel accept", "error", err)
 			return err
 		}
+		// backlogに残っている接続をつながったまま待たせないように、Listenerも閉じる
+		if err := ns.listener.Close(); err != nil {
+			slog.WarnContext(ctx, "Failed to close listener", "error", err)
+		}
 	}
+
+	// つなぎかけの接続は待たずにやめる
+	ns.abortDials(ctx, ErrServerClosed)
+
+	drainer, _ := ns.app.(transport.Drainer)
 	for _, conn := range ns.connections {
-		if conn.Status() != peer.StateClosed.String() {
-			// 閉じることを送信する
-			// オレオレプロトコルここに来れないわ...困っち
+		conn.SetDraining()
+		if drainer == nil {
+			continue
+		}
+		if err := drainer.OnDrain(ctx, conn); err != nil {
+			slog.ErrorContext(ctx, "Application error", "fd", conn.Fd(), "error", err)
 		}
 	}
 	return nil
 }
 
+// closeIdlePeers はDrainingの間、リクエストを処理していない (NewかIdleで送信キューが空の) 接続を閉じます
+func (ns *NetworkServer) closeIdlePeers(ctx context.Context) {
+	for _, conn := range ns.connections {
+		switch conn.State() {
+		case peer.StateNew, peer.StateIdle:
+			if conn.Buffered() == 0 {
+				ns.closePeer(ctx, conn, ErrServerClosed)
+			}
+		}
+	}
+}
+
 func (ns *NetworkServer) Listen(ctx context.Context) error {
-	addr := fmt.Sprintf("%s:%d", ns.config.Address, ns.config.Port)
-	listener, err := engine.Listen(ns.config.Protocol, addr, 1024)
+	addr := ns.config.Address
+	switch ns.config.Protocol {
+	case "tcp", "udp":
+		// IPv6のアドレスは[::1]:8080のように括弧で囲む
+		addr = net.JoinHostPort(ns.config.Address, strconv.Itoa(ns.config.Port))
+	}
+	listen := engine.Listen
+	if ns.config.ReusePort {
+		listen = engine.ListenReusePort
+	}
+	opts := []engine.ListenOption{engine.WithSocketOptions(ns.config.SocketOptions)}
+	if ns.config.SocketMode != 0 {
+		opts = append(opts, engine.WithSocketMode(ns.config.SocketMode))
+	}
+	listener, err := listen(ns.config.Protocol, addr, defaultListenBacklog, opts...)
 	if err != nil {
 		return err
 	}
+
+	if err := ns.Attach(ctx, listener); err != nil {
+		return err
+	}
+
+	slog.Info("Listening on", "address", addr)
+	return nil
+}
+
+// Attach は作成済みのListenerでAccept/RecvFromを開始します
+// LoopbackListenerを渡すとソケットなしでサーバーを動かせます
+func (ns *NetworkServer) Attach(ctx context.Context, listener engine.Listener) error {
 	ns.listener = listener
 
 	switch ns.config.Protocol {
-	case "tcp":
+	case "tcp", "unix", "unixpacket":
 		if err := ns.engine.Accept(ctx, listener); err != nil {
 			slog.ErrorContext(ctx, "Failed to start accepting connections", "error", err)
 			return err
@@ -239,45 +435,118 @@ func (ns *NetworkServer) Listen(ctx context.Context) error {
 		}
 	}
 
-	slog.Info("Listening on", "address", addr)
 	return nil
 }
 
+// isStream はprotocolが接続を受け付けるものかを返します
+func isStream(protocol string) bool {
+	switch protocol {
+	case "tcp", "unix", "unixpacket":
+		return true
+	}
+	return false
+}
+
 func (ns *NetworkServer) handleAccept(ctx context.Context, event *engine.NetEvent) {
+	if event.Err != nil {
+		slog.ErrorContext(ctx, "Stopped accepting connections", "listener", event.Fd, "error", event.Err)
+		return
+	}
 	newFd := event.Fd
 	if newFd < 0 {
 		slog.WarnContext(ctx, "Invalid file descriptor for new connection", "fd", newFd)
 		return
 	}
+	if ns.status != Running {
+		// 受け付けをキャンセルする前に受け付けていた接続
+		slog.DebugContext(ctx, "Rejecting connection while draining", "fd", newFd)
+		ns.admission.rejectedDraining.Add(1)
+		ns.reject(ctx, newFd)
+		return
+	}
 
 	sockAddr, err := ns.engine.GetSockAddr(ctx, newFd)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to get peer name", "fd", newFd, "error", err)
+		ns.reject(ctx, newFd)
 		return
 	}
-	connPeer := peer.NewPeer(sockAddr.Fd, sockAddr.LocalAddr, sockAddr.RemoteAddr)
-	slog.DebugContext(ctx, "Accepted new connection", "fd", newFd, "localAddr", connPeer.LocalAddr, "remoteAddr", connPeer.RemoteAddr)
+	if err := ns.admission.acquire(sockAddr.RemoteAddr, time.Now()); err != nil {
+		slog.DebugContext(ctx, "Rejecting connection", "fd", newFd, "remoteAddr", sockAddr.RemoteAddr, "reason", err)
+		ns.reject(ctx, newFd)
+		return
+	}
+	connPeer := ns.newPeer(ctx, sockAddr, event)
+	if ns.config.HeaderReadTimeout > 0 {
+		connPeer.SetReadDeadline(time.Now().Add(ns.config.HeaderReadTimeout))
+	}
+	slog.DebugContext(ctx, "Accepted new connection", "fd", newFd, "localAddr", connPeer.LocalAddr(), "remoteAddr", connPeer.RemoteAddr())
 
-	ns.connections[newFd] = connPeer
+	if err := ns.establish(ctx, connPeer); err != nil {
+		slog.ErrorContext(ctx, "Failed to establish connection", "fd", newFd, "error", err)
+	}
+}
+
+// newPeer はAcceptかDialした接続のPeerを作って、このイベントループから送信・切断できるようにします
+func (ns *NetworkServer) newPeer(ctx context.Context, sockAddr *engine.SockAddr, event *engine.NetEvent) *peer.Peer {
+	var opts []peer.PeerOption
+	if ns.config.SendBufferSize > 0 {
+		opts = append(opts, peer.WithSendBuffer(ns.config.SendBufferSize))
+	}
+	fd := sockAddr.Fd
+	connPeer := peer.NewPeer(fd, sockAddr.LocalAddr, sockAddr.RemoteAddr, opts...)
+	connPeer.SetReactor(ns.id)
+	connPeer.SetSendNotifier(func() { ns.requestSend(ctx, fd) })
+	connPeer.SetCloseNotifier(func() { ns.requestClose(ctx, connPeer) })
+	if ns.config.OnStateChange != nil {
+		connPeer.OnStateChange(ns.config.OnStateChange)
+	}
+	if ns.pipeline != nil {
+		for _, hook := range ns.pipeline.StateHooks() {
+			connPeer.OnStateChange(hook)
+		}
+	}
+	if event.Fixed {
+		connPeer.SetFixedIndex(event.FixedIndex)
+	}
+	return connPeer
+}
+
+// establish はpを接続表に入れてアプリケーションに知らせ、READを登録します
+// アプリケーションが拒否するか登録に失敗したら、pを閉じてエラーを返します
+func (ns *NetworkServer) establish(ctx context.Context, p *peer.Peer) error {
+	fd := p.Fd()
+	ns.connections[fd] = p
+	ns.watchTimeout(p, time.Now())
 
 	// Applicationに通知
 	if ns.app != nil {
-		if err := ns.app.OnConnect(ctx, connPeer); err != nil {
-			slog.ErrorContext(ctx, "Application rejected connection", "fd", newFd, "error", err)
-			delete(ns.connections, newFd)
-			return
+		if err := ns.app.OnConnect(ctx, p); err != nil {
+			delete(ns.connections, fd)
+			p.Transition(peer.StateClosing)
+			ns.teardown(ctx, p)
+			return fmt.Errorf("application rejected connection: %w", err)
 		}
 	}
 
 	// 新しい接続に対してREAD操作を登録
-	if err := ns.engine.RegisterRead(ctx, connPeer.Fd()); err != nil {
-		slog.ErrorContext(ctx, "Failed to register read operation", "fd", newFd, "error", err)
-		delete(ns.connections, newFd)
-		return
+	if err := ns.engine.RegisterRead(ctx, fd); err != nil {
+		ns.closePeer(ctx, p, err)
+		return fmt.Errorf("failed to register read operation: %w", err)
+	}
+	return nil
+}
+
+// reject はPeerを作らずにfdを閉じます。EVENT_TYPE_CLOSEはhandleCloseで読み捨てます
+func (ns *NetworkServer) reject(ctx context.Context, fd int32) {
+	if err := ns.engine.ClosePeer(ctx, fd); err != nil {
+		slog.WarnContext(ctx, "Failed to close peer", "fd", fd, "error", err)
 	}
 }
 
 func (ns *NetworkServer) handleRead(ctx context.Context, event *engine.NetEvent) {
+	// ゼロコピー受信のバッファはアプリケーションの処理が終わったら返す
+	defer event.Release()
 	fd := event.Fd
 	data := event.Data
 
@@ -286,19 +555,39 @@ func (ns *NetworkServer) handleRead(ctx context.Context, event *engine.NetEvent)
 		return
 	}
 
-	if len(data) == 0 {
-		slog.Warn("Received empty data for read event", "fd", fd)
-		return
-	}
-
-	slog.Debug("Received data from peer", "fd", fd, "dataLength", len(data), "data", string(data))
-
 	p, ok := ns.connections[fd]
 	if !ok {
 		slog.Warn("Peer not found for read event", "fd", fd)
 		return
 	}
 
+	if event.Err != nil {
+		slog.DebugContext(ctx, "Failed to read from peer, closing", "fd", fd, "error", event.Err)
+		ns.closePeer(ctx, p, event.Err)
+		return
+	}
+	// 0バイトの読み込みはピアが接続を閉じた (EOF) ということ
+	if len(data) == 0 {
+		slog.DebugContext(ctx, "Peer closed connection", "fd", fd)
+		ns.closePeer(ctx, p, io.EOF)
+		return
+	}
+	p.Touch()
+	if p.Transition(peer.StateActive) && ns.config.HeaderReadTimeout > 0 {
+		// 新しいリクエストの始まり
+		p.SetReadDeadline(time.Now().Add(ns.config.HeaderReadTimeout))
+	}
+	// 返すものがなければ、処理し終えたところで待ちに戻る
+	// 読み込み期限はアプリケーションが立て直すこともあるので、処理し終えてから登録し直す
+	defer func() {
+		if p.Buffered() == 0 {
+			p.CompareAndSwapState(peer.StateActive, peer.StateIdle)
+		}
+		ns.watchTimeout(p, time.Now())
+	}()
+
+	slog.Debug("Received data from peer", "fd", fd, "dataLength", len(data))
+
 	// ミドルウェア実行（ログ等）
 	if ns.pipeline != nil {
 		// あんまこの設計良くないな
@@ -317,16 +606,12 @@ func (ns *NetworkServer) handleRead(ctx context.Context, event *engine.NetEvent)
 			return
 		}
 
-		// レスポンスがあれば送信
-		if len(response) > 0 {
-			if err := ns.engine.Write(ctx, fd, response); err != nil {
-				slog.Error("Failed to send response", "fd", fd, "error", err)
-			}
-		}
+		// レスポンスがあれば送信。OnDataの中でEnqueueされた分もここで送られる
+		ns.send(ctx, p, response)
 	}
 }
 
-func (ns *NetworkServer) handleWrite(event *engine.NetEvent) {
+func (ns *NetworkServer) handleWrite(ctx context.Context, event *engine.NetEvent) {
 	fd := event.Fd
 	if fd < 0 {
 		slog.Warn("Invalid file descriptor for write event", "fd", fd)
@@ -334,8 +619,103 @@ func (ns *NetworkServer) handleWrite(event *engine.NetEvent) {
 	}
 	p := ns.connections[fd]
 	if p == nil {
-		slog.Warn("Peer not found for write event", "fd", fd)
+		// 閉じた接続のキャンセルされた書き込み
+		slog.DebugContext(ctx, "Peer not found for write event", "fd", fd)
+		return
+	}
+	if event.Err != nil {
+		slog.WarnContext(ctx, "Failed to write to peer, closing", "fd", fd, "error", event.Err)
+		ns.closePeer(ctx, p, event.Err)
+		return
+	}
+	p.Touch()
+	// 短く書けたときは残りが未送信に戻るので、続きと一緒に送り直す
+	if p.CompleteSend(event.SentLength) {
+		ns.scheduleSend(fd)
+		return
+	}
+	// Closeされていれば、送り切ったので閉じる
+	if p.CloseRequested() {
+		ns.closePeer(ctx, p, nil)
+		return
+	}
+	p.CompareAndSwapState(peer.StateActive, peer.StateIdle)
+}
+
+// requestClose はpを閉じるようにイベントループに頼みます (Peer.Closeから呼ばれます)
+// 送信キューが空でなければ、送り切ったときにhandleWriteで閉じます
+func (ns *NetworkServer) requestClose(ctx context.Context, p *peer.Peer) {
+	err := ns.Post(ctx, func(ctx context.Context) {
+		if ns.connections[p.Fd()] != p {
+			return
+		}
+		if p.Buffered() == 0 {
+			ns.closePeer(ctx, p, nil)
+		}
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to request close", "fd", p.Fd(), "error", err)
+	}
+}
+
+// requestSend はfdを送信待ちに積むようにイベントループに頼みます (Peer.Sendから呼ばれます)
+func (ns *NetworkServer) requestSend(ctx context.Context, fd int32) {
+	err := ns.Post(ctx, func(ctx context.Context) {
+		ns.scheduleSend(fd)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to request send", "fd", fd, "error", err)
+	}
+}
+
+// closePeer はアプリケーションに切断を通知してから接続を閉じます
+// EOF・エラー・Close・タイムアウト・シャットダウンのどれで閉じる場合もここを通り、OnDisconnectは1回だけ呼ばれます
+// reasonはOnDisconnectの中でpeer.CloseReasonから見えます
+func (ns *NetworkServer) closePeer(ctx context.Context, p *peer.Peer, reason error) {
+	if ns.connections[p.Fd()] != p || !p.Transition(peer.StateClosing) {
+		// もう閉じている
+		return
+	}
+	slog.DebugContext(ctx, "Closing peer", "fd", p.Fd(), "reason", reason)
+	delete(ns.connections, p.Fd())
+	if ns.timers != nil {
+		ns.timers.remove(p)
+	}
+	p.SetCloseReason(reason)
+	if ns.app != nil {
+		if err := ns.app.OnDisconnect(ctx, p); err != nil {
+			slog.ErrorContext(ctx, "Application error", "fd", p.Fd(), "error", err)
+		}
+	}
+	ns.teardown(ctx, p)
+}
+
+// teardown はエンジンにfdを閉じさせ、EVENT_TYPE_CLOSEが届くまでpを持っておきます
+// カーネルが送信中のバッファを読んでいる間にGCされないようにするためです
+func (ns *NetworkServer) teardown(ctx context.Context, p *peer.Peer) {
+	ns.closing[p.Fd()] = p
+	if err := ns.engine.ClosePeer(ctx, p.Fd()); err != nil {
+		slog.WarnContext(ctx, "Failed to close peer", "fd", p.Fd(), "error", err)
+		ns.handleClose(ctx, &engine.NetEvent{EventType: event.EVENT_TYPE_CLOSE, Fd: p.Fd(), Err: err})
+	}
+}
+
+// handleClose はfdを閉じ終えた接続を片付けます
+func (ns *NetworkServer) handleClose(ctx context.Context, event *engine.NetEvent) {
+	p, ok := ns.closing[event.Fd]
+	if !ok {
+		// Peerを作る前に閉じた接続 (Draining中のAccept)
+		slog.DebugContext(ctx, "Closed fd without peer", "fd", event.Fd)
 		return
 	}
-	p.Writer.Advance(event.SentLength)
+	delete(ns.closing, event.Fd)
+	if event.Err != nil {
+		slog.WarnContext(ctx, "Failed to close peer", "fd", event.Fd, "error", event.Err)
+	}
+	p.Transition(peer.StateClosed)
+	p.ReleaseBuffers()
+	if !p.Outbound() {
+		ns.admission.release(p.RemoteAddr())
+	}
+	slog.DebugContext(ctx, "Peer closed", "fd", event.Fd)
 }
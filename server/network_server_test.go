@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/touka-aoi/low-level-server/core/engine"
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+	"github.com/touka-aoi/low-level-server/core/event"
+	"github.com/touka-aoi/low-level-server/server/peer"
+	"github.com/touka-aoi/low-level-server/transport"
+	"github.com/touka-aoi/low-level-server/transport/http"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	testLocalAddr  = netip.MustParseAddrPort("127.0.0.1:8080")
+	testRemoteAddr = netip.MustParseAddrPort("127.0.0.1:50000")
+)
+
+// recordingApp はOnDataでreplyを返し、接続と切断を覚えておくTransportです
+// コールバックはstepを呼んだテストのゴルーチンで呼ばれます
+type recordingApp struct {
+	reply       []byte
+	connectErr  error
+	peers       map[int32]*peer.Peer
+	disconnects map[int32]int
+}
+
+func newRecordingApp(reply []byte) *recordingApp {
+	return &recordingApp{
+		reply:       reply,
+		peers:       make(map[int32]*peer.Peer),
+		disconnects: make(map[int32]int),
+	}
+}
+
+func (a *recordingApp) OnConnect(ctx context.Context, p *peer.Peer) error {
+	if a.connectErr != nil {
+		return a.connectErr
+	}
+	a.peers[p.Fd()] = p
+	return nil
+}
+
+func (a *recordingApp) OnData(ctx context.Context, p *peer.Peer, data []byte) ([]byte, error) {
+	return a.reply, nil
+}
+
+func (a *recordingApp) OnDisconnect(ctx context.Context, p *peer.Peer) error {
+	a.disconnects[p.Fd()]++
+	return nil
+}
+
+// newTestServer はLoopbackNetEngineの上でappを動かすNetworkServerを作ります
+// Serveは回さないので、テストはイベントを注入してからdrainで処理させます
+func newTestServer(t *testing.T, app transport.Transport) (*NetworkServer, *engine.LoopbackNetEngine) {
+	t.Helper()
+	e := engine.NewLoopbackNetEngine()
+	ns := NewNetworkServer(e, NetworkServerConfig{Protocol: "tcp"}, nil, app)
+	if err := ns.Attach(context.Background(), engine.NewLoopbackListener(3)); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+	return ns, e
+}
+
+// drain は積まれたイベントがなくなるまでイベントループを回します
+func drain(t *testing.T, ns *NetworkServer) {
+	t.Helper()
+	for range 100 {
+		err := ns.step(context.Background())
+		if errors.Is(err, toukaerrors.ErrWouldBlock) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("step: %v", err)
+		}
+	}
+	t.Fatalf("event loop did not settle")
+}
+
+func TestHTTPRequestIsAnswered(t *testing.T) {
+	router := http.NewRouter()
+	router.GET("/", func(r *http.Request) (*http.ResponseBuilder, error) {
+		return http.NewResponse().Status(200).Text("hello"), nil
+	})
+	ns, e := newTestServer(t, http.NewHTTPApplication(router))
+
+	e.InjectAccept(10, testLocalAddr, testRemoteAddr)
+	drain(t, ns)
+	if !e.Reading(10) {
+		t.Fatalf("accepted connection is not reading")
+	}
+
+	e.InjectRead(10, []byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	drain(t, ns)
+
+	response := string(e.Written(10))
+	if !strings.HasPrefix(response, "HTTP/1.1 200") || !strings.HasSuffix(response, "hello") {
+		t.Fatalf("response = %q, want 200 with body hello", response)
+	}
+	if e.Closed(10) {
+		t.Fatalf("keep-alive connection was closed")
+	}
+}
+
+func TestRejectedConnectionIsNotRead(t *testing.T) {
+	app := newRecordingApp(nil)
+	app.connectErr = errors.New("rejected")
+	ns, e := newTestServer(t, app)
+
+	e.InjectAccept(10, testLocalAddr, testRemoteAddr)
+	drain(t, ns)
+
+	if e.Reading(10) {
+		t.Fatalf("rejected connection is reading")
+	}
+	e.InjectRead(10, []byte("request"))
+	drain(t, ns)
+	if got := e.Written(10); len(got) != 0 {
+		t.Fatalf("written %q to a rejected connection", got)
+	}
+}
+
+func TestReplyIsWritten(t *testing.T) {
+	reply := bytes.Repeat([]byte("0123456789"), 100)
+	ns, e := newTestServer(t, newRecordingApp(reply))
+
+	e.InjectAccept(10, testLocalAddr, testRemoteAddr)
+	e.InjectRead(10, []byte("request"))
+	drain(t, ns)
+
+	if got := e.Written(10); !bytes.Equal(got, reply) {
+		t.Fatalf("written %d bytes, want the %d byte reply", len(got), len(reply))
+	}
+}
+
+func TestPeerIsClosedWhenReadEnds(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject func(e *engine.LoopbackNetEngine)
+	}{
+		{name: "eof", inject: func(e *engine.LoopbackNetEngine) { e.InjectDisconnect(10) }},
+		{name: "reset", inject: func(e *engine.LoopbackNetEngine) {
+			e.InjectEvent(&engine.NetEvent{EventType: event.EVENT_TYPE_READ, Fd: 10, Err: unix.ECONNRESET})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newRecordingApp(nil)
+			ns, e := newTestServer(t, app)
+
+			e.InjectAccept(10, testLocalAddr, testRemoteAddr)
+			drain(t, ns)
+			tt.inject(e)
+			drain(t, ns)
+
+			if got := app.disconnects[10]; got != 1 {
+				t.Errorf("OnDisconnect called %d times, want 1", got)
+			}
+			if !e.Closed(10) {
+				t.Errorf("connection was not closed")
+			}
+			if _, ok := ns.connections[10]; ok {
+				t.Errorf("connection is still tracked")
+			}
+		})
+	}
+}
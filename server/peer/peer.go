@@ -2,7 +2,9 @@ package peer
 
 import (
 	"net/netip"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,22 +15,63 @@ type Peer struct {
 	localAddr  netip.AddrPort
 	remoteAddr netip.AddrPort
 	status     atomic.Int32
-	LastActive atomic.Int64
+	LastActive atomic.Int64 // 最後に読み書きした時刻 (UnixNano)
+	fixedIndex int32        // 固定ファイルテーブルのスロット (-1なら未登録)
+	reactor    int          // この接続を持っているリアクターの番号
+	outbound   bool         // こちらからDialした接続
 
 	Reader *RingReader
-	Writer *RingWriter
+
+	// 送信キュー (send.go)。どのゴルーチンからもSendされるのでsendLockで守る
+	sendLock      sync.Mutex
+	writer        *RingWriter   // コピーして積んだ小さいデータ
+	segments      []sendSegment // 送る順に並べたキューの区切り
+	buffered      int           // キューに残っているバイト数 (送信中を含む)
+	inFlight      int           // TakeUnsentで渡して完了を待っているバイト数
+	highWatermark int
+	lowWatermark  int
+	paused        bool
+	onPause       func()
+	onResume      func()
+	sendNotifier  func()
+	sendProgress  time.Time     // 最後に送信が進んだ (か空のキューに積んだ) 時刻
+	flushPending  atomic.Bool   // イベントループに送信を頼んでまだ取り出されていない
+	drained       chan struct{} // 送信が終わってバッファに空きができたことをSendContextに知らせる
+
+	closeRequested atomic.Bool
+	draining       atomic.Bool
+	closeNotifier  func()
+	closeReason    error
+
+	readDeadline atomic.Int64 // この時刻 (UnixNano) までに読み終わらなければ閉じる。0なら期限なし
+
+	hookLock   sync.Mutex
+	stateHooks []StateHook
 }
 
-func NewPeer(fd int32, localAddr netip.AddrPort, remoteAddr netip.AddrPort) *Peer {
+func NewPeer(fd int32, localAddr netip.AddrPort, remoteAddr netip.AddrPort, opts ...PeerOption) *Peer {
 	sessionID := uuid.NewString()
-	return &Peer{
+	p := &Peer{
 		SessionID:  sessionID,
 		fd:         fd,
 		localAddr:  localAddr,
 		remoteAddr: remoteAddr,
+		fixedIndex: -1,
 		Reader:     NewRingReader(4096),
-		Writer:     NewRingWriter(4096),
+		writer:     NewRingWriter(defaultSendBufferSize),
+		drained:    make(chan struct{}, 1),
 	}
+	p.Touch()
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.highWatermark <= 0 || p.highWatermark > p.writer.Capacity() {
+		p.highWatermark = p.writer.Capacity() * 3 / 4
+	}
+	if p.lowWatermark < 0 || p.lowWatermark >= p.highWatermark {
+		p.lowWatermark = p.highWatermark / 3
+	}
+	return p
 }
 
 func (p *Peer) Fd() int32 {
@@ -43,7 +86,173 @@ func (p *Peer) RemoteAddr() netip.AddrPort {
 	return p.remoteAddr
 }
 
+// FixedIndex はエンジンの固定ファイルテーブルに登録されているスロットを返します
+func (p *Peer) FixedIndex() (int32, bool) {
+	return p.fixedIndex, p.fixedIndex >= 0
+}
+
+func (p *Peer) SetFixedIndex(index int32) {
+	p.fixedIndex = index
+}
+
+// Reactor はこの接続を持っているリアクターの番号を返します
+// 接続はそのリアクターのイベントループからしか触れないので、他から触るときはPostToPeerを使います
+func (p *Peer) Reactor() int {
+	return p.reactor
+}
+
+func (p *Peer) SetReactor(reactor int) {
+	p.reactor = reactor
+}
+
+// Outbound はこちらからDialした接続ならtrueを返します (受け付けた接続ならfalse)
+func (p *Peer) Outbound() bool {
+	return p.outbound
+}
+
+func (p *Peer) SetOutbound() {
+	p.outbound = true
+}
+
 func (p *Peer) Status() string {
-	s := p.status.Load()
-	return ConnState(s).String()
+	return p.State().String()
+}
+
+func (p *Peer) State() ConnState {
+	return ConnState(p.status.Load())
+}
+
+// CompareAndSwapState は状態がfromのときだけtoに変えます
+// fromからtoに遷移できない場合や、他のゴルーチンが先に状態を変えた場合はfalseを返します
+func (p *Peer) CompareAndSwapState(from, to ConnState) bool {
+	if !from.CanTransition(to) {
+		return false
+	}
+	if !p.status.CompareAndSwap(int32(from), int32(to)) {
+		return false
+	}
+	p.runStateHooks(from, to)
+	return true
+}
+
+// Transition は今の状態からtoに変えます。今の状態からtoに遷移できなければfalseを返します
+func (p *Peer) Transition(to ConnState) bool {
+	for {
+		from := p.State()
+		if !from.CanTransition(to) {
+			return false
+		}
+		if p.CompareAndSwapState(from, to) {
+			return true
+		}
+	}
+}
+
+// OnStateChange は状態が変わったときに呼ぶhookを追加します
+func (p *Peer) OnStateChange(hook StateHook) {
+	p.hookLock.Lock()
+	defer p.hookLock.Unlock()
+	p.stateHooks = append(p.stateHooks, hook)
+}
+
+func (p *Peer) runStateHooks(from, to ConnState) {
+	p.hookLock.Lock()
+	hooks := p.stateHooks
+	p.hookLock.Unlock()
+	for _, hook := range hooks {
+		hook(p, from, to)
+	}
+}
+
+// Touch はLastActiveを今の時刻にします。読み書きのたびに呼びます
+func (p *Peer) Touch() {
+	p.LastActive.Store(time.Now().UnixNano())
+}
+
+// LastActiveTime はLastActiveをtime.Timeで返します
+func (p *Peer) LastActiveTime() time.Time {
+	return time.Unix(0, p.LastActive.Load())
+}
+
+// SetReadDeadline はtまでに読み終わらなければ接続を閉じるようにします。ゼロ値で期限をなくします
+// HTTPのヘッダ読み込みタイムアウトでは、サーバーがリクエストの始まりで期限を立て、アプリケーションがヘッダを読み終えたら消します
+func (p *Peer) SetReadDeadline(t time.Time) {
+	if t.IsZero() {
+		p.readDeadline.Store(0)
+		return
+	}
+	p.readDeadline.Store(t.UnixNano())
+}
+
+// ReadDeadline はSetReadDeadlineで立てた期限を返します。期限がなければfalseです
+func (p *Peer) ReadDeadline() (time.Time, bool) {
+	d := p.readDeadline.Load()
+	if d == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, d), true
+}
+
+// CloseReason は接続を閉じた理由を返します (OnDisconnectの中で使えます)
+// ピアが閉じた場合はio.EOF、Closeで閉じた場合はnilです
+func (p *Peer) CloseReason() error {
+	return p.closeReason
+}
+
+// SetCloseReason は接続を閉じる理由を記録します。イベントループがOnDisconnectの前に呼びます
+func (p *Peer) SetCloseReason(err error) {
+	p.closeReason = err
+}
+
+// Close は送信キューに残っているデータを送り切ってから接続を閉じるように頼みます。どのゴルーチンから呼んでもかまいません
+// 閉じ終わるとOnDisconnectが呼ばれます
+func (p *Peer) Close() {
+	if !p.closeRequested.CompareAndSwap(false, true) {
+		return
+	}
+	p.sendLock.Lock()
+	notify := p.closeNotifier
+	p.sendLock.Unlock()
+	if notify != nil {
+		notify()
+	}
+}
+
+// Draining はサーバーがシャットダウン中で、この接続もいずれ閉じられることを返します
+// HTTPなら次のレスポンスにConnection: closeをつけるといった判断に使います
+func (p *Peer) Draining() bool {
+	return p.draining.Load()
+}
+
+func (p *Peer) SetDraining() {
+	p.draining.Store(true)
+}
+
+// CloseRequested はCloseが呼ばれたかを返します
+func (p *Peer) CloseRequested() bool {
+	return p.closeRequested.Load()
+}
+
+// SetCloseNotifier はCloseされたときにイベントループへ切断を頼む関数を設定します
+func (p *Peer) SetCloseNotifier(notify func()) {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	p.closeNotifier = notify
+}
+
+// ReleaseBuffers は接続を閉じ終えた後に、受信・送信バッファを手放します
+// これ以降のSendはErrPeerClosedになり、SendContextで待っているゴルーチンも起きます
+func (p *Peer) ReleaseBuffers() {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	if p.writer == nil {
+		return
+	}
+	p.Reader = nil
+	p.writer = nil
+	p.segments = nil
+	p.buffered = 0
+	p.sendNotifier = nil
+	p.closeNotifier = nil
+	close(p.drained)
 }
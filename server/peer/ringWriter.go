@@ -37,6 +37,11 @@ func (p *RingWriter) Advance2(n int) {
 	p.queuedByte += n
 }
 
+// Requeue は送信中にした範囲を未送信に戻します
+func (p *RingWriter) Requeue() {
+	p.queuedByte = 0
+}
+
 func (p *RingWriter) QueuedByte() int {
 	return p.queuedByte
 }
@@ -57,6 +62,14 @@ func (p *RingWriter) ViewFrom(offset, n int) (a, b []byte, ok bool) {
 	return p.ring.ViewFrom(offset, n)
 }
 
+func (p *RingWriter) Capacity() int {
+	return p.ring.Capacity()
+}
+
+func (p *RingWriter) Free() int {
+	return p.ring.Free()
+}
+
 func (p *RingWriter) Length() int {
 	return p.ring.Length()
 }
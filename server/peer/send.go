@@ -0,0 +1,290 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+)
+
+const (
+	defaultSendBufferSize = 64 * 1024
+	// maxSendIovecs は1回のTakeUnsentで返す区切りの数の上限です (IOV_MAXより十分小さくする)
+	maxSendIovecs = 64
+)
+
+// ErrPeerClosed は閉じた接続にSendしたときのエラーです
+var ErrPeerClosed = errors.New("peer is closed")
+
+// sendSegment は送信キューの1区切りです
+// bufがnilならリング (writer) に積んだnバイト、そうでなければコピーせずに参照しているまだ送っていないデータです
+type sendSegment struct {
+	buf []byte
+	n   int
+}
+
+// PeerOption はNewPeerに渡すオプションです
+type PeerOption func(*Peer)
+
+// WithSendBuffer は小さいデータをコピーして積むリングの大きさを指定します (2のべき乗に切り上げ)
+// 送信待ちがこれを超えているとSendはErrWouldBlockを返します。リングに入りきらないデータは別に確保して積みます
+func WithSendBuffer(size int) PeerOption {
+	return func(p *Peer) {
+		p.writer = NewRingWriter(size)
+	}
+}
+
+// WithWatermarks は背圧のしきい値を指定します
+// 送信待ちがhigh以上になるとonPauseを、その後low以下まで減るとonResumeを1回ずつ呼びます
+func WithWatermarks(high, low int) PeerOption {
+	return func(p *Peer) {
+		p.highWatermark = high
+		p.lowWatermark = low
+	}
+}
+
+// OnBackpressure は背圧の通知先を設定します
+// onPauseはSendを呼んだゴルーチンから、onResumeはイベントループから呼ばれます
+func (p *Peer) OnBackpressure(onPause, onResume func()) {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	p.onPause = onPause
+	p.onResume = onResume
+}
+
+// Send はdataを送信キューに積んで、イベントループに送信を頼みます。どのゴルーチンから呼んでもかまいません
+// dataはコピーされます。複数渡すと (ヘッダとボディなど) つなげずに続けて積みます
+// 送信待ちが送信バッファの大きさを超えるなら何も積まずにErrWouldBlockを返します。キューが空ならどんなに大きくても積みます
+func (p *Peer) Send(data ...[]byte) error {
+	if err := p.Enqueue(data...); err != nil {
+		return err
+	}
+	p.notifySend()
+	return nil
+}
+
+// Enqueue はdataを送信キューに積むだけで、イベントループには知らせません
+// OnDataなどイベントループから呼ばれるコールバックの中で積んだ分は、コールバックの後に送信されます
+// 小さいデータはリングにコピーし、入りきらないデータは別に確保したコピーを積みます
+func (p *Peer) Enqueue(data ...[]byte) error {
+	return p.enqueue(data, true)
+}
+
+// EnqueueBuffers はbufsをコピーせずに送信キューに積みます。大きなレスポンスのボディなどに使います
+// bufsは送り終わるまで (CompleteSendで外れるまで) 書き換えてはいけません
+// イベントループで待てない呼び出し元のためのものなので、送信待ちの量にかかわらず積みます (閉じていればErrPeerClosed)
+func (p *Peer) EnqueueBuffers(bufs ...[]byte) error {
+	return p.enqueue(bufs, false)
+}
+
+func (p *Peer) enqueue(data [][]byte, copied bool) error {
+	var total int
+	for _, b := range data {
+		total += len(b)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	p.sendLock.Lock()
+	if p.writer == nil || p.closeRequested.Load() {
+		p.sendLock.Unlock()
+		return ErrPeerClosed
+	}
+	if copied && p.buffered > 0 && p.buffered+total > p.writer.Capacity() {
+		p.sendLock.Unlock()
+		return toukaerrors.ErrWouldBlock
+	}
+	if p.buffered == 0 {
+		// 空のキューに積んだところから送信が進まない時間を数える
+		p.sendProgress = time.Now()
+	}
+	for _, b := range data {
+		p.push(b, copied)
+	}
+	p.buffered += total
+	var onPause func()
+	if !p.paused && p.buffered >= p.highWatermark {
+		p.paused = true
+		onPause = p.onPause
+	}
+	p.sendLock.Unlock()
+
+	if onPause != nil {
+		onPause()
+	}
+	return nil
+}
+
+// push はbをキューの末尾に積みます。sendLockを持って呼びます
+func (p *Peer) push(b []byte, copied bool) {
+	if len(b) == 0 {
+		return
+	}
+	if !copied {
+		p.segments = append(p.segments, sendSegment{buf: b})
+		return
+	}
+	if len(b) > p.writer.Free() {
+		// リングに入りきらないので、リングを待たずに別に確保して積む
+		p.segments = append(p.segments, sendSegment{buf: bytes.Clone(b)})
+		return
+	}
+	_, _ = p.writer.Write(b)
+	if last := len(p.segments) - 1; last >= 0 && p.segments[last].buf == nil {
+		// 続けてリングに積んだ分は1つの区切りにまとめる
+		p.segments[last].n += len(b)
+		return
+	}
+	p.segments = append(p.segments, sendSegment{n: len(b)})
+}
+
+// notifySend はまだ頼んでいなければイベントループに送信を頼みます
+func (p *Peer) notifySend() {
+	p.sendLock.Lock()
+	notify := p.sendNotifier
+	p.sendLock.Unlock()
+	if notify != nil && p.flushPending.CompareAndSwap(false, true) {
+		notify()
+	}
+}
+
+// SendContext はバッファに空きができるまで待ってからSendします
+func (p *Peer) SendContext(ctx context.Context, data ...[]byte) error {
+	for {
+		err := p.Send(data...)
+		if !errors.Is(err, toukaerrors.ErrWouldBlock) {
+			return err
+		}
+		select {
+		case <-p.drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Writable は送信待ちがhighWatermarkより少ないかを返します
+func (p *Peer) Writable() bool {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	return p.writer != nil && p.buffered < p.highWatermark
+}
+
+// Buffered は送信キューに残っているバイト数を返します (送信中を含む)
+func (p *Peer) Buffered() int {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	return p.buffered
+}
+
+// SendStalled は送信キューにデータが残ったまま、最後に送信が進んでからの時間を返します
+// キューが空なら0です
+func (p *Peer) SendStalled(now time.Time) time.Duration {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	if p.buffered == 0 {
+		return 0
+	}
+	return now.Sub(p.sendProgress)
+}
+
+// 以下はイベントループ (NetworkServer) が使います
+
+// SetSendNotifier はSendされたときにイベントループへ送信を頼む関数を設定します
+func (p *Peer) SetSendNotifier(notify func()) {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	p.sendNotifier = notify
+}
+
+// TakeUnsent はキューの先頭から次にエンジンに渡す範囲を返して、送信中にします
+// リングの折り返しや参照で積んだデータは別々のスライスのまま返すので、Writevで1回で送ります
+// 順番が入れ替わらないように送信中の書き込みは1つだけで、送信中ならnilを返します (CompleteSendの後にもう一度呼びます)
+// 返した範囲はCompleteSendされるまで書き換わりません
+func (p *Peer) TakeUnsent() [][]byte {
+	// 取り出した後にSendされたら、もう一度頼んでもらう
+	p.flushPending.Store(false)
+
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+	if p.inFlight > 0 || p.buffered == 0 {
+		return nil
+	}
+	var bufs [][]byte
+	var offset int // リングの中で、この区切りが始まる位置
+	for _, seg := range p.segments {
+		if len(bufs) >= maxSendIovecs-1 {
+			break
+		}
+		if seg.buf != nil {
+			bufs = append(bufs, seg.buf)
+			p.inFlight += len(seg.buf)
+			continue
+		}
+		b1, b2, ok := p.writer.ViewFrom(offset, seg.n)
+		if !ok {
+			break
+		}
+		offset += seg.n
+		bufs = append(bufs, b1)
+		if len(b2) > 0 {
+			bufs = append(bufs, b2)
+		}
+		p.inFlight += seg.n
+		p.writer.Advance2(seg.n)
+	}
+	return bufs
+}
+
+// CompleteSend は送信が終わったnバイトをキューの先頭から外して、まだ送るものが残っているかを返します
+// nが渡した範囲より短ければ (short write)、残りは未送信に戻って次のTakeUnsentで送り直されます
+func (p *Peer) CompleteSend(n int) bool {
+	p.sendLock.Lock()
+	if n > 0 {
+		p.sendProgress = time.Now()
+		p.buffered -= n
+	}
+	for n > 0 && len(p.segments) > 0 {
+		seg := &p.segments[0]
+		if seg.buf != nil {
+			k := min(n, len(seg.buf))
+			seg.buf = seg.buf[k:]
+			n -= k
+			if len(seg.buf) > 0 {
+				break
+			}
+		} else {
+			k := min(n, seg.n)
+			p.writer.Advance(k)
+			seg.n -= k
+			n -= k
+			if seg.n > 0 {
+				break
+			}
+		}
+		// 送り終えた区切りの参照を外してから詰める
+		p.segments[0] = sendSegment{}
+		p.segments = p.segments[1:]
+	}
+	p.inFlight = 0
+	p.writer.Requeue()
+	more := p.buffered > 0
+	var onResume func()
+	if p.paused && p.buffered <= p.lowWatermark {
+		p.paused = false
+		onResume = p.onResume
+	}
+	p.sendLock.Unlock()
+
+	select {
+	case p.drained <- struct{}{}:
+	default:
+	}
+	if onResume != nil {
+		onResume()
+	}
+	return more
+}
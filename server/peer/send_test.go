@@ -0,0 +1,219 @@
+package peer
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	toukaerrors "github.com/touka-aoi/low-level-server/core/errors"
+)
+
+// sendStep はテストでPeerに順に行う操作です
+type sendStep struct {
+	send     int // nバイトSendする
+	buffer   int // nバイトEnqueueBuffersする
+	take     bool
+	complete int // nバイトCompleteSendする
+	wantErr  error
+	wantTake int  // takeで取り出せるバイト数
+	wantBufs int  // takeで返るスライスの数 (0なら確かめない)
+	wantMore bool // completeの後にまだ送るものが残っているか
+}
+
+func TestPeerSendWatermarks(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		high, low    int
+		steps        []sendStep
+		wantPause    int
+		wantResume   int
+		wantBuffered int
+	}{
+		{
+			name:         "below high watermark",
+			size:         16,
+			high:         8,
+			low:          4,
+			steps:        []sendStep{{send: 7}},
+			wantBuffered: 7,
+		},
+		{
+			name:         "pause once at high watermark",
+			size:         16,
+			high:         8,
+			low:          4,
+			steps:        []sendStep{{send: 8}, {send: 4}},
+			wantPause:    1,
+			wantBuffered: 12,
+		},
+		{
+			name: "full buffer would block",
+			size: 16,
+			high: 8,
+			low:  4,
+			steps: []sendStep{
+				{send: 12},
+				{send: 8, wantErr: toukaerrors.ErrWouldBlock},
+			},
+			wantPause:    1,
+			wantBuffered: 12,
+		},
+		{
+			name: "larger than buffer into empty queue",
+			size: 16,
+			high: 8,
+			low:  4,
+			steps: []sendStep{
+				{send: 17},
+				{send: 1, wantErr: toukaerrors.ErrWouldBlock},
+				{take: true, wantTake: 17},
+				{complete: 17, wantMore: false},
+			},
+			wantPause:    1,
+			wantResume:   1,
+			wantBuffered: 0,
+		},
+		{
+			name: "buffer kept in order with copied data",
+			size: 32,
+			high: 32,
+			low:  4,
+			steps: []sendStep{
+				{send: 2},
+				{buffer: 20},
+				{send: 3},
+				{take: true, wantTake: 25, wantBufs: 3},
+				{complete: 7, wantMore: true},
+				{take: true, wantTake: 18, wantBufs: 2},
+				{complete: 15, wantMore: true},
+				{take: true, wantTake: 3, wantBufs: 1},
+			},
+			wantBuffered: 3,
+		},
+		{
+			name: "resume at low watermark",
+			size: 16,
+			high: 8,
+			low:  4,
+			steps: []sendStep{
+				{send: 10},
+				{take: true, wantTake: 10},
+				{complete: 10, wantMore: false},
+			},
+			wantPause:    1,
+			wantResume:   1,
+			wantBuffered: 0,
+		},
+		{
+			name: "stay paused above low watermark",
+			size: 16,
+			high: 8,
+			low:  4,
+			steps: []sendStep{
+				{send: 10},
+				{take: true, wantTake: 10},
+				{complete: 5, wantMore: true},
+			},
+			wantPause:    1,
+			wantBuffered: 5,
+		},
+		{
+			name: "short write is resent",
+			size: 16,
+			high: 8,
+			low:  4,
+			steps: []sendStep{
+				{send: 10},
+				{take: true, wantTake: 10},
+				{complete: 4, wantMore: true},
+				{take: true, wantTake: 6},
+				{complete: 2, wantMore: true},
+			},
+			wantPause:    1,
+			wantResume:   1,
+			wantBuffered: 4,
+		},
+		{
+			name: "one write in flight",
+			size: 16,
+			high: 8,
+			low:  4,
+			steps: []sendStep{
+				{send: 3},
+				{take: true, wantTake: 3},
+				{send: 2},
+				{take: true, wantTake: 0},
+				{complete: 3, wantMore: true},
+				{take: true, wantTake: 2},
+			},
+			wantBuffered: 2,
+		},
+		{
+			name: "take across wrap",
+			size: 16,
+			high: 16,
+			low:  4,
+			steps: []sendStep{
+				{send: 12},
+				{take: true, wantTake: 12},
+				{complete: 12, wantMore: false},
+				{send: 8},
+				{take: true, wantTake: 8, wantBufs: 2},
+				{complete: 4, wantMore: true},
+				{take: true, wantTake: 4, wantBufs: 1},
+			},
+			wantBuffered: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPeer(1, netip.AddrPort{}, netip.AddrPort{}, WithSendBuffer(tt.size), WithWatermarks(tt.high, tt.low))
+			var pause, resume, notified int
+			p.OnBackpressure(func() { pause++ }, func() { resume++ })
+			p.SetSendNotifier(func() { notified++ })
+
+			for i, step := range tt.steps {
+				switch {
+				case step.send > 0:
+					if err := p.Send(make([]byte, step.send)); !errors.Is(err, step.wantErr) {
+						t.Fatalf("step %d: Send(%d) = %v, want %v", i, step.send, err, step.wantErr)
+					}
+				case step.buffer > 0:
+					if err := p.EnqueueBuffers(make([]byte, step.buffer)); err != nil {
+						t.Fatalf("step %d: EnqueueBuffers(%d) = %v", i, step.buffer, err)
+					}
+				case step.take:
+					bufs := p.TakeUnsent()
+					var got int
+					for _, b := range bufs {
+						got += len(b)
+					}
+					if got != step.wantTake {
+						t.Fatalf("step %d: TakeUnsent = %d bytes, want %d", i, got, step.wantTake)
+					}
+					if step.wantBufs > 0 && len(bufs) != step.wantBufs {
+						t.Fatalf("step %d: TakeUnsent = %d buffers, want %d", i, len(bufs), step.wantBufs)
+					}
+				case step.complete > 0:
+					if more := p.CompleteSend(step.complete); more != step.wantMore {
+						t.Fatalf("step %d: CompleteSend(%d) = %v, want %v", i, step.complete, more, step.wantMore)
+					}
+				}
+			}
+
+			if pause != tt.wantPause || resume != tt.wantResume {
+				t.Errorf("pause, resume = %d, %d, want %d, %d", pause, resume, tt.wantPause, tt.wantResume)
+			}
+			if got := p.Buffered(); got != tt.wantBuffered {
+				t.Errorf("Buffered = %d, want %d", got, tt.wantBuffered)
+			}
+			if got, want := p.Writable(), tt.wantBuffered < tt.high; got != want {
+				t.Errorf("Writable = %v, want %v", got, want)
+			}
+			if tt.wantBuffered > 0 && notified == 0 {
+				t.Errorf("send notifier was not called")
+			}
+		})
+	}
+}
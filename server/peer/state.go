@@ -4,19 +4,43 @@ package peer
 type ConnState int32
 
 const (
-	StateNew    ConnState = iota
-	StateActive           // has data transfer
-	StateIdle             // keep-alive
+	StateNew     ConnState = iota
+	StateActive            // has data transfer
+	StateIdle              // keep-alive
+	StateClosing           // closing (waiting for the engine to close the fd)
 	StateClosed
 )
 
 var stateName = map[ConnState]string{
-	StateNew:    "new",
-	StateActive: "active",
-	StateIdle:   "idle",
-	StateClosed: "closed",
+	StateNew:     "new",
+	StateActive:  "active",
+	StateIdle:    "idle",
+	StateClosing: "closing",
+	StateClosed:  "closed",
 }
 
 func (s ConnState) String() string {
 	return stateName[s]
 }
+
+// transitions は状態ごとに遷移できる先です
+// New→Active→Idle→Closing→Closed の順に進み、ActiveとIdleは行き来します。Closingへはどこからでも行けます
+var transitions = map[ConnState][]ConnState{
+	StateNew:     {StateActive, StateClosing},
+	StateActive:  {StateIdle, StateClosing},
+	StateIdle:    {StateActive, StateClosing},
+	StateClosing: {StateClosed},
+}
+
+// CanTransition はsからtoに遷移できるかを返します
+func (s ConnState) CanTransition(to ConnState) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateHook は接続の状態が変わったときに呼ばれます。状態を変えたゴルーチン (通常はイベントループ) から呼ばれます
+type StateHook func(p *Peer, from, to ConnState)
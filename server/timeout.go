@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/touka-aoi/low-level-server/server/peer"
+)
+
+var (
+	// ErrIdleTimeout はIdleTimeoutの間何も読み書きしなかったので閉じたことを表します
+	ErrIdleTimeout = errors.New("idle timeout")
+	// ErrReadTimeout はHeaderReadTimeoutまでにヘッダを読み終えなかったので閉じたことを表します
+	ErrReadTimeout = errors.New("header read timeout")
+	// ErrWriteTimeout はWriteTimeoutの間送信が進まなかったので閉じたことを表します
+	ErrWriteTimeout = errors.New("write timeout")
+	// ErrServerClosed はサーバーのシャットダウンで閉じたことを表します
+	ErrServerClosed = errors.New("server closed")
+	// ErrDrainTimeout はDrainTimeoutまでに接続が閉じ終わらなかったことを表します
+	ErrDrainTimeout = errors.New("drain timeout exceeded")
+)
+
+const (
+	minTimeoutCheckInterval = 10 * time.Millisecond
+	maxTimeoutCheckInterval = time.Second
+)
+
+// timeoutCheckInterval は接続のタイムアウトを見て回る間隔です
+// 一番短いタイムアウトの1/4にするので、閉じるのはタイムアウトから最大その分だけ遅れます
+func (ns *NetworkServer) timeoutCheckInterval() time.Duration {
+	var shortest time.Duration
+	for _, d := range []time.Duration{ns.config.IdleTimeout, ns.config.HeaderReadTimeout, ns.config.WriteTimeout} {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	if shortest == 0 {
+		return 0
+	}
+	return min(max(shortest/4, minTimeoutCheckInterval), maxTimeoutCheckInterval)
+}
+
+// checkTimeouts はタイムアウトした接続を閉じます。イベントループの1周ごとに呼びます
+// 期限が来たバケツの接続だけを見るので、接続がいくら多くても1回に触るのは期限が来た接続だけです
+// ループはイベントがなくてもeventWaitTimeoutごとに起きるので、それより細かい間隔にはなりません
+func (ns *NetworkServer) checkTimeouts(ctx context.Context) {
+	if ns.timers == nil {
+		return
+	}
+	now := time.Now()
+	for _, p := range ns.timers.expire(now) {
+		if ns.connections[p.Fd()] != p {
+			continue
+		}
+		if reason := ns.timedOut(p, now); reason != nil {
+			slog.DebugContext(ctx, "Closing timed out peer", "fd", p.Fd(), "reason", reason)
+			ns.closePeer(ctx, p, reason)
+			continue
+		}
+		// 見ている間に読み書きがあって期限が延びた
+		ns.watchTimeout(p, now)
+	}
+}
+
+// watchTimeout はpのタイムアウトを次に見る時刻をタイマーホイールに登録します
+// 読み書きで期限が延びても登録し直さず、その時刻に見たときに延びた先へ登録し直します
+func (ns *NetworkServer) watchTimeout(p *peer.Peer, now time.Time) {
+	if ns.timers == nil || ns.connections[p.Fd()] != p {
+		return
+	}
+	if next, ok := ns.nextTimeout(p, now); ok {
+		ns.timers.schedule(p, next)
+	}
+}
+
+// nextTimeout はpのタイムアウトを次に見る時刻を返します
+// まだ始まっていない期限 (送信の詰まりやリクエスト処理中のアイドル) は、今始まったとしたときの期限にします
+// それより前には切れないので、その時刻に見ればよい
+func (ns *NetworkServer) nextTimeout(p *peer.Peer, now time.Time) (time.Time, bool) {
+	var next time.Time
+	earliest := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	if d := ns.config.WriteTimeout; d > 0 {
+		earliest(now.Add(d - p.SendStalled(now)))
+	}
+	if deadline, ok := p.ReadDeadline(); ok {
+		earliest(deadline)
+	}
+	if d := ns.config.IdleTimeout; d > 0 {
+		switch p.State() {
+		case peer.StateNew, peer.StateIdle:
+			earliest(p.LastActiveTime().Add(d))
+		default:
+			earliest(now.Add(d))
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// timedOut はpがタイムアウトしていればその理由を返します
+func (ns *NetworkServer) timedOut(p *peer.Peer, now time.Time) error {
+	if d := ns.config.WriteTimeout; d > 0 && p.SendStalled(now) > d {
+		return ErrWriteTimeout
+	}
+	if deadline, ok := p.ReadDeadline(); ok && now.After(deadline) {
+		return ErrReadTimeout
+	}
+	if d := ns.config.IdleTimeout; d > 0 {
+		switch p.State() {
+		case peer.StateNew, peer.StateIdle:
+			if now.Sub(p.LastActiveTime()) > d {
+				return ErrIdleTimeout
+			}
+		}
+	}
+	return nil
+}
+
+const timerWheelSize = 512
+
+// timerWheel は接続をタイムアウトを見る時刻ごとのバケツに分けておきます
+// 時刻をtickで区切り、tick番号をtimerWheelSizeで割った余りのバケツに入れます
+// 1周より先の時刻はそのバケツに残しておき、周ってきたときに時刻を比べます
+type timerWheel struct {
+	tick    time.Duration
+	buckets [timerWheelSize][]timerEntry
+	next    int64                // 次に見るtick番号
+	due     map[*peer.Peer]int64 // 接続 -> 登録しているtick番号
+}
+
+type timerEntry struct {
+	p  *peer.Peer
+	at int64
+}
+
+func newTimerWheel(tick time.Duration, now time.Time) *timerWheel {
+	return &timerWheel{
+		tick: tick,
+		next: now.UnixNano() / int64(tick),
+		due:  make(map[*peer.Peer]int64),
+	}
+}
+
+// schedule はpをdeadlineに見るように登録します
+// もっと早い時刻に登録してあれば何もしません。遅い時刻の登録は古い方を捨てます
+func (w *timerWheel) schedule(p *peer.Peer, deadline time.Time) {
+	// deadlineを過ぎたtickで見るように切り上げる
+	at := max((deadline.UnixNano()+int64(w.tick)-1)/int64(w.tick), w.next)
+	if cur, ok := w.due[p]; ok && cur <= at {
+		return
+	}
+	w.due[p] = at
+	b := &w.buckets[at%timerWheelSize]
+	*b = append(*b, timerEntry{p: p, at: at})
+}
+
+// remove はpの登録を消します。バケツに残ったものは見るときに捨てます
+func (w *timerWheel) remove(p *peer.Peer) {
+	delete(w.due, p)
+}
+
+// expire はnowまでに時刻が来た接続を登録から外して返します
+func (w *timerWheel) expire(now time.Time) []*peer.Peer {
+	end := now.UnixNano() / int64(w.tick)
+	if end < w.next {
+		return nil
+	}
+	// 長く止まっていたときも、全部のバケツを1回ずつ見れば足りる
+	last := min(end, w.next+timerWheelSize-1)
+	var expired []*peer.Peer
+	for t := w.next; t <= last; t++ {
+		b := &w.buckets[t%timerWheelSize]
+		kept := (*b)[:0]
+		for _, e := range *b {
+			switch at, ok := w.due[e.p]; {
+			case !ok || at != e.at:
+				// 閉じたか、別の時刻に登録し直した
+			case e.at > end:
+				kept = append(kept, e)
+			default:
+				delete(w.due, e.p)
+				expired = append(expired, e.p)
+			}
+		}
+		clear((*b)[len(kept):])
+		*b = kept
+	}
+	w.next = end + 1
+	return expired
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/touka-aoi/low-level-server/server/peer"
+)
+
+func TestTimerWheel(t *testing.T) {
+	const tick = 10 * time.Millisecond
+	start := time.Unix(0, 0).Add(1000 * tick)
+
+	type schedule struct {
+		peer  int
+		after time.Duration // startからの時間
+	}
+	type expire struct {
+		after time.Duration
+		want  []int
+	}
+	tests := []struct {
+		name     string
+		schedule []schedule
+		remove   []int
+		expire   []expire
+	}{
+		{
+			name:     "expires on the tick after the deadline",
+			schedule: []schedule{{peer: 0, after: 25 * time.Millisecond}},
+			expire: []expire{
+				{after: 20 * time.Millisecond},
+				{after: 30 * time.Millisecond, want: []int{0}},
+				{after: 40 * time.Millisecond},
+			},
+		},
+		{
+			name: "earlier schedule replaces later",
+			schedule: []schedule{
+				{peer: 0, after: 50 * time.Millisecond},
+				{peer: 0, after: 20 * time.Millisecond},
+			},
+			expire: []expire{
+				{after: 20 * time.Millisecond, want: []int{0}},
+				{after: 50 * time.Millisecond},
+			},
+		},
+		{
+			name: "later schedule is ignored",
+			schedule: []schedule{
+				{peer: 0, after: 20 * time.Millisecond},
+				{peer: 0, after: 50 * time.Millisecond},
+			},
+			expire: []expire{
+				{after: 20 * time.Millisecond, want: []int{0}},
+				{after: 50 * time.Millisecond},
+			},
+		},
+		{
+			name:     "removed",
+			schedule: []schedule{{peer: 0, after: 20 * time.Millisecond}},
+			remove:   []int{0},
+			expire:   []expire{{after: 20 * time.Millisecond}},
+		},
+		{
+			name:     "past deadline expires on the next check",
+			schedule: []schedule{{peer: 0, after: -time.Second}},
+			expire:   []expire{{after: 0, want: []int{0}}},
+		},
+		{
+			name:     "beyond one revolution",
+			schedule: []schedule{{peer: 0, after: (timerWheelSize + 88) * tick}},
+			expire: []expire{
+				{after: timerWheelSize * tick},
+				{after: (timerWheelSize + 88) * tick, want: []int{0}},
+			},
+		},
+		{
+			name: "long stall expires everything once",
+			schedule: []schedule{
+				{peer: 0, after: 30 * time.Millisecond},
+				{peer: 1, after: 100 * tick},
+				{peer: 2, after: (timerWheelSize + 5) * tick},
+			},
+			expire: []expire{
+				{after: 10 * timerWheelSize * tick, want: []int{0, 1, 2}},
+				{after: 11 * timerWheelSize * tick},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newTimerWheel(tick, start)
+			var peers [3]*peer.Peer
+			for i := range peers {
+				peers[i] = peer.NewPeer(int32(i), netip.AddrPort{}, netip.AddrPort{})
+			}
+			for _, s := range tt.schedule {
+				w.schedule(peers[s.peer], start.Add(s.after))
+			}
+			for _, n := range tt.remove {
+				w.remove(peers[n])
+			}
+			for _, e := range tt.expire {
+				var got []int
+				for _, p := range w.expire(start.Add(e.after)) {
+					got = append(got, slices.Index(peers[:], p))
+				}
+				slices.Sort(got)
+				if !slices.Equal(got, e.want) {
+					t.Errorf("expire(+%v) = %v, want %v", e.after, got, e.want)
+				}
+			}
+		})
+	}
+}
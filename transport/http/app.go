@@ -1,9 +1,11 @@
 package http
 
 import (
+	"bytes"
 	"context"
-	"fmt"
 	"log/slog"
+	"time"
+	"unsafe"
 
 	"github.com/touka-aoi/low-level-server/server/peer"
 	"github.com/touka-aoi/low-level-server/transport"
@@ -28,13 +30,61 @@ func (h *HTTPApplication) OnConnect(ctx context.Context, peer *peer.Peer) error
 }
 
 // OnData processes HTTP requests
+// The response header and body are queued on the peer by reference as separate buffers,
+// so they go out in a single vectored write without copying the body
 func (h *HTTPApplication) OnData(ctx context.Context, peer *peer.Peer, data []byte) ([]byte, error) {
+	response := h.handle(ctx, peer, data)
+	draining := peer.Draining()
+	if draining {
+		// The server is shutting down, so tell the client not to reuse this connection
+		response.Header("Connection", "close")
+	}
+	header, body := response.BuildParts()
+	if overlaps(body, data) {
+		// The request body points into the receive buffer, which is reused once OnData returns
+		body = bytes.Clone(body)
+	}
+	if err := peer.EnqueueBuffers(header, body); err != nil {
+		// The peer is already closing, so the response is dropped like any send after close
+		slog.DebugContext(ctx, "Dropping HTTP response", "peer", peer.RemoteAddr(), "error", err)
+		return nil, nil
+	}
+	if draining {
+		peer.Close()
+	}
+	return nil, nil
+}
+
+// overlaps reports whether a and b share any memory
+func overlaps(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	aStart := uintptr(unsafe.Pointer(unsafe.SliceData(a)))
+	bStart := uintptr(unsafe.Pointer(unsafe.SliceData(b)))
+	return aStart < bStart+uintptr(len(b)) && bStart < aStart+uintptr(len(a))
+}
+
+// OnDrain is called when the server starts shutting down
+// Keep-alive connections waiting for a request are closed now, and connections
+// with a request in progress get "Connection: close" on their response
+func (h *HTTPApplication) OnDrain(ctx context.Context, p *peer.Peer) error {
+	switch p.State() {
+	case peer.StateNew, peer.StateIdle:
+		p.Close()
+	}
+	return nil
+}
+
+func (h *HTTPApplication) handle(ctx context.Context, peer *peer.Peer, data []byte) *ResponseBuilder {
 	// Parse HTTP request
 	req, err := ParseHTTPRequest(data)
 	if err != nil {
 		slog.ErrorContext(ctx, "Failed to parse HTTP request", "error", err)
-		return createErrorResponse(400, "Bad Request"), nil
+		return createErrorResponse(400, "Bad Request")
 	}
+	// The header has been read, so the header read timeout no longer applies
+	peer.SetReadDeadline(time.Time{})
 
 	slog.DebugContext(ctx, "HTTP request received",
 		"method", req.Method,
@@ -44,17 +94,17 @@ func (h *HTTPApplication) OnData(ctx context.Context, peer *peer.Peer, data []by
 	// Route the request
 	handler := h.router.Match(req.Method, req.Path)
 	if handler == nil {
-		return createErrorResponse(404, "Not Found"), nil
+		return createErrorResponse(404, "Not Found")
 	}
 
 	// Execute handler
 	response, err := handler(req)
 	if err != nil {
 		slog.ErrorContext(ctx, "Handler error", "error", err)
-		return createErrorResponse(500, "Internal Server Error"), nil
+		return createErrorResponse(500, "Internal Server Error")
 	}
 
-	return response, nil
+	return response
 }
 
 // OnDisconnect is called when a connection is closed
@@ -63,12 +113,14 @@ func (h *HTTPApplication) OnDisconnect(ctx context.Context, peer *peer.Peer) err
 	return nil
 }
 
-func createErrorResponse(status int, message string) []byte {
-	statusText := statusTexts[status]
-	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Length: %d\r\n\r\n%s",
-		status, statusText, len(message), message))
+func createErrorResponse(status int, message string) *ResponseBuilder {
+	return NewResponse().
+		Status(status).
+		Text(message)
 }
 
+var _ transport.Drainer = (*HTTPApplication)(nil)
+
 var statusTexts = map[int]string{
 	200: "OK",
 	400: "Bad Request",
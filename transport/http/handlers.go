@@ -11,36 +11,32 @@ func DefaultHandlers() *Router {
 	router := NewRouter()
 
 	// Home handler
-	router.GET("/", func(req *Request) ([]byte, error) {
+	router.GET("/", func(req *Request) (*ResponseBuilder, error) {
 		return NewResponse().
-			Text("hello! I'm go server !").
-			Build(), nil
+			Text("hello! I'm go server !"), nil
 	})
 
 	// Ping handler
-	router.POST("/ping", func(req *Request) ([]byte, error) {
+	router.POST("/ping", func(req *Request) (*ResponseBuilder, error) {
 		return NewResponse().
-			Text("pong").
-			Build(), nil
+			Text("pong"), nil
 	})
 
 	// Echo handler
-	router.POST("/echo", func(req *Request) ([]byte, error) {
+	router.POST("/echo", func(req *Request) (*ResponseBuilder, error) {
 		if len(req.Body) == 0 {
 			return NewResponse().
 				Status(400).
-				Text("No body provided").
-				Build(), nil
+				Text("No body provided"), nil
 		}
 
 		return NewResponse().
 			Header("X-Echo-Length", fmt.Sprintf("%d", len(req.Body))).
-			Body(req.Body).
-			Build(), nil
+			Body(req.Body), nil
 	})
 
 	// JSON API example
-	router.GET("/api/status", func(req *Request) ([]byte, error) {
+	router.GET("/api/status", func(req *Request) (*ResponseBuilder, error) {
 		status := map[string]interface{}{
 			"status": "ok",
 			"server": "low-level-server",
@@ -53,12 +49,11 @@ func DefaultHandlers() *Router {
 		}
 
 		return NewResponse().
-			JSON(data).
-			Build(), nil
+			JSON(data), nil
 	})
 
 	// File upload handler (example)
-	router.POST("/upload", func(req *Request) ([]byte, error) {
+	router.POST("/upload", func(req *Request) (*ResponseBuilder, error) {
 		contentType := req.Headers["Content-Type"]
 		slog.Info("Upload request", "contentType", contentType, "size", len(req.Body))
 
@@ -71,12 +66,11 @@ func DefaultHandlers() *Router {
 
 		data, _ := json.Marshal(response)
 		return NewResponse().
-			JSON(data).
-			Build(), nil
+			JSON(data), nil
 	})
 
 	// Media serving example
-	router.GET("/media/*", func(req *Request) ([]byte, error) {
+	router.GET("/media/*", func(req *Request) (*ResponseBuilder, error) {
 		// Extract file path
 		// For example: /media/video.m3u8
 		
@@ -84,16 +78,14 @@ func DefaultHandlers() *Router {
 		// For now, return 404
 		return NewResponse().
 			Status(404).
-			Text("Media serving not implemented yet").
-			Build(), nil
+			Text("Media serving not implemented yet"), nil
 	})
 
 	// Health check
-	router.GET("/health", func(req *Request) ([]byte, error) {
+	router.GET("/health", func(req *Request) (*ResponseBuilder, error) {
 		return NewResponse().
 			Header("Cache-Control", "no-cache").
-			Text("OK").
-			Build(), nil
+			Text("OK"), nil
 	})
 
 	return router
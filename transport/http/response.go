@@ -59,6 +59,13 @@ func (r *ResponseBuilder) HTML(html string) *ResponseBuilder {
 
 // Build creates the final HTTP response bytes
 func (r *ResponseBuilder) Build() []byte {
+	header, body := r.BuildParts()
+	return append(header, body...)
+}
+
+// BuildParts creates the status line and headers, and returns them with the body
+// without concatenating, so they can be sent with a single vectored write
+func (r *ResponseBuilder) BuildParts() (header, body []byte) {
 	// Set default headers
 	if _, ok := r.headers["Date"]; !ok {
 		r.headers["Date"] = time.Now().UTC().Format(time.RFC1123)
@@ -67,22 +74,17 @@ func (r *ResponseBuilder) Build() []byte {
 		r.headers["Server"] = "low-level-server/1.0"
 	}
 
-	// Build response
+	// Build status line
 	statusText := statusTexts[r.status]
-	response := fmt.Sprintf("HTTP/1.1 %d %s\r\n", r.status, statusText)
+	header = fmt.Appendf(header, "HTTP/1.1 %d %s\r\n", r.status, statusText)
 
 	// Add headers
 	for key, value := range r.headers {
-		response += fmt.Sprintf("%s: %s\r\n", key, value)
+		header = fmt.Appendf(header, "%s: %s\r\n", key, value)
 	}
 
 	// End headers
-	response += "\r\n"
+	header = append(header, "\r\n"...)
 
-	// Add body if present
-	if len(r.body) > 0 {
-		response += string(r.body)
-	}
-
-	return []byte(response)
-}
\ No newline at end of file
+	return header, r.body
+}
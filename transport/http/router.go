@@ -5,7 +5,10 @@ import (
 	"sync"
 )
 
-type HandlerFunc func(*Request) ([]byte, error)
+// HandlerFunc はリクエストを処理してレスポンスを返します
+// ヘッダとボディは別々のバッファのまま送信するので、BuildせずにResponseBuilderを返します
+// ボディはコピーせずに送信キューに積むので、送り終わるまで書き換えないでください
+type HandlerFunc func(*Request) (*ResponseBuilder, error)
 
 type Router struct {
 	mu     sync.RWMutex
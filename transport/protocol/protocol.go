@@ -78,6 +78,7 @@ func ParseFrame(data []byte) (*Frame, error) {
 
 func (f *Frame) Marshal() []byte {
 	buf := make([]byte, HeaderSize+len(f.Payload))
+	binary.BigEndian.PutUint16(buf[0:2], MagicNumber)
 	buf[2] = f.Type
 	binary.BigEndian.PutUint32(buf[3:7], uint32(len(f.Payload)))
 	// コピーしたくないけど方法を知らない
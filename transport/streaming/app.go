@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"log/slog"
+	"time"
 
 	"github.com/touka-aoi/low-level-server/server/peer"
 	"github.com/touka-aoi/low-level-server/transport"
@@ -33,19 +34,27 @@ func (l *LiveStreamingApp) SetHandler(handler protocol.LiveProtocol) {
 	l.handler = handler
 }
 
-func (l LiveStreamingApp) OnConnect(ctx context.Context, peer *peer.Peer) error {
+func (l LiveStreamingApp) OnConnect(ctx context.Context, p *peer.Peer) error {
 	//TODO implement me
 	// 認証情報の検証や接続管理などをここに入れたい
 	go func() {
 		slog.DebugContext(ctx, "start sending test")
 		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
 	LOOP:
 		for {
 			select {
 			case <-ctx.Done():
 				break LOOP
 			case <-ticker.C:
-				peer.Writer.Feed([]byte("this is sending test"))
+				err := p.Send([]byte("this is sending test"))
+				if errors.Is(err, peer.ErrPeerClosed) {
+					// 接続が閉じたら送るのをやめる
+					break LOOP
+				}
+				if err != nil {
+					slog.WarnContext(ctx, "Failed to send test data", "error", err)
+				}
 			}
 		}
 		slog.DebugContext(ctx, "end sending test")
@@ -112,9 +121,19 @@ func (l *LiveStreamingApp) processFrame(ctx context.Context, frame *protocol.Fra
 }
 
 func (l LiveStreamingApp) OnDisconnect(ctx context.Context, peer *peer.Peer) error {
-	//TODO implement me
 	// 接続管理を入れる
-	panic("implement me")
+	slog.DebugContext(ctx, "Live connection closed", "session", peer.SessionID, "reason", peer.CloseReason())
+	return nil
+}
+
+// OnDrain はサーバーが止まるときに、CmdDisconnectの制御フレームを送ってから閉じます
+func (l LiveStreamingApp) OnDrain(ctx context.Context, peer *peer.Peer) error {
+	frame := protocol.Frame{Type: protocol.TYPE_CONTROL, Payload: []byte{protocol.CmdDisconnect}}
+	if err := peer.Enqueue(frame.Marshal()); err != nil {
+		slog.WarnContext(ctx, "Failed to queue disconnect frame", "session", peer.SessionID, "error", err)
+	}
+	peer.Close()
+	return nil
 }
 
 func (l LiveStreamingApp) handleControl() {
@@ -126,7 +145,10 @@ func (l LiveStreamingApp) handleData() {
 func (l LiveStreamingApp) handleHeartbeat() {
 }
 
-var _ transport.Transport = (*LiveStreamingApp)(nil)
+var (
+	_ transport.Transport = (*LiveStreamingApp)(nil)
+	_ transport.Drainer   = (*LiveStreamingApp)(nil)
+)
 
 func NewLiveStreamingApp() *LiveStreamingApp {
 	return &LiveStreamingApp{}
@@ -2,12 +2,30 @@ package transport
 
 import (
 	"context"
+	"net/netip"
 
 	"github.com/touka-aoi/low-level-server/server/peer"
 )
 
 type Transport interface {
 	OnConnect(ctx context.Context, peer *peer.Peer) error
+	// OnData のdataは呼び出し中だけ有効です
+	// ゼロコピー受信ではカーネルと共有しているバッファを指すので、保持したい場合はコピーします (peer.Reader.Feedはコピーします)
+	// 返したデータはコピーせずに送信キューに積まれるので、送り終わるまで書き換えないでください
 	OnData(ctx context.Context, peer *peer.Peer, data []byte) ([]byte, error)
 	OnDisconnect(ctx context.Context, peer *peer.Peer) error
 }
+
+// Drainer はサーバーのシャットダウンで、プロトコルごとの別れの挨拶を送れるTransportです
+// OnDrainはシャットダウンが始まったときに接続ごとに1回、イベントループから呼ばれます
+// 挨拶をEnqueueしてpeer.Closeを呼べば、送り切ってから閉じます。何もしなければ、リクエストを処理していない接続から閉じられます
+type Drainer interface {
+	OnDrain(ctx context.Context, peer *peer.Peer) error
+}
+
+// DatagramTransport はUDPのデータグラムを受け取れるTransportです
+// OnDatagramはデータグラムが届くたびにイベントループから呼ばれ、返したデータはfromへ1つのデータグラムとして送られます (nilか空なら返事はしません)
+// dataは呼び出し中だけ有効なので、返事や保持に使うときはコピーします。返したスライスは送り終わるまで書き換えないでください
+type DatagramTransport interface {
+	OnDatagram(ctx context.Context, from netip.AddrPort, data []byte) ([]byte, error)
+}